@@ -0,0 +1,46 @@
+// fakecto 本地运行模拟的cto.new上游，配合 clerk_base_url 等配置项使用
+package main
+
+import (
+	"cto2api/internal/fakeupstream"
+	"cto2api/services"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:7040", "监听地址")
+	cookie := flag.String("cookie", "fake-cookie", "可用的Cookie，多个用逗号分隔")
+	reply := flag.String("reply", "Hello from fakecto", "固定回复内容，按空格拆分为多个update帧")
+	flag.Parse()
+
+	server, err := fakeupstream.NewOn(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer server.Close()
+
+	words := strings.SplitAfter(*reply, " ")
+	for _, c := range strings.Split(*cookie, ",") {
+		server.AddAccount(&fakeupstream.Account{
+			Cookie: strings.TrimSpace(c),
+			Reply:  words,
+			Billing: services.BillingInfo{
+				Active:               true,
+				TaskCreditsLimit:     1000,
+				TaskConcurrencyLimit: 5,
+			},
+		})
+	}
+
+	endpoints := server.Endpoints()
+	log.Printf("模拟上游已启动: %s", server.URL)
+	log.Printf("CTO_CLERK_BASE_URL=%s CTO_API_BASE_URL=%s CTO_STREAM_BASE_URL=%s", endpoints.ClerkBaseURL, endpoints.APIBaseURL, endpoints.StreamBaseURL)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	<-stop
+}
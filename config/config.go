@@ -11,8 +11,82 @@ import (
 type Config struct {
 	Port         int    `json:"port"`
 	Host         string `json:"host"`
-	DataFile     string `json:"data_file"`
+	DataFile     string `json:"data_file"`     // 旧版JSON数据文件，数据库为空时从中导入
 	PasswordHash string `json:"password_hash"` // bcrypt hash
+
+	// 数据存储（bbolt数据库）
+	DBFile            string `json:"db_file"`
+	StoreFlushSeconds int    `json:"store_flush_seconds"` // 请求计数、用量和健康状态的批量写入间隔
+
+	// 管理会话
+	SessionSecret      string `json:"session_secret"`        // 管理token签名密钥，为空时每次启动随机生成
+	AdminTokenTTLHours int    `json:"admin_token_ttl_hours"` // 管理token有效期（小时）
+
+	// 提示词组装
+	PromptTemplate   string `json:"prompt_template"`   // plain / xml / last_user
+	PromptTruncation string `json:"prompt_truncation"` // drop_oldest / drop_middle / tail
+	PromptMaxBytes   int    `json:"prompt_max_bytes"`  // prompt最大字节数，0表示不限制
+
+	// 会话亲和（复用上游chatHistoryId）
+	ConversationAffinity   bool `json:"conversation_affinity"`
+	ConversationTTLMinutes int  `json:"conversation_ttl_minutes"`
+
+	// 上游地址（可指向测试镜像、录制回放服务或本地模拟服务）
+	ClerkBaseURL      string `json:"clerk_base_url"`
+	APIBaseURL        string `json:"api_base_url"`
+	StreamBaseURL     string `json:"stream_base_url"`
+	ClerkAPIVersion   string `json:"clerk_api_version"`
+	ClerkJSVersion    string `json:"clerk_js_version"`
+	ClerkJWTJSVersion string `json:"clerk_jwt_js_version"` // 获取JWT时的 _clerk_js_version，tokens接口沿用旧版本号
+	RecordDir         string `json:"record_dir"`           // 非空时将上游HTTP交互和WebSocket帧录制到该目录
+
+	// Cookie选择策略
+	CookieStrategy string `json:"cookie_strategy"` // round_robin / weighted / least_in_flight / most_credits / random
+
+	// 用量刷新
+	UsageRefreshMinutes int `json:"usage_refresh_minutes"` // 每个Cookie的用量刷新间隔（带随机抖动）
+
+	// 上游失败自动切换Cookie
+	FailoverMaxAttempts    int `json:"failover_max_attempts"`    // 单次请求最多尝试的Cookie数
+	FailoverTimeoutSeconds int `json:"failover_timeout_seconds"` // 超过该时间不再发起新的尝试
+
+	// Responses API
+	ResponseTTLHours int `json:"response_ttl_hours"` // 保存的响应（previous_response_id）有效期
+
+	// 限流与排队
+	RateLimitGlobalRPM   int `json:"rate_limit_global_rpm"`   // 全局每分钟请求数（令牌桶），0表示不限制
+	RateLimitGlobalBurst int `json:"rate_limit_global_burst"` // 全局令牌桶容量，0时等于每分钟请求数
+	RateLimitKeyRPM      int `json:"rate_limit_key_rpm"`      // 未设置rpm_limit的API密钥的默认每分钟请求数，0表示不限制
+	QueueMaxSize         int `json:"queue_max_size"`          // 所有Cookie都达到并发上限时最多排队的请求数，0表示不排队
+	QueueTimeoutSeconds  int `json:"queue_timeout_seconds"`   // 排队最长等待时间
+
+	// 日志（JSON格式，自动脱敏Cookie、Authorization和JWT）
+	LogLevel      string `json:"log_level"`       // debug / info / warn / error
+	LogFile       string `json:"log_file"`        // 日志文件，为空时输出到标准输出
+	LogMaxSizeMB  int    `json:"log_max_size_mb"` // 单个日志文件的最大大小，超过后轮转
+	LogMaxBackups int    `json:"log_max_backups"` // 保留的旧日志文件数
+	LogMaxAgeDays int    `json:"log_max_age_days"`
+
+	// 请求记录（保存在数据库中，供管理页面查看和重放）
+	JournalEnabled           bool `json:"journal_enabled"`
+	JournalRetentionDays     int  `json:"journal_retention_days"`      // 元数据保留天数，0表示不删除
+	JournalBodies            bool `json:"journal_bodies"`              // 是否记录请求和响应内容
+	JournalBodyMaxBytes      int  `json:"journal_body_max_bytes"`      // 请求和响应内容各自的最大字节数
+	JournalBodyRetentionDays int  `json:"journal_body_retention_days"` // 内容保留天数
+	JournalMaxEntries        int  `json:"journal_max_entries"`         // 最多保留的记录数，0表示不限制
+
+	// Prometheus指标
+	MetricsToken string `json:"metrics_token"` // /metrics的Bearer token，为空时不需要认证
+
+	// 代理思考过程
+	ExposeReasoning bool `json:"expose_reasoning"` // 以reasoning_content / thinking块返回上游代理的思考过程
+
+	// Cookie熔断
+	HealthFailureThreshold     int `json:"health_failure_threshold"`      // 连续临时失败多少次后进入冷却
+	HealthBaseCooldownSeconds  int `json:"health_base_cooldown_seconds"`  // 首次冷却时长，之后指数翻倍
+	HealthMaxCooldownMinutes   int `json:"health_max_cooldown_minutes"`   // 最长冷却时长
+	HealthDeadAfter            int `json:"health_dead_after"`             // 连续认证失败多少次后标记为dead
+	HealthProbeIntervalSeconds int `json:"health_probe_interval_seconds"` // 半开探测检查间隔
 }
 
 var (
@@ -27,6 +101,53 @@ func Load() *Config {
 			Port:     7032,
 			Host:     "0.0.0.0",
 			DataFile: "data.json",
+
+			DBFile:            "cto2api.db",
+			StoreFlushSeconds: 5,
+
+			AdminTokenTTLHours: 24,
+
+			PromptTemplate:   "plain",
+			PromptTruncation: "drop_oldest",
+			PromptMaxBytes:   200000,
+
+			ConversationAffinity:   true,
+			ConversationTTLMinutes: 60,
+
+			ClerkBaseURL:      "https://clerk.cto.new",
+			APIBaseURL:        "https://api.enginelabs.ai",
+			StreamBaseURL:     "wss://api.enginelabs.ai",
+			ClerkAPIVersion:   "2025-04-10",
+			ClerkJSVersion:    "5.102.0",
+			ClerkJWTJSVersion: "5.101.1",
+
+			CookieStrategy: "round_robin",
+
+			UsageRefreshMinutes: 5,
+
+			FailoverMaxAttempts:    3,
+			FailoverTimeoutSeconds: 60,
+
+			ResponseTTLHours: 24,
+
+			LogLevel:      "info",
+			LogMaxSizeMB:  100,
+			LogMaxBackups: 5,
+			LogMaxAgeDays: 30,
+
+			JournalRetentionDays:     30,
+			JournalBodyMaxBytes:      64 * 1024,
+			JournalBodyRetentionDays: 7,
+			JournalMaxEntries:        50000,
+
+			QueueMaxSize:        50,
+			QueueTimeoutSeconds: 30,
+
+			HealthFailureThreshold:     3,
+			HealthBaseCooldownSeconds:  30,
+			HealthMaxCooldownMinutes:   30,
+			HealthDeadAfter:            5,
+			HealthProbeIntervalSeconds: 15,
 		}
 
 		// 尝试从文件加载
@@ -45,10 +166,35 @@ func Load() *Config {
 		if host := os.Getenv("HOST"); host != "" {
 			cfg.Host = host
 		}
+
+		// 从环境变量读取上游地址
+		envOverride(&cfg.ClerkBaseURL, "CTO_CLERK_BASE_URL")
+		envOverride(&cfg.APIBaseURL, "CTO_API_BASE_URL")
+		envOverride(&cfg.StreamBaseURL, "CTO_STREAM_BASE_URL")
+		envOverride(&cfg.ClerkAPIVersion, "CTO_CLERK_API_VERSION")
+		envOverride(&cfg.ClerkJSVersion, "CTO_CLERK_JS_VERSION")
+		envOverride(&cfg.ClerkJWTJSVersion, "CTO_CLERK_JWT_JS_VERSION")
+		envOverride(&cfg.RecordDir, "CTO_RECORD_DIR")
+
+		envOverride(&cfg.MetricsToken, "METRICS_TOKEN")
+		envOverride(&cfg.LogLevel, "LOG_LEVEL")
+		envOverride(&cfg.LogFile, "LOG_FILE")
+
+		// 从环境变量读取管理会话签名密钥
+		if secret := os.Getenv("ADMIN_SESSION_SECRET"); secret != "" {
+			cfg.SessionSecret = secret
+		}
 	})
 	return cfg
 }
 
+// envOverride 环境变量非空时覆盖配置项
+func envOverride(field *string, name string) {
+	if value := os.Getenv(name); value != "" {
+		*field = value
+	}
+}
+
 // Save 保存配置
 func (c *Config) Save() error {
 	data, err := json.MarshalIndent(c, "", "  ")
@@ -0,0 +1,489 @@
+package handlers
+
+import (
+	"bytes"
+	"cto2api/config"
+	"cto2api/services"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// AnthropicRequest Anthropic Messages API请求
+type AnthropicRequest struct {
+	Model      string             `json:"model"`
+	MaxTokens  int                `json:"max_tokens"`
+	System     AnthropicContent   `json:"system"`
+	Messages   []AnthropicMessage `json:"messages"`
+	Stream     bool               `json:"stream"`
+	Tools      []AnthropicTool    `json:"tools,omitempty"`
+	ToolChoice json.RawMessage    `json:"tool_choice,omitempty"`
+	Thinking   *AnthropicThinking `json:"thinking,omitempty"`
+}
+
+// AnthropicThinking 扩展思考配置，启用时以thinking块返回上游代理的思考过程
+type AnthropicThinking struct {
+	Type         string `json:"type"` // enabled / disabled
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// thinkingSignature thinking块的签名。上游不提供签名，SDK要求该字段非空
+const thinkingSignature = "cto2api"
+
+// wantsThinking 是否返回thinking块：请求启用了扩展思考，或配置开启了expose_reasoning
+func (r *AnthropicRequest) wantsThinking() bool {
+	if r.Thinking != nil && r.Thinking.Type == "enabled" {
+		return true
+	}
+	return config.Get().ExposeReasoning
+}
+
+// AnthropicMessage Anthropic消息
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+// AnthropicContent 消息内容，兼容字符串和内容块数组两种形式
+type AnthropicContent []AnthropicBlock
+
+// AnthropicBlock 内容块
+type AnthropicBlock struct {
+	Type      string           `json:"type"`
+	Text      string           `json:"text,omitempty"`
+	ID        string           `json:"id,omitempty"`
+	Name      string           `json:"name,omitempty"`
+	Input     json.RawMessage  `json:"input,omitempty"`
+	ToolUseID string           `json:"tool_use_id,omitempty"`
+	Content   AnthropicContent `json:"content,omitempty"` // tool_result的内容
+	IsError   bool             `json:"is_error,omitempty"`
+	Thinking  string           `json:"thinking,omitempty"`
+	Signature string           `json:"signature,omitempty"`
+}
+
+// AnthropicTool Anthropic工具定义
+type AnthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema,omitempty"`
+}
+
+// AnthropicResponse Anthropic Messages API响应
+type AnthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []AnthropicBlock `json:"content"`
+	StopReason   *string          `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        AnthropicUsage   `json:"usage"`
+}
+
+// AnthropicUsage 使用统计
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// UnmarshalJSON 解析字符串、内容块数组或null
+func (a *AnthropicContent) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*a = nil
+		return nil
+	case len(data) > 0 && data[0] == '"':
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		*a = AnthropicContent{{Type: "text", Text: text}}
+		return nil
+	case len(data) > 0 && data[0] == '[':
+		var blocks []AnthropicBlock
+		if err := json.Unmarshal(data, &blocks); err != nil {
+			return err
+		}
+		*a = blocks
+		return nil
+	}
+	return fmt.Errorf("content必须是字符串或内容块数组")
+}
+
+// text 拼接所有文本块
+func (a AnthropicContent) text() string {
+	texts := make([]string, 0, len(a))
+	for _, block := range a {
+		if block.Type == "text" && block.Text != "" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Messages Anthropic Messages API
+func (h *APIHandler) Messages(c *gin.Context) {
+	// 验证API密钥（x-api-key，兼容Bearer）
+	apiKey := c.GetHeader("x-api-key")
+	if apiKey == "" {
+		apiKey = extractBearerToken(c.GetHeader("Authorization"))
+	}
+	if status, msg := h.validateAPIKey(c, apiKey); status != 0 {
+		respondAnthropicError(c, status, anthropicErrorType(status), msg)
+		return
+	}
+
+	var req AnthropicRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondAnthropicError(c, http.StatusBadRequest, errTypeInvalidRequest, err.Error())
+		return
+	}
+
+	messages, err := anthropicPromptMessages(&req)
+	if err != nil {
+		respondAnthropicError(c, http.StatusBadRequest, errTypeInvalidRequest, err.Error())
+		return
+	}
+
+	// 工具调用模拟
+	toolInstructions, apiErr := toolPrompt(anthropicTools(req.Tools), anthropicToolChoice(req.ToolChoice))
+	if apiErr != nil {
+		respondAnthropicError(c, http.StatusBadRequest, errTypeInvalidRequest, apiErr.Message)
+		return
+	}
+	if toolInstructions != "" {
+		messages = append([]services.PromptMessage{{Role: "system", Content: toolInstructions}}, messages...)
+	}
+
+	chat, err := h.startChat(c, req.Model, messages)
+	if err != nil {
+		status, apiErr := chatAPIError(err)
+		respondAnthropicError(c, status, anthropicErrorType(status), apiErr.Message)
+		return
+	}
+
+	var parser *services.ToolCallParser
+	if toolInstructions != "" {
+		parser = services.NewToolCallParser()
+	}
+
+	messageID := "msg_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	inputTokens := len(chat.prompt) / 4
+
+	if req.Stream {
+		h.streamAnthropic(c, chat, parser, messageID, req.Model, inputTokens, req.wantsThinking())
+		return
+	}
+
+	result, err := h.consumeStream(chat, parser, nil, nil, nil)
+	if err != nil {
+		status, apiErr := chatAPIError(err)
+		respondAnthropicError(c, status, anthropicErrorType(status), apiErr.Message)
+		return
+	}
+
+	content := []AnthropicBlock{}
+	if req.wantsThinking() && result.reasoning != "" {
+		content = append(content, AnthropicBlock{Type: "thinking", Thinking: result.reasoning, Signature: thinkingSignature})
+	}
+	text := result.text
+	if len(result.calls) > 0 {
+		text = strings.TrimSpace(text)
+	}
+	if text != "" {
+		content = append(content, AnthropicBlock{Type: "text", Text: text})
+	}
+	for _, call := range result.calls {
+		content = append(content, AnthropicBlock{
+			Type:  "tool_use",
+			ID:    newToolUseID(),
+			Name:  call.Name,
+			Input: toolUseInput(call.Arguments),
+		})
+	}
+
+	c.JSON(http.StatusOK, AnthropicResponse{
+		ID:         messageID,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      req.Model,
+		Content:    content,
+		StopReason: stringPtr(anthropicStopReason(result)),
+		Usage: AnthropicUsage{
+			InputTokens:  inputTokens,
+			OutputTokens: len(result.raw) / 4,
+		},
+	})
+}
+
+// streamAnthropic 以Anthropic SSE事件序列输出，thinking为true时输出thinking块
+func (h *APIHandler) streamAnthropic(c *gin.Context, chat *upstreamChat, parser *services.ToolCallParser, messageID, model string, inputTokens int, thinking bool) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	c.SSEvent("message_start", gin.H{
+		"type": "message_start",
+		"message": AnthropicResponse{
+			ID:      messageID,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   model,
+			Content: []AnthropicBlock{},
+			Usage:   AnthropicUsage{InputTokens: inputTokens},
+		},
+	})
+
+	blockIndex := 0
+	openBlock := "" // 当前打开的块类型（text/thinking），没有时为空
+
+	closeBlock := func() {
+		if openBlock == "" {
+			return
+		}
+		if openBlock == "thinking" {
+			c.SSEvent("content_block_delta", gin.H{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": gin.H{"type": "signature_delta", "signature": thinkingSignature},
+			})
+		}
+		c.SSEvent("content_block_stop", gin.H{"type": "content_block_stop", "index": blockIndex})
+		blockIndex++
+		openBlock = ""
+	}
+
+	// startBlock 打开指定类型的块，已打开的其他块先关闭
+	startBlock := func(blockType string, block gin.H) {
+		if openBlock == blockType {
+			return
+		}
+		closeBlock()
+		c.SSEvent("content_block_start", gin.H{
+			"type":          "content_block_start",
+			"index":         blockIndex,
+			"content_block": block,
+		})
+		openBlock = blockType
+	}
+
+	var onReasoning func(string)
+	if thinking {
+		onReasoning = func(text string) {
+			startBlock("thinking", gin.H{"type": "thinking", "thinking": ""})
+			c.SSEvent("content_block_delta", gin.H{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": gin.H{"type": "thinking_delta", "thinking": text},
+			})
+		}
+	}
+
+	result, err := h.consumeStream(chat, parser,
+		func(text string) {
+			startBlock("text", gin.H{"type": "text", "text": ""})
+			c.SSEvent("content_block_delta", gin.H{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": gin.H{"type": "text_delta", "text": text},
+			})
+		},
+		func(call services.ParsedToolCall) {
+			closeBlock()
+			c.SSEvent("content_block_start", gin.H{
+				"type":  "content_block_start",
+				"index": blockIndex,
+				"content_block": gin.H{
+					"type":  "tool_use",
+					"id":    newToolUseID(),
+					"name":  call.Name,
+					"input": gin.H{},
+				},
+			})
+			c.SSEvent("content_block_delta", gin.H{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": gin.H{"type": "input_json_delta", "partial_json": string(toolUseInput(call.Arguments))},
+			})
+			c.SSEvent("content_block_stop", gin.H{"type": "content_block_stop", "index": blockIndex})
+			blockIndex++
+		},
+		onReasoning,
+	)
+	if err != nil {
+		status, apiErr := chatAPIError(err)
+		c.SSEvent("error", gin.H{
+			"type":  "error",
+			"error": gin.H{"type": anthropicErrorType(status), "message": apiErr.Message},
+		})
+		return
+	}
+	closeBlock()
+
+	c.SSEvent("message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": gin.H{"stop_reason": anthropicStopReason(result), "stop_sequence": nil},
+		"usage": gin.H{"output_tokens": len(result.raw) / 4},
+	})
+	c.SSEvent("message_stop", gin.H{"type": "message_stop"})
+}
+
+// anthropicPromptMessages 转换为提示词组装器的消息格式
+func anthropicPromptMessages(req *AnthropicRequest) ([]services.PromptMessage, error) {
+	messages := make([]services.PromptMessage, 0, len(req.Messages)+1)
+	if system := req.System.text(); system != "" {
+		messages = append(messages, services.PromptMessage{Role: "system", Content: system})
+	}
+
+	toolNames := make(map[string]string)
+	for i, m := range req.Messages {
+		var texts []string
+		var calls []services.ParsedToolCall
+
+		for j, block := range m.Content {
+			switch block.Type {
+			case "text":
+				if block.Text != "" {
+					texts = append(texts, block.Text)
+				}
+			case "tool_use":
+				toolNames[block.ID] = block.Name
+				input := string(bytes.TrimSpace(block.Input))
+				if input == "" {
+					input = "{}"
+				}
+				calls = append(calls, services.ParsedToolCall{Name: block.Name, Arguments: input})
+			case "tool_result":
+				// 工具结果作为独立的tool消息
+				name := toolNames[block.ToolUseID]
+				if name == "" {
+					name = block.ToolUseID
+				}
+				content := block.Content.text()
+				if block.IsError {
+					content = "[error] " + content
+				}
+				messages = append(messages, services.PromptMessage{Role: "tool", Name: name, Content: content})
+			case "thinking", "redacted_thinking":
+				// 历史思考过程不转发
+			default:
+				return nil, fmt.Errorf("messages[%d].content[%d]: 不支持的内容类型 %q，上游暂不支持图片等附件", i, j, block.Type)
+			}
+		}
+
+		content := strings.Join(texts, "\n")
+		if len(calls) > 0 {
+			content = services.RenderToolCalls(content, calls)
+		}
+		if content != "" {
+			messages = append(messages, services.PromptMessage{Role: m.Role, Content: content})
+		}
+	}
+
+	return messages, nil
+}
+
+// anthropicTools 转换为OpenAI格式的工具定义
+func anthropicTools(tools []AnthropicTool) []Tool {
+	result := make([]Tool, 0, len(tools))
+	for _, tool := range tools {
+		result = append(result, Tool{
+			Type: "function",
+			Function: ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+	return result
+}
+
+// anthropicToolChoice 转换为OpenAI格式的tool_choice
+func anthropicToolChoice(raw json.RawMessage) json.RawMessage {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil
+	}
+
+	var choice struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(raw, &choice); err != nil {
+		return raw
+	}
+
+	var converted interface{}
+	switch choice.Type {
+	case "any":
+		converted = "required"
+	case "none":
+		converted = "none"
+	case "tool":
+		converted = gin.H{"type": "function", "function": gin.H{"name": choice.Name}}
+	default:
+		converted = "auto"
+	}
+	data, _ := json.Marshal(converted)
+	return data
+}
+
+// anthropicStopReason 根据输出确定stop_reason
+func anthropicStopReason(result *streamResult) string {
+	if len(result.calls) > 0 {
+		return "tool_use"
+	}
+	return "end_turn"
+}
+
+// anthropicErrorType HTTP状态码对应的Anthropic错误类型
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusPaymentRequired:
+		return "billing_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return "overloaded_error"
+	case http.StatusGatewayTimeout:
+		return "timeout_error"
+	default:
+		return "api_error"
+	}
+}
+
+// respondAnthropicError 返回Anthropic格式的错误
+func respondAnthropicError(c *gin.Context, status int, errType, message string) {
+	c.JSON(status, gin.H{
+		"type":  "error",
+		"error": gin.H{"type": errType, "message": message},
+	})
+}
+
+// toolUseInput tool_use块的input必须是JSON对象：模型给出的参数不是合法的JSON对象时包装为{"raw": 原文}
+func toolUseInput(arguments string) json.RawMessage {
+	trimmed := strings.TrimSpace(arguments)
+	if strings.HasPrefix(trimmed, "{") && json.Valid([]byte(trimmed)) {
+		return json.RawMessage(trimmed)
+	}
+	data, _ := json.Marshal(map[string]string{"raw": arguments})
+	return data
+}
+
+// newToolUseID 生成tool_use块ID
+func newToolUseID() string {
+	return "toolu_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"cto2api/config"
 	"cto2api/models"
 	"cto2api/services"
+	"encoding/json"
 	"net/http"
 	"strings"
 	"time"
@@ -14,29 +16,63 @@ import (
 
 // APIHandler API处理器
 type APIHandler struct {
-	store        *models.DataStore
-	usageManager *services.UsageManager
+	store         *models.DataStore
+	usageManager  *services.UsageManager
+	sessions      *services.SessionManager
+	prompts       *services.PromptBuilder
+	conversations *services.ConversationStore // 为nil时不启用会话亲和
+	responses     *services.ResponseStore
+	events        *services.EventHub // 代理事件订阅（/v1/cto/events）
+	limiter       *services.RateLimiter
+	metrics       *services.Metrics
+	journal       *services.Journal // 为nil时不记录请求
+	queue         *cookieQueue
+	endpoints     services.Endpoints
 }
 
 // NewAPIHandler 创建API处理器
-func NewAPIHandler(store *models.DataStore) *APIHandler {
-	return &APIHandler{
+func NewAPIHandler(store *models.DataStore, endpoints services.Endpoints) *APIHandler {
+	cfg := config.Get()
+	h := &APIHandler{
 		store:        store,
-		usageManager: services.NewUsageManager(),
-	}
+		endpoints:    endpoints,
+		usageManager: services.NewUsageManager(store, endpoints, time.Duration(cfg.UsageRefreshMinutes)*time.Minute),
+		sessions:     services.NewSessionManager(cfg.SessionSecret, time.Duration(cfg.AdminTokenTTLHours)*time.Hour, store),
+		prompts:      services.NewPromptBuilder(cfg.PromptTemplate, cfg.PromptTruncation, cfg.PromptMaxBytes),
+		responses:    services.NewResponseStore(time.Duration(cfg.ResponseTTLHours) * time.Hour),
+		events:       services.NewEventHub(),
+		limiter:      services.NewRateLimiter(),
+		metrics:      services.NewMetrics(store),
+		queue:        &cookieQueue{},
+	}
+	if cfg.ConversationAffinity {
+		h.conversations = services.NewConversationStore(time.Duration(cfg.ConversationTTLMinutes) * time.Minute)
+	}
+	return h
+}
+
+// UseUsageManager 使用由调用方启动和停止的用量管理器（默认的管理器只在查询时刷新，不在后台轮询）
+func (h *APIHandler) UseUsageManager(usageManager *services.UsageManager) {
+	h.usageManager = usageManager
 }
 
 // Message 消息结构
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role             string         `json:"role"`
+	Content          MessageContent `json:"content"`
+	ReasoningContent string         `json:"reasoning_content,omitempty"` // 代理的思考过程（expose_reasoning开启时返回）
+	Name             string         `json:"name,omitempty"`
+	ToolCalls        []ToolCall     `json:"tool_calls,omitempty"`
+	ToolCallID       string         `json:"tool_call_id,omitempty"`
 }
 
 // ChatRequest 聊天请求
 type ChatRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
-	Stream   bool      `json:"stream"`
+	Model      string          `json:"model"`
+	Messages   []Message       `json:"messages"`
+	Stream     bool            `json:"stream"`
+	Tools      []Tool          `json:"tools,omitempty"`
+	ToolChoice json.RawMessage `json:"tool_choice,omitempty"`
 }
 
 // ChatResponse 聊天响应
@@ -81,7 +117,9 @@ type StreamDelta struct {
 
 // DeltaContent 增量内容
 type DeltaContent struct {
-	Content string `json:"content,omitempty"`
+	Content          string     `json:"content,omitempty"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
 }
 
 // 模型映射
@@ -95,87 +133,58 @@ func (h *APIHandler) ChatCompletions(c *gin.Context) {
 	// 验证API密钥
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "缺少Authorization头"})
+		respondAPIKeyError(c, http.StatusUnauthorized, "缺少Authorization头")
 		return
 	}
 
 	// 提取Bearer token
-	parts := strings.SplitN(authHeader, " ", 2)
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的Authorization格式"})
-		return
-	}
-
-	apiKey := parts[1]
-	expectedKey := h.store.GetAPIKey()
-	
-	if expectedKey == "" {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "API密钥未设置，请先在管理页面设置"})
+	apiKey := extractBearerToken(authHeader)
+	if apiKey == "" {
+		respondAPIKeyError(c, http.StatusUnauthorized, "无效的Authorization格式")
 		return
 	}
 
-	if apiKey != expectedKey {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的API密钥"})
+	if status, msg := h.validateAPIKey(c, apiKey); status != 0 {
+		respondAPIKeyError(c, status, msg)
 		return
 	}
 
 	var req ChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondAPIError(c, http.StatusBadRequest, &APIError{Message: err.Error(), Type: errTypeInvalidRequest})
 		return
 	}
 
-	// 获取可用的cookie
-	cookieInfo := h.store.GetNextCookie()
-	if cookieInfo == nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "没有可用的Cookie"})
+	// 上游暂不支持图片等附件
+	if apiErr := validateMessageContent(req.Messages); apiErr != nil {
+		respondAPIError(c, http.StatusBadRequest, apiErr)
 		return
 	}
 
-	// 提取用户消息
-	var prompt string
-	for i := len(req.Messages) - 1; i >= 0; i-- {
-		if req.Messages[i].Role == "user" {
-			prompt = req.Messages[i].Content
-			break
-		}
-	}
-
-	if prompt == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "没有找到用户消息"})
+	// 工具调用模拟：将工具说明作为系统消息注入
+	messages := toPromptMessages(req.Messages)
+	toolInstructions, apiErr := toolPrompt(req.Tools, req.ToolChoice)
+	if apiErr != nil {
+		respondAPIError(c, http.StatusBadRequest, apiErr)
 		return
 	}
-
-	// 创建CTO客户端
-	client := services.NewCTOClient(cookieInfo.Cookie)
-
-	// 获取认证信息
-	clerkInfo, err := client.GetClerkInfo()
-	if err != nil {
-		h.store.RecordError(cookieInfo.ID)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取认证信息失败: " + err.Error()})
-		return
+	if toolInstructions != "" {
+		messages = append([]services.PromptMessage{{Role: "system", Content: toolInstructions}}, messages...)
 	}
 
-	jwt, err := client.GetJWT(clerkInfo.SessionID)
+	// 创建（或续接）上游聊天
+	chat, err := h.startChat(c, req.Model, messages)
 	if err != nil {
-		h.store.RecordError(cookieInfo.ID)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取JWT失败: " + err.Error()})
+		respondChatError(c, err)
 		return
 	}
 
-	// 确定adapter
-	adapter := modelMapping[req.Model]
-	if adapter == "" {
-		adapter = "ClaudeSonnet4_5"
-	}
+	chatID := chat.chatID
+	prompt := chat.prompt
 
-	// 创建聊天
-	chatID := uuid.New().String()
-	if err := client.CreateChat(jwt, prompt, adapter, chatID); err != nil {
-		h.store.RecordError(cookieInfo.ID)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建聊天失败: " + err.Error()})
-		return
+	var parser *services.ToolCallParser
+	if toolInstructions != "" {
+		parser = services.NewToolCallParser()
 	}
 
 	// 流式响应
@@ -184,57 +193,74 @@ func (h *APIHandler) ChatCompletions(c *gin.Context) {
 		c.Header("Cache-Control", "no-cache")
 		c.Header("Connection", "keep-alive")
 
-		responseChan := make(chan services.StreamResponse, 100)
-		go client.StreamChat(chatID, clerkInfo.UserID, responseChan)
+		sendChunk := func(delta DeltaContent, finishReason *string) {
+			c.SSEvent("", StreamChunk{
+				ID:      "chatcmpl-" + chatID,
+				Object:  "chat.completion.chunk",
+				Created: time.Now().Unix(),
+				Model:   req.Model,
+				Choices: []StreamDelta{{
+					Index:        0,
+					Delta:        delta,
+					FinishReason: finishReason,
+				}},
+			})
+		}
 
-		for resp := range responseChan {
-			if resp.Error != nil {
-				h.store.RecordError(cookieInfo.ID)
-				break
+		var onReasoning func(string)
+		if config.Get().ExposeReasoning {
+			onReasoning = func(text string) {
+				sendChunk(DeltaContent{ReasoningContent: text}, nil)
 			}
+		}
 
-			if resp.Done {
-				chunk := StreamChunk{
-					ID:      "chatcmpl-" + chatID,
-					Object:  "chat.completion.chunk",
-					Created: time.Now().Unix(),
-					Model:   req.Model,
-					Choices: []StreamDelta{{
-						Index:        0,
-						Delta:        DeltaContent{},
-						FinishReason: stringPtr("stop"),
-					}},
-				}
-				c.SSEvent("", chunk)
-				c.SSEvent("", "[DONE]")
-				break
-			}
+		callIndex := 0
+		result, err := h.consumeStream(chat, parser,
+			func(text string) {
+				sendChunk(DeltaContent{Content: text}, nil)
+			},
+			func(parsed services.ParsedToolCall) {
+				call := toToolCalls([]services.ParsedToolCall{parsed})[0]
+				call.Index = intPtr(callIndex)
+				callIndex++
+				sendChunk(DeltaContent{ToolCalls: []ToolCall{call}}, nil)
+			},
+			onReasoning,
+		)
+		if err != nil {
+			// 流已经开始，以最后一个SSE事件返回错误
+			_, apiErr := chatAPIError(err)
+			c.SSEvent("", gin.H{"error": apiErr})
+			return
+		}
 
-			if resp.Content != "" {
-				chunk := StreamChunk{
-					ID:      "chatcmpl-" + chatID,
-					Object:  "chat.completion.chunk",
-					Created: time.Now().Unix(),
-					Model:   req.Model,
-					Choices: []StreamDelta{{
-						Index: 0,
-						Delta: DeltaContent{Content: resp.Content},
-					}},
-				}
-				c.SSEvent("", chunk)
-			}
+		finishReason := "stop"
+		if len(result.calls) > 0 {
+			finishReason = "tool_calls"
 		}
+		sendChunk(DeltaContent{}, stringPtr(finishReason))
+		c.SSEvent("", "[DONE]")
 		return
 	}
 
 	// 非流式响应
-	fullResponse, err := client.GetFullResponse(chatID, clerkInfo.UserID)
+	result, err := h.consumeStream(chat, parser, nil, nil, nil)
 	if err != nil {
-		h.store.RecordError(cookieInfo.ID)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "获取响应失败: " + err.Error()})
+		respondChatError(c, err)
 		return
 	}
 
+	message := Message{Role: "assistant", Content: TextContent(result.text)}
+	if config.Get().ExposeReasoning {
+		message.ReasoningContent = result.reasoning
+	}
+	finishReason := "stop"
+	if len(result.calls) > 0 {
+		message.Content = TextContent(strings.TrimSpace(result.text))
+		message.ToolCalls = toToolCalls(result.calls)
+		finishReason = "tool_calls"
+	}
+
 	response := ChatResponse{
 		ID:      "chatcmpl-" + chatID,
 		Object:  "chat.completion",
@@ -242,19 +268,54 @@ func (h *APIHandler) ChatCompletions(c *gin.Context) {
 		Model:   req.Model,
 		Choices: []Choice{{
 			Index:        0,
-			Message:      Message{Role: "assistant", Content: fullResponse},
-			FinishReason: "stop",
+			Message:      message,
+			FinishReason: finishReason,
 		}},
 		Usage: Usage{
 			PromptTokens:     len(prompt) / 4,
-			CompletionTokens: len(fullResponse) / 4,
-			TotalTokens:      (len(prompt) + len(fullResponse)) / 4,
+			CompletionTokens: len(result.raw) / 4,
+			TotalTokens:      (len(prompt) + len(result.raw)) / 4,
 		},
 	}
 
 	c.JSON(http.StatusOK, response)
 }
 
+// toPromptMessages 转换为提示词组装器的消息格式
+// 助手的工具调用渲染为上游可理解的文本，工具结果以调用的函数名标注
+func toPromptMessages(messages []Message) []services.PromptMessage {
+	toolNames := make(map[string]string)
+	result := make([]services.PromptMessage, 0, len(messages))
+	for _, m := range messages {
+		content := m.Content.String()
+		name := m.Name
+
+		switch m.Role {
+		case "assistant":
+			if len(m.ToolCalls) > 0 {
+				for _, call := range m.ToolCalls {
+					toolNames[call.ID] = call.Function.Name
+				}
+				content = services.RenderToolCalls(content, toParsedToolCalls(m.ToolCalls))
+			}
+		case "tool":
+			if name == "" {
+				name = toolNames[m.ToolCallID]
+			}
+			if name == "" {
+				name = m.ToolCallID
+			}
+		}
+
+		result = append(result, services.PromptMessage{
+			Role:    m.Role,
+			Name:    name,
+			Content: content,
+		})
+	}
+	return result
+}
+
 // ListModels 列出模型
 func (h *APIHandler) ListModels(c *gin.Context) {
 	models := []gin.H{}
@@ -337,9 +398,36 @@ func (h *APIHandler) Login(c *gin.Context) {
 		return
 	}
 
-	// 生成简单的token（实际项目中应使用JWT）
-	token := uuid.New().String()
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	token, claims, err := h.sessions.Issue()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成token失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"expires_at": claims.ExpiresAt,
+	})
+}
+
+// Logout 退出登录（注销当前会话）
+func (h *APIHandler) Logout(c *gin.Context) {
+	if claims := currentSession(c); claims != nil {
+		if err := h.sessions.Revoke(claims); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存会话状态失败"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已退出登录"})
+}
+
+// RevokeAllSessions 注销所有管理会话（包括当前会话）
+func (h *APIHandler) RevokeAllSessions(c *gin.Context) {
+	if err := h.sessions.RevokeAll(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存会话状态失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "所有会话已注销"})
 }
 
 // CheckSetup 检查是否已完成初始设置
@@ -369,21 +457,9 @@ func (h *APIHandler) UpdateAPIKey(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "API密钥更新成功"})
 }
 
-// GetAPIKey 获取当前API密钥（仅显示部分）
+// GetAPIKey 获取当前默认API密钥（只返回脱敏后的密钥）
 func (h *APIHandler) GetAPIKey(c *gin.Context) {
-	key := h.store.GetAPIKey()
-	if key == "" {
-		c.JSON(http.StatusOK, gin.H{"api_key": ""})
-		return
-	}
-
-	// 只显示前8位和后4位
-	masked := key
-	if len(key) > 12 {
-		masked = key[:8] + "..." + key[len(key)-4:]
-	}
-
-	c.JSON(http.StatusOK, gin.H{"api_key": masked, "full_key": key})
+	c.JSON(http.StatusOK, gin.H{"api_key": h.store.GetAPIKey()})
 }
 
 // AddCookieRequest 添加Cookie请求
@@ -421,6 +497,7 @@ type UpdateCookieRequest struct {
 	Name    *string `json:"name"`
 	Cookie  *string `json:"cookie"`
 	Enabled *bool   `json:"enabled"`
+	Weight  *int    `json:"weight"`
 }
 
 // UpdateCookie 更新Cookie
@@ -443,6 +520,9 @@ func (h *APIHandler) UpdateCookie(c *gin.Context) {
 	if req.Enabled != nil {
 		updates["enabled"] = *req.Enabled
 	}
+	if req.Weight != nil {
+		updates["weight"] = *req.Weight
+	}
 
 	if err := h.store.UpdateCookie(id, updates); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新失败"})
@@ -464,47 +544,9 @@ func (h *APIHandler) DeleteCookie(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
 }
 
-// ListCookies 列出所有Cookie（带用量信息）
+// ListCookies 列出所有Cookie（带最后已知的用量信息，由后台定期刷新），输出副本以免与计数更新并发读写
 func (h *APIHandler) ListCookies(c *gin.Context) {
-	cookies := h.store.ListCookies()
-	
-	// 异步获取每个Cookie的用量信息
-	for _, cookie := range cookies {
-		if cookie.Enabled {
-			go h.fetchCookieUsage(cookie)
-		}
-	}
-	
-	c.JSON(http.StatusOK, cookies)
-}
-
-// fetchCookieUsage 异步获取Cookie用量信息
-func (h *APIHandler) fetchCookieUsage(cookie *models.CookieInfo) {
-	client := services.NewCTOClient(cookie.Cookie)
-	
-	clerkInfo, err := client.GetClerkInfo()
-	if err != nil {
-		return
-	}
-	
-	jwt, err := client.GetJWT(clerkInfo.SessionID)
-	if err != nil {
-		return
-	}
-	
-	billing, err := h.usageManager.GetBillingInfo(client, jwt)
-	if err != nil {
-		return
-	}
-	
-	// 更新Cookie的用量信息（不保存到文件）
-	cookie.Usage = &models.UsageInfo{
-		TaskCreditsUsage:     billing.TaskCreditsUsage,
-		TaskCreditsLimit:     billing.TaskCreditsLimit,
-		TaskConcurrencyUsage: billing.TaskConcurrencyUsage,
-		TaskConcurrencyLimit: billing.TaskConcurrencyLimit,
-		LastUpdate:           time.Now().Format("2006-01-02 15:04:05"),
-	}
+	c.JSON(http.StatusOK, h.store.CookieSnapshots())
 }
 
 // TestCookie 测试Cookie连通性
@@ -519,30 +561,22 @@ func (h *APIHandler) TestCookie(c *gin.Context) {
 	}
 
 	// 创建CTO客户端
-	client := services.NewCTOClient(cookieInfo.Cookie)
+	client := services.NewCTOClient(cookieInfo.Cookie, h.endpoints)
 
-	// 测试获取认证信息
-	clerkInfo, err := client.GetClerkInfo()
+	// 测试获取认证信息和JWT（与聊天请求共用缓存）
+	_, jwt, err := client.Authenticate(c.Request.Context())
 	if err != nil {
+		h.recordFailure(id, err)
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
-			"message": "获取认证信息失败: " + err.Error(),
+			"message": err.Error(),
 		})
 		return
 	}
 
-	// 测试获取JWT
-	jwt, err := client.GetJWT(clerkInfo.SessionID)
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"success": false,
-			"message": "获取JWT失败: " + err.Error(),
-		})
-		return
-	}
-
-	// 如果能获取到JWT，说明Cookie有效
+	// 如果能获取到JWT，说明Cookie有效（手动测试通过后立即恢复分配）
 	if jwt != "" {
+		h.store.ResetHealth(id)
 		c.JSON(http.StatusOK, gin.H{
 			"success": true,
 			"message": "Cookie有效，连接正常",
@@ -556,55 +590,20 @@ func (h *APIHandler) TestCookie(c *gin.Context) {
 	})
 }
 
-// GetUsage 获取用量信息（总览）
+// GetUsage 获取Cookie池用量汇总
 func (h *APIHandler) GetUsage(c *gin.Context) {
-	// 获取任意一个可用的Cookie来获取用量信息
-	cookieInfo := h.store.GetNextCookie()
-	if cookieInfo == nil {
+	pool := h.store.PoolUsage()
+	if pool.Cookies == 0 {
 		c.JSON(http.StatusOK, gin.H{
 			"error": "没有可用的Cookie，无法获取用量信息",
 		})
 		return
 	}
 
-	// 创建CTO客户端
-	client := services.NewCTOClient(cookieInfo.Cookie)
-
-	// 获取认证信息
-	clerkInfo, err := client.GetClerkInfo()
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"error": "获取认证信息失败: " + err.Error(),
-		})
-		return
-	}
-
-	jwt, err := client.GetJWT(clerkInfo.SessionID)
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"error": "获取JWT失败: " + err.Error(),
-		})
-		return
-	}
-
-	// 使用缓存机制获取用量信息
-	billing, err := h.usageManager.GetBillingInfo(client, jwt)
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"error": "获取用量信息失败: " + err.Error(),
-		})
-		return
-	}
-
-	// 异步刷新（如果缓存快过期）
-	if h.usageManager.IsStale() {
-		go h.usageManager.RefreshAsync(client, jwt)
-	}
-
-	c.JSON(http.StatusOK, billing)
+	c.JSON(http.StatusOK, pool)
 }
 
-// GetCookieUsage 获取指定Cookie的用量信息
+// GetCookieUsage 立即刷新并获取指定Cookie的用量信息
 func (h *APIHandler) GetCookieUsage(c *gin.Context) {
 	id := c.Param("id")
 	
@@ -615,31 +614,10 @@ func (h *APIHandler) GetCookieUsage(c *gin.Context) {
 		return
 	}
 
-	// 创建CTO客户端
-	client := services.NewCTOClient(cookieInfo.Cookie)
-
-	// 获取认证信息
-	clerkInfo, err := client.GetClerkInfo()
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"error": "获取认证信息失败: " + err.Error(),
-		})
-		return
-	}
-
-	jwt, err := client.GetJWT(clerkInfo.SessionID)
+	billing, err := h.usageManager.Refresh(c.Request.Context(), cookieInfo)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
-			"error": "获取JWT失败: " + err.Error(),
-		})
-		return
-	}
-
-	// 获取用量信息
-	billing, err := client.GetBillingInfo(jwt)
-	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"error": "获取用量信息失败: " + err.Error(),
+			"error": err.Error(),
 		})
 		return
 	}
@@ -649,4 +627,8 @@ func (h *APIHandler) GetCookieUsage(c *gin.Context) {
 
 func stringPtr(s string) *string {
 	return &s
+}
+
+func intPtr(i int) *int {
+	return &i
 }
\ No newline at end of file
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"cto2api/models"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CreateAPIKeyRequest 创建API密钥请求
+type CreateAPIKeyRequest struct {
+	Name             string     `json:"name" binding:"required"`
+	Owner            string     `json:"owner"`
+	ExpiresAt        *time.Time `json:"expires_at"`
+	AllowedModels    []string   `json:"allowed_models"`
+	RPMLimit         int        `json:"rpm_limit" binding:"min=0"`
+	DailyCreditLimit int        `json:"daily_credit_limit" binding:"min=0"`
+}
+
+// ListAPIKeys 列出所有API密钥（不包含密钥本身和哈希）
+func (h *APIHandler) ListAPIKeys(c *gin.Context) {
+	keys := h.store.ListAPIKeys()
+	for _, k := range keys {
+		k.KeyHash = ""
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// CreateAPIKey 创建API密钥，明文密钥只在创建时返回一次
+func (h *APIHandler) CreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "过期时间必须晚于当前时间"})
+		return
+	}
+
+	key, err := models.GenerateAPIKey()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "生成API密钥失败"})
+		return
+	}
+
+	info := &models.APIKeyInfo{
+		ID:               uuid.New().String(),
+		Name:             req.Name,
+		Owner:            req.Owner,
+		CreatedAt:        time.Now(),
+		ExpiresAt:        req.ExpiresAt,
+		AllowedModels:    req.AllowedModels,
+		RPMLimit:         req.RPMLimit,
+		DailyCreditLimit: req.DailyCreditLimit,
+	}
+	if err := h.store.CreateAPIKey(info, key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存API密钥失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":      info.ID,
+		"name":    info.Name,
+		"key":     key,
+		"hint":    info.Hint,
+		"message": "请立即保存该密钥，之后将无法再次查看",
+	})
+}
+
+// RevokeAPIKey 撤销API密钥
+func (h *APIHandler) RevokeAPIKey(c *gin.Context) {
+	if err := h.store.RevokeAPIKey(c.Param("id")); err != nil {
+		if errors.Is(err, models.ErrAPIKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "撤销失败"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "撤销成功"})
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ContentPart OpenAI多模态内容片段
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL 图片片段
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// MessageContent 消息内容，兼容字符串和内容片段数组两种形式
+type MessageContent struct {
+	Text  string        // 字符串形式的内容
+	Parts []ContentPart // 数组形式的内容，为nil表示字符串形式
+}
+
+// TextContent 创建纯文本内容
+func TextContent(text string) MessageContent {
+	return MessageContent{Text: text}
+}
+
+// UnmarshalJSON 解析字符串、内容片段数组或null
+func (m *MessageContent) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*m = MessageContent{}
+		return nil
+	case len(data) > 0 && data[0] == '"':
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		*m = MessageContent{Text: text}
+		return nil
+	case len(data) > 0 && data[0] == '[':
+		var parts []ContentPart
+		if err := json.Unmarshal(data, &parts); err != nil {
+			return err
+		}
+		if parts == nil {
+			parts = []ContentPart{}
+		}
+		*m = MessageContent{Parts: parts}
+		return nil
+	}
+	return fmt.Errorf("content必须是字符串或内容片段数组")
+}
+
+// MarshalJSON 字符串形式输出为字符串（空内容输出null），数组形式原样输出
+func (m MessageContent) MarshalJSON() ([]byte, error) {
+	if m.Parts == nil {
+		if m.Text == "" {
+			return []byte("null"), nil
+		}
+		return json.Marshal(m.Text)
+	}
+	return json.Marshal(m.Parts)
+}
+
+// String 拼接所有文本片段
+func (m MessageContent) String() string {
+	if m.Parts == nil {
+		return m.Text
+	}
+
+	texts := make([]string, 0, len(m.Parts))
+	for _, part := range m.Parts {
+		if isTextPart(part.Type) && part.Text != "" {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// unsupportedPart 返回第一个不支持的（非文本）片段下标，没有时返回-1
+func (m MessageContent) unsupportedPart() int {
+	for i, part := range m.Parts {
+		if !isTextPart(part.Type) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isTextPart 是否为文本片段
+func isTextPart(partType string) bool {
+	return partType == "text" || partType == "input_text" || partType == "output_text"
+}
+
+// validateMessageContent 校验消息内容，上游暂不支持图片等附件
+func validateMessageContent(messages []Message) *APIError {
+	for i, m := range messages {
+		idx := m.Content.unsupportedPart()
+		if idx < 0 {
+			continue
+		}
+		partType := m.Content.Parts[idx].Type
+		return &APIError{
+			Message: fmt.Sprintf("不支持的内容类型 %q：上游暂不支持图片等附件，请只发送文本内容", partType),
+			Type:    errTypeInvalidRequest,
+			Param:   fmt.Sprintf("messages[%d].content[%d]", i, idx),
+			Code:    "unsupported_content_type",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"cto2api/services"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI错误类型
+const (
+	errTypeInvalidRequest    = "invalid_request_error"
+	errTypeAuthentication    = "authentication_error"
+	errTypeInsufficientQuota = "insufficient_quota"
+	errTypeRateLimit         = "rate_limit_error"
+	errTypePermission        = "permission_error"
+	errTypeServer            = "server_error"
+	errTypeAPI               = "api_error"
+)
+
+// 错误码
+const (
+	errCodeInvalidAPIKey     = "invalid_api_key"
+	errCodeCookieExpired     = "cookie_expired"       // Cookie没有活动会话或已被上游拒绝
+	errCodeUpstreamAuth      = "upstream_auth_failed" // Clerk认证或JWT失败
+	errCodeInsufficientQuota = "insufficient_quota"   // 上游额度用尽
+	errCodeConcurrencyLimit  = "concurrency_limit_exceeded"
+	errCodeNoAvailableCookie = "no_available_cookie"
+	errCodeUpstreamError     = "upstream_error"
+	errCodeUpstreamStream    = "upstream_stream_error" // WebSocket连接或读取失败
+	errCodeUpstreamTimeout   = "upstream_timeout"
+	errCodeAPIKeyNotSet      = "api_key_not_set"
+	errCodeModelNotAllowed   = "model_not_allowed"    // API密钥不允许使用该模型
+	errCodeRateLimitExceeded = "rate_limit_exceeded"  // 超过API密钥每分钟请求数
+	errCodeDailyQuota        = "daily_quota_exceeded" // 超过API密钥每日额度
+	errCodeQueueTimeout      = "queue_timeout"        // 排队等待可用Cookie超时
+)
+
+// APIError OpenAI格式的错误
+type APIError struct {
+	Message string
+	Type    string
+	Param   string
+	Code    string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// MarshalJSON 按OpenAI格式输出，空的param/code输出为null
+func (e *APIError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Message string  `json:"message"`
+		Type    string  `json:"type"`
+		Param   *string `json:"param"`
+		Code    *string `json:"code"`
+	}{
+		Message: e.Message,
+		Type:    e.Type,
+		Param:   nullableString(e.Param),
+		Code:    nullableString(e.Code),
+	})
+}
+
+// respondAPIError 返回 {"error": {...}} 格式的错误响应
+func respondAPIError(c *gin.Context, status int, err *APIError) {
+	c.JSON(status, gin.H{"error": err})
+}
+
+// respondAPIKeyError 返回API密钥校验失败的错误
+func respondAPIKeyError(c *gin.Context, status int, message string) {
+	respondAPIError(c, status, apiKeyError(status, message))
+}
+
+// apiKeyError API密钥校验失败对应的错误
+func apiKeyError(status int, message string) *APIError {
+	if status == http.StatusUnauthorized {
+		return &APIError{Message: message, Type: errTypeAuthentication, Code: errCodeInvalidAPIKey}
+	}
+	return &APIError{Message: message, Type: errTypeServer, Code: errCodeAPIKeyNotSet}
+}
+
+// upstreamAPIError 将上游错误映射为HTTP状态码和OpenAI格式错误，message为返回给调用方的错误信息
+//
+//	Cookie失效、Clerk认证失败 -> 401；额度用尽 -> 402；并发/频率限制 -> 429
+//	WebSocket失败及其他上游错误 -> 502；超时 -> 504
+func upstreamAPIError(message string, err error) (int, *APIError) {
+	apiErr := &APIError{Message: message, Type: errTypeServer, Code: errCodeUpstreamError}
+
+	var authErr *services.AuthError
+	isAuth := errors.As(err, &authErr)
+
+	var upstreamErr *services.UpstreamError
+	var streamErr *services.StreamError
+	switch {
+	case services.IsTimeout(err):
+		apiErr.Code = errCodeUpstreamTimeout
+		return http.StatusGatewayTimeout, apiErr
+	case errors.Is(err, services.ErrNoSession):
+		apiErr.Type, apiErr.Code = errTypeAuthentication, errCodeCookieExpired
+		return http.StatusUnauthorized, apiErr
+	case errors.As(err, &upstreamErr):
+		switch upstreamErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			apiErr.Type, apiErr.Code = errTypeAuthentication, errCodeUpstreamAuth
+			if isAuth {
+				apiErr.Code = errCodeCookieExpired
+			}
+			return http.StatusUnauthorized, apiErr
+		case http.StatusPaymentRequired:
+			apiErr.Type, apiErr.Code = errTypeInsufficientQuota, errCodeInsufficientQuota
+			return http.StatusPaymentRequired, apiErr
+		case http.StatusTooManyRequests:
+			apiErr.Type, apiErr.Code = errTypeRateLimit, errCodeConcurrencyLimit
+			return http.StatusTooManyRequests, apiErr
+		}
+		// Clerk返回的其他4xx视为认证失败，5xx视为上游不可用
+		if isAuth && upstreamErr.StatusCode < http.StatusInternalServerError {
+			apiErr.Type, apiErr.Code = errTypeAuthentication, errCodeUpstreamAuth
+			return http.StatusUnauthorized, apiErr
+		}
+	case errors.As(err, &streamErr):
+		apiErr.Code = errCodeUpstreamStream
+	}
+	return http.StatusBadGateway, apiErr
+}
+
+// chatAPIError 聊天失败对应的HTTP状态码和OpenAI格式错误
+// startChat返回的chatError已经包含映射结果，其他错误（读取流失败）按上游错误映射
+func chatAPIError(err error) (int, *APIError) {
+	var chatErr *chatError
+	if errors.As(err, &chatErr) {
+		return chatErr.status, chatErr.apiErr
+	}
+	return upstreamAPIError("获取响应失败: "+err.Error(), err)
+}
+
+// respondChatError 返回聊天失败的错误响应
+func respondChatError(c *gin.Context, err error) {
+	status, apiErr := chatAPIError(err)
+	respondAPIError(c, status, apiErr)
+}
+
+// nullableString 空字符串转为nil
+func nullableString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"cto2api/services"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventsKeepAlive 没有事件时发送SSE注释保持连接
+const eventsKeepAlive = 15 * time.Second
+
+// CTOEvents 以SSE原样推送上游代理事件（文本、思考过程、文件修改、命令执行等）
+// 使用API密钥时必须指定chat_id，且只推送该密钥发起的聊天的事件；
+// 使用管理会话token时chat_id可以为空，推送所有进行中聊天的事件。SSE事件名为事件类型，data为services.ChatEvent
+func (h *APIHandler) CTOEvents(c *gin.Context) {
+	filter, ok := h.eventsFilter(c)
+	if !ok {
+		return
+	}
+
+	events, unsubscribe := h.events.Subscribe(filter)
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	ctx := c.Request.Context()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-events:
+			c.SSEvent(event.Type, event)
+			return true
+		case <-keepAlive.C:
+			w.Write([]byte(": keep-alive\n\n"))
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	})
+}
+
+// eventsFilter 根据调用方身份确定订阅条件，失败时已写入错误响应
+func (h *APIHandler) eventsFilter(c *gin.Context) (services.EventFilter, bool) {
+	filter := services.EventFilter{ChatID: c.Query("chat_id")}
+
+	token := extractBearerToken(c.GetHeader("Authorization"))
+	if token != "" {
+		if _, err := h.sessions.Validate(token); err == nil {
+			return filter, true
+		}
+	}
+
+	apiKey := token
+	if apiKey == "" {
+		apiKey = c.GetHeader("x-api-key")
+	}
+	if status, msg := h.validateAPIKey(c, apiKey); status != 0 {
+		respondAPIKeyError(c, status, msg)
+		return filter, false
+	}
+	if filter.ChatID == "" {
+		respondAPIError(c, http.StatusBadRequest, &APIError{
+			Message: "缺少chat_id（只有管理员可以订阅所有聊天）",
+			Type:    errTypeInvalidRequest,
+			Param:   "chat_id",
+		})
+		return filter, false
+	}
+	filter.APIKeyID = currentAPIKey(c).ID
+	return filter, true
+}
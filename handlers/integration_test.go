@@ -0,0 +1,1569 @@
+package handlers_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"cto2api/config"
+	"cto2api/handlers"
+	"cto2api/internal/fakeupstream"
+	"cto2api/models"
+	"cto2api/services"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testAPIKey        = "sk-test"
+	testAdminPassword = "admin-test"
+)
+
+var (
+	upstream *fakeupstream.Server
+	store    *models.DataStore
+	router   *gin.Engine
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := os.MkdirTemp("", "cto2api-test")
+	if err != nil {
+		panic(err)
+	}
+
+	storage, err := models.OpenBoltStorage(filepath.Join(dir, "cto2api.db"))
+	if err != nil {
+		panic(err)
+	}
+	store, err = models.GetStore(storage)
+	if err != nil {
+		panic(err)
+	}
+	store.SetAPIKey(testAPIKey)
+	hash, _ := bcrypt.GenerateFromPassword([]byte(testAdminPassword), bcrypt.MinCost)
+	store.SetPasswordHash(string(hash))
+
+	journal, err := services.NewJournal(storage, services.JournalOptions{RecordBodies: true})
+	if err != nil {
+		panic(err)
+	}
+
+	upstream = fakeupstream.New()
+	router = gin.New()
+	h := handlers.NewAPIHandler(store, upstream.Endpoints())
+	h.UseJournal(journal)
+	h.RegisterRoutes(router)
+
+	code := m.Run()
+
+	upstream.Close()
+	store.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// useAccounts 注册上游账号，并让Cookie池只包含这些账号的Cookie
+func useAccounts(t *testing.T, accounts ...*fakeupstream.Account) []*models.CookieInfo {
+	t.Helper()
+
+	for _, cookie := range store.ListCookies() {
+		store.DeleteCookie(cookie.ID)
+	}
+
+	cookies := make([]*models.CookieInfo, 0, len(accounts))
+	for i, account := range accounts {
+		// Cookie按测试区分，避免共享的JWT缓存和健康状态互相影响
+		account.Cookie = t.Name() + "-" + string(rune('a'+i))
+		upstream.AddAccount(account)
+
+		cookie := &models.CookieInfo{
+			ID:      uuid.New().String(),
+			Name:    account.Cookie,
+			Cookie:  account.Cookie,
+			Enabled: true,
+		}
+		if err := store.AddCookie(cookie); err != nil {
+			t.Fatal(err)
+		}
+		cookies = append(cookies, cookie)
+	}
+	return cookies
+}
+
+// post 发送带API密钥的JSON请求
+func post(t *testing.T, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	return postWithKey(t, path, testAPIKey, body)
+}
+
+// postWithKey 使用指定的API密钥（或管理token）发送JSON请求
+func postWithKey(t *testing.T, path, key string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// sseData 解析SSE响应中的data行
+func sseData(t *testing.T, body string) []string {
+	t.Helper()
+
+	var result []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data:"); ok {
+			result = append(result, strings.TrimSpace(data))
+		}
+	}
+	return result
+}
+
+func chatRequest(content string, stream bool) map[string]interface{} {
+	return map[string]interface{}{
+		"model":    "gpt-5",
+		"stream":   stream,
+		"messages": []map[string]string{{"role": "user", "content": content}},
+	}
+}
+
+func TestChatCompletionsNonStreaming(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"Hello", ", world"}})
+
+	w := post(t, "/v1/chat/completions", chatRequest("hi there", false))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var resp handlers.ChatResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.Choices[0].Message.Content.String(); got != "Hello, world" {
+		t.Errorf("content = %q, want %q", got, "Hello, world")
+	}
+	if got := resp.Choices[0].FinishReason; got != "stop" {
+		t.Errorf("finish_reason = %q, want stop", got)
+	}
+
+	chats := upstream.Chats()
+	last := chats[len(chats)-1]
+	if last.Adapter != "GPT5" {
+		t.Errorf("adapter = %q, want GPT5", last.Adapter)
+	}
+	if !strings.Contains(last.Prompt, "hi there") {
+		t.Errorf("prompt %q does not contain the user message", last.Prompt)
+	}
+}
+
+func TestChatCompletionsStreaming(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"foo", "bar"}})
+
+	w := post(t, "/v1/chat/completions", chatRequest("stream please", true))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	events := sseData(t, w.Body.String())
+	if len(events) == 0 || events[len(events)-1] != "[DONE]" {
+		t.Fatalf("stream did not end with [DONE]: %q", events)
+	}
+
+	var text strings.Builder
+	var finish string
+	for _, data := range events[:len(events)-1] {
+		var chunk handlers.StreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		text.WriteString(chunk.Choices[0].Delta.Content)
+		if chunk.Choices[0].FinishReason != nil {
+			finish = *chunk.Choices[0].FinishReason
+		}
+	}
+	if text.String() != "foobar" {
+		t.Errorf("streamed text = %q, want %q", text.String(), "foobar")
+	}
+	if finish != "stop" {
+		t.Errorf("finish_reason = %q, want stop", finish)
+	}
+}
+
+func TestChatCompletionsContentParts(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"ok"}})
+
+	// 文本片段按换行拼接，字符串形式不变
+	tests := []struct {
+		name    string
+		content interface{}
+		prompt  string
+	}{
+		{"text parts", []map[string]string{{"type": "text", "text": "first"}, {"type": "text", "text": "second"}}, "first\nsecond"},
+		{"plain string", "just text", "just text"},
+	}
+	for _, tt := range tests {
+		w := post(t, "/v1/chat/completions", map[string]interface{}{
+			"model":    "gpt-5",
+			"messages": []map[string]interface{}{{"role": "user", "content": tt.content}},
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", tt.name, w.Code, w.Body.String())
+		}
+		chats := upstream.Chats()
+		if got := chats[len(chats)-1].Prompt; got != tt.prompt {
+			t.Errorf("%s: prompt = %q, want %q", tt.name, got, tt.prompt)
+		}
+	}
+
+	// 图片片段返回OpenAI格式的400，param指向不支持的片段
+	w := post(t, "/v1/chat/completions", map[string]interface{}{
+		"model": "gpt-5",
+		"messages": []map[string]interface{}{
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": []map[string]interface{}{
+				{"type": "text", "text": "what is this?"},
+				{"type": "image_url", "image_url": map[string]string{"url": "https://example.com/cat.png"}},
+			}},
+		},
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("image status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var envelope struct {
+		Error struct {
+			Type  string `json:"type"`
+			Param string `json:"param"`
+			Code  string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Error.Type != "invalid_request_error" || envelope.Error.Param != "messages[1].content[1]" || envelope.Error.Code != "unsupported_content_type" {
+		t.Errorf("error = %+v", envelope.Error)
+	}
+}
+
+// toolReply 工具调用的开始和结束标记被拆分到不同帧中的上游回复
+var toolReply = []string{
+	"Let me check.<tool_",
+	"call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": ",
+	"\"Paris\"}}\n</tool_call>\n<tool_call>{\"name\": \"get_time\"}</tool",
+	"_call>",
+}
+
+func toolRequest(stream bool) map[string]interface{} {
+	req := chatRequest("weather and time in Paris?", stream)
+	req["tools"] = []map[string]interface{}{
+		{"type": "function", "function": map[string]interface{}{"name": "get_weather", "parameters": map[string]interface{}{"type": "object"}}},
+		{"type": "function", "function": map[string]interface{}{"name": "get_time"}},
+	}
+	return req
+}
+
+func TestChatCompletionsToolCalls(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: toolReply})
+
+	w := post(t, "/v1/chat/completions", toolRequest(false))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp handlers.ChatResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	choice := resp.Choices[0]
+	if choice.FinishReason != "tool_calls" {
+		t.Errorf("finish_reason = %q, want tool_calls", choice.FinishReason)
+	}
+	if got := choice.Message.Content.String(); got != "Let me check." {
+		t.Errorf("content = %q", got)
+	}
+	calls := choice.Message.ToolCalls
+	if len(calls) != 2 || calls[0].Function.Name != "get_weather" || calls[0].Function.Arguments != `{"city":"Paris"}` ||
+		calls[1].Function.Name != "get_time" || calls[1].Function.Arguments != "{}" {
+		t.Fatalf("tool calls = %+v", calls)
+	}
+	if calls[0].ID == "" || calls[0].ID == calls[1].ID || calls[0].Type != "function" {
+		t.Errorf("tool call ids = %q, %q (type %q)", calls[0].ID, calls[1].ID, calls[0].Type)
+	}
+
+	chats := upstream.Chats()
+	if prompt := chats[len(chats)-1].Prompt; !strings.Contains(prompt, "get_weather") || !strings.Contains(prompt, "<tool_call>") {
+		t.Errorf("prompt does not describe the tools: %q", prompt)
+	}
+}
+
+func TestChatCompletionsToolCallsStreaming(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: toolReply})
+
+	w := post(t, "/v1/chat/completions", toolRequest(true))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	events := sseData(t, w.Body.String())
+	if len(events) == 0 || events[len(events)-1] != "[DONE]" {
+		t.Fatalf("stream did not end with [DONE]: %q", events)
+	}
+
+	var text strings.Builder
+	var calls []handlers.ToolCall
+	var finish string
+	for _, data := range events[:len(events)-1] {
+		var chunk handlers.StreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		delta := chunk.Choices[0].Delta
+		if strings.Contains(delta.Content, "<tool") {
+			t.Errorf("tool call markup leaked into content: %q", delta.Content)
+		}
+		text.WriteString(delta.Content)
+		calls = append(calls, delta.ToolCalls...)
+		if chunk.Choices[0].FinishReason != nil {
+			finish = *chunk.Choices[0].FinishReason
+		}
+	}
+
+	if strings.TrimSpace(text.String()) != "Let me check." {
+		t.Errorf("streamed text = %q", text.String())
+	}
+	if len(calls) != 2 || *calls[0].Index != 0 || *calls[1].Index != 1 ||
+		calls[0].Function.Name != "get_weather" || calls[1].Function.Name != "get_time" {
+		t.Errorf("streamed tool calls = %+v", calls)
+	}
+	if finish != "tool_calls" {
+		t.Errorf("finish_reason = %q, want tool_calls", finish)
+	}
+}
+
+func TestChatCompletionsRejectsInvalidAPIKey(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"unused"}})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"gpt-5","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer wrong-key")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if got := errorCode(t, w.Body.Bytes()); got != "invalid_api_key" {
+		t.Errorf("error code = %q, want invalid_api_key", got)
+	}
+}
+
+func TestChatCompletionsStreamInterrupted(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{
+		Frames: []string{fakeupstream.UpdateFrame("partial")},
+		Abort:  true,
+	})
+
+	w := post(t, "/v1/chat/completions", chatRequest("will break", false))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d, body = %s", w.Code, http.StatusBadGateway, w.Body.String())
+	}
+	if got := errorCode(t, w.Body.Bytes()); got != "upstream_stream_error" {
+		t.Errorf("error code = %q, want upstream_stream_error", got)
+	}
+}
+
+func TestChatCompletionsStreamInterruptedSendsErrorEvent(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{
+		Frames: []string{fakeupstream.UpdateFrame("partial")},
+		Abort:  true,
+	})
+
+	w := post(t, "/v1/chat/completions", chatRequest("will break", true))
+	events := sseData(t, w.Body.String())
+	if len(events) == 0 {
+		t.Fatal("empty stream")
+	}
+	last := events[len(events)-1]
+	if got := errorCode(t, []byte(last)); got != "upstream_stream_error" {
+		t.Errorf("last event = %s, want an upstream_stream_error error event", last)
+	}
+}
+
+func TestChatCompletionsErrorMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		account *fakeupstream.Account
+		status  int
+		code    string
+	}{
+		{"expired cookie", &fakeupstream.Account{NoSession: true}, http.StatusUnauthorized, "cookie_expired"},
+		{"clerk rejected", &fakeupstream.Account{ClerkStatus: http.StatusUnauthorized}, http.StatusUnauthorized, "cookie_expired"},
+		{"credits exhausted", &fakeupstream.Account{ChatStatus: http.StatusPaymentRequired}, http.StatusPaymentRequired, "insufficient_quota"},
+		{"upstream concurrency", &fakeupstream.Account{ChatStatus: http.StatusTooManyRequests}, http.StatusTooManyRequests, "concurrency_limit_exceeded"},
+		{"upstream down", &fakeupstream.Account{ChatStatus: http.StatusServiceUnavailable}, http.StatusBadGateway, "upstream_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useAccounts(t, tt.account)
+
+			w := post(t, "/v1/chat/completions", chatRequest("hello", false))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d, body = %s", w.Code, tt.status, w.Body.String())
+			}
+			if got := errorCode(t, w.Body.Bytes()); got != tt.code {
+				t.Errorf("error code = %q, want %q", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestChatCompletionsAllCookiesBusy(t *testing.T) {
+	cookies := useAccounts(t, &fakeupstream.Account{Reply: []string{"unused"}})
+	store.SetUsage(cookies[0].ID, &models.UsageInfo{TaskConcurrencyLimit: 1})
+	if store.UseCookie(cookies[0].ID) == nil {
+		t.Fatal("could not occupy the only slot")
+	}
+	defer store.ReleaseCookie(cookies[0].ID)
+
+	cfg := config.Get()
+	cfg.QueueMaxSize = 0
+	t.Cleanup(func() { cfg.QueueMaxSize = 50 })
+
+	w := post(t, "/v1/chat/completions", chatRequest("busy?", false))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d, body = %s", w.Code, http.StatusTooManyRequests, w.Body.String())
+	}
+	if got := errorCode(t, w.Body.Bytes()); got != "concurrency_limit_exceeded" {
+		t.Errorf("error code = %q, want concurrency_limit_exceeded", got)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After header")
+	}
+}
+
+func TestChatCompletionsQueue(t *testing.T) {
+	cookies := useAccounts(t, &fakeupstream.Account{Reply: []string{"queued"}})
+	store.SetUsage(cookies[0].ID, &models.UsageInfo{TaskConcurrencyLimit: 1})
+	if store.UseCookie(cookies[0].ID) == nil {
+		t.Fatal("could not occupy the only slot")
+	}
+
+	cfg := config.Get()
+	cfg.QueueTimeoutSeconds = 1
+	t.Cleanup(func() { cfg.QueueTimeoutSeconds = 30 })
+
+	// 没有Cookie释放时排队超时
+	w := post(t, "/v1/chat/completions", chatRequest("wait", false))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d, body = %s", w.Code, http.StatusTooManyRequests, w.Body.String())
+	}
+	if got := errorCode(t, w.Body.Bytes()); got != "queue_timeout" {
+		t.Errorf("error code = %q, want queue_timeout", got)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+
+	// 排队期间Cookie释放后继续处理
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- post(t, "/v1/chat/completions", chatRequest("wait", false)) }()
+	time.Sleep(100 * time.Millisecond)
+	store.ReleaseCookie(cookies[0].ID)
+
+	w = <-done
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestChatCompletionsGlobalRateLimit(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"ok"}})
+
+	cfg := config.Get()
+	cfg.RateLimitGlobalRPM = 1
+	cfg.RateLimitGlobalBurst = 2
+	t.Cleanup(func() { cfg.RateLimitGlobalRPM, cfg.RateLimitGlobalBurst = 0, 0 })
+
+	for i, remaining := range []string{"1", "0"} {
+		w := post(t, "/v1/chat/completions", chatRequest("hi", false))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d status = %d, body = %s", i, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("x-ratelimit-remaining-requests"); got != remaining {
+			t.Errorf("request %d x-ratelimit-remaining-requests = %q, want %s", i, got, remaining)
+		}
+		if got := w.Header().Get("x-ratelimit-limit-requests"); got != "1" {
+			t.Errorf("request %d x-ratelimit-limit-requests = %q, want 1", i, got)
+		}
+	}
+
+	w := post(t, "/v1/chat/completions", chatRequest("hi", false))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d, body = %s", w.Code, http.StatusTooManyRequests, w.Body.String())
+	}
+	if got := errorCode(t, w.Body.Bytes()); got != "rate_limit_exceeded" {
+		t.Errorf("error code = %q, want rate_limit_exceeded", got)
+	}
+	// 每分钟1个令牌，下一个令牌约在60秒后
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+}
+
+// errorCode 解析OpenAI格式错误的code字段
+func errorCode(t *testing.T, body []byte) string {
+	t.Helper()
+
+	var envelope struct {
+		Error *struct {
+			Message string  `json:"message"`
+			Type    string  `json:"type"`
+			Code    *string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error == nil {
+		t.Fatalf("not an OpenAI error envelope: %s", body)
+	}
+	if envelope.Error.Message == "" || envelope.Error.Type == "" {
+		t.Errorf("error envelope is missing message or type: %s", body)
+	}
+	if envelope.Error.Code == nil {
+		return ""
+	}
+	return *envelope.Error.Code
+}
+
+func TestChatCompletionsClientDisconnect(t *testing.T) {
+	cookies := useAccounts(t, &fakeupstream.Account{
+		Frames: []string{fakeupstream.UpdateFrame("working")},
+		Hold:   true,
+	})
+
+	for _, stream := range []bool{true, false} {
+		data, _ := json.Marshal(chatRequest("long task", stream))
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(data)).WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+testAPIKey)
+
+		done := make(chan struct{})
+		go func() {
+			router.ServeHTTP(httptest.NewRecorder(), req)
+			close(done)
+		}()
+
+		waitFor(t, "upstream stream to open", func() bool { return upstream.OpenStreams() == 1 })
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("stream=%v: handler still running after client disconnect", stream)
+		}
+		waitFor(t, "upstream stream to close", func() bool { return upstream.OpenStreams() == 0 })
+
+		if n := store.InFlight(cookies[0].ID); n != 0 {
+			t.Errorf("stream=%v: in-flight = %d after disconnect, want 0", stream, n)
+		}
+	}
+
+	if got := store.GetCookie(cookies[0].ID).ErrorCount; got != 0 {
+		t.Errorf("client disconnects counted as %d cookie errors", got)
+	}
+}
+
+// waitFor 轮询直到条件成立
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChatCompletionsNoCookies(t *testing.T) {
+	useAccounts(t)
+
+	w := post(t, "/v1/chat/completions", chatRequest("anyone?", false))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestChatCompletionsFailover(t *testing.T) {
+	cookies := useAccounts(t,
+		&fakeupstream.Account{ClerkStatus: http.StatusBadGateway},
+		&fakeupstream.Account{Reply: []string{"recovered"}},
+	)
+	bad, good := cookies[0], cookies[1]
+	wantTrail := bad.ID + "=clerk_failed, " + good.ID + "=ok"
+
+	// 轮询下两次请求中至少有一次先选到失败的Cookie
+	sawFailover := false
+	for i := 0; i < 2; i++ {
+		w := post(t, "/v1/chat/completions", chatRequest("failover "+string(rune('0'+i)), false))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		if w.Header().Get("X-CTO2API-Attempt-Trail") == wantTrail {
+			sawFailover = true
+			if got := w.Header().Get("X-CTO2API-Attempts"); got != "2" {
+				t.Errorf("X-CTO2API-Attempts = %q, want 2", got)
+			}
+		}
+	}
+	if !sawFailover {
+		t.Errorf("no request failed over from %s to %s", bad.ID, good.ID)
+	}
+	if store.GetCookie(bad.ID).ErrorCount == 0 {
+		t.Error("failed cookie has no recorded error")
+	}
+}
+
+func TestChatCompletionsAllCookiesFail(t *testing.T) {
+	useAccounts(t,
+		&fakeupstream.Account{ClerkStatus: http.StatusBadGateway},
+		&fakeupstream.Account{ChatStatus: http.StatusInternalServerError},
+	)
+
+	w := post(t, "/v1/chat/completions", chatRequest("nobody home", false))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if got := w.Header().Get("X-CTO2API-Attempts"); got != "2" {
+		t.Errorf("X-CTO2API-Attempts = %q, want 2", got)
+	}
+	if !strings.Contains(w.Body.String(), "尝试2个Cookie均失败") {
+		t.Errorf("body = %s, want failover summary", w.Body.String())
+	}
+}
+
+// conversationRequest 带对话历史的请求
+func conversationRequest(messages ...string) map[string]interface{} {
+	history := make([]map[string]string, 0, len(messages))
+	for i, content := range messages {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		history = append(history, map[string]string{"role": role, "content": content})
+	}
+	return map[string]interface{}{"model": "gpt-5", "messages": history}
+}
+
+func TestConversationAffinity(t *testing.T) {
+	cookies := useAccounts(t,
+		&fakeupstream.Account{Reply: []string{"first reply"}},
+		&fakeupstream.Account{Reply: []string{"first reply"}},
+	)
+	byValue := map[string]*models.CookieInfo{cookies[0].Cookie: cookies[0], cookies[1].Cookie: cookies[1]}
+
+	if w := post(t, "/v1/chat/completions", conversationRequest("turn one")); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	first := upstream.Chats()[len(upstream.Chats())-1]
+
+	// 命中：续接同一个上游会话，只发送新增的消息
+	w := post(t, "/v1/chat/completions", conversationRequest("turn one", "first reply", "turn two"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	second := upstream.Chats()[len(upstream.Chats())-1]
+	if second.ChatID != first.ChatID || second.Cookie != first.Cookie {
+		t.Errorf("continued chat = %+v, want chat %s on %s", second, first.ChatID, first.Cookie)
+	}
+	if second.Prompt != "turn two" {
+		t.Errorf("continued prompt = %q, want only the new message", second.Prompt)
+	}
+	if trail := w.Header().Get("X-CTO2API-Attempt-Trail"); trail != byValue[first.Cookie].ID+"=continue_ok" {
+		t.Errorf("attempt trail = %q", trail)
+	}
+
+	// 未命中：历史中的助手回复与之前的响应不一致时创建新会话
+	post(t, "/v1/chat/completions", conversationRequest("turn one", "edited reply", "turn two"))
+	if miss := upstream.Chats()[len(upstream.Chats())-1]; miss.ChatID == first.ChatID || !strings.Contains(miss.Prompt, "edited reply") {
+		t.Errorf("mismatched history reused chat: %+v", miss)
+	}
+
+	// 原Cookie不可用时在其他Cookie上创建新会话，并发送完整历史
+	store.RecordFailure(byValue[first.Cookie].ID, models.FailureAuth, "session expired")
+	w = post(t, "/v1/chat/completions", conversationRequest("turn one", "first reply", "turn two", "first reply", "turn three"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	moved := upstream.Chats()[len(upstream.Chats())-1]
+	if moved.Cookie == first.Cookie || moved.ChatID == first.ChatID {
+		t.Errorf("chat after cookie failure = %+v, want a new chat on the other cookie", moved)
+	}
+	if !strings.Contains(moved.Prompt, "turn one") || !strings.Contains(moved.Prompt, "turn three") {
+		t.Errorf("new chat prompt = %q, want the full history", moved.Prompt)
+	}
+}
+
+// TestConversationAffinityPerKey 会话亲和只在同一个API密钥、同一个适配器内续接
+func TestConversationAffinityPerKey(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"shared reply"}})
+	_, other := createAPIKey(t, adminToken(t), map[string]interface{}{"name": "affinity-other"})
+
+	if w := post(t, "/v1/chat/completions", conversationRequest("same opening")); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	first := upstream.Chats()[len(upstream.Chats())-1]
+
+	// 另一个API密钥发送相同的前缀：创建新会话并发送完整历史
+	w := postWithKey(t, "/v1/chat/completions", other, conversationRequest("same opening", "shared reply", "next"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if chat := upstream.Chats()[len(upstream.Chats())-1]; chat.ChatID == first.ChatID || !strings.Contains(chat.Prompt, "same opening") {
+		t.Errorf("other key continued chat %s: %+v", first.ChatID, chat)
+	}
+
+	// 同一个密钥换用其他模型：不续接
+	request := conversationRequest("same opening", "shared reply", "next")
+	request["model"] = "claude-sonnet-4-5"
+	if w := post(t, "/v1/chat/completions", request); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if chat := upstream.Chats()[len(upstream.Chats())-1]; chat.ChatID == first.ChatID {
+		t.Errorf("chat %s continued under another model", first.ChatID)
+	}
+}
+
+func TestMessagesNonStreaming(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"Bonjour"}})
+
+	w := post(t, "/v1/messages", map[string]interface{}{
+		"model":      "claude-sonnet-4-5",
+		"max_tokens": 128,
+		"messages":   []map[string]string{{"role": "user", "content": "salut"}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var resp handlers.AnthropicResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Content) != 1 || resp.Content[0].Text != "Bonjour" {
+		t.Errorf("content = %+v, want a single Bonjour text block", resp.Content)
+	}
+	if resp.StopReason == nil || *resp.StopReason != "end_turn" {
+		t.Errorf("stop_reason = %v, want end_turn", resp.StopReason)
+	}
+}
+
+// anthropicToolRequest 带工具定义的Messages请求
+func anthropicToolRequest(stream bool) map[string]interface{} {
+	return map[string]interface{}{
+		"model":      "claude-sonnet-4-5",
+		"max_tokens": 128,
+		"stream":     stream,
+		"messages":   []map[string]string{{"role": "user", "content": "weather and time in Paris?"}},
+		"tools": []map[string]interface{}{
+			{"name": "get_weather", "input_schema": map[string]interface{}{"type": "object"}},
+			{"name": "get_time", "input_schema": map[string]interface{}{"type": "object"}},
+		},
+	}
+}
+
+func TestMessagesToolUse(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: toolReply})
+
+	w := post(t, "/v1/messages", anthropicToolRequest(false))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp handlers.AnthropicResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StopReason == nil || *resp.StopReason != "tool_use" {
+		t.Errorf("stop_reason = %v, want tool_use", resp.StopReason)
+	}
+	if len(resp.Content) != 3 || resp.Content[0].Type != "text" || resp.Content[0].Text != "Let me check." {
+		t.Fatalf("content = %+v, want text followed by two tool_use blocks", resp.Content)
+	}
+	for i, want := range []struct{ name, input string }{{"get_weather", `{"city":"Paris"}`}, {"get_time", `{}`}} {
+		block := resp.Content[i+1]
+		if block.Type != "tool_use" || block.Name != want.name || string(block.Input) != want.input || !strings.HasPrefix(block.ID, "toolu_") {
+			t.Errorf("block %d = %+v, want %s with input %s", i+1, block, want.name, want.input)
+		}
+	}
+}
+
+// TestMessagesToolUseInvalidInput 参数不是JSON对象时包装为{"raw": 原文}，响应仍是合法的JSON
+func TestMessagesToolUseInvalidInput(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		useAccounts(t, &fakeupstream.Account{Reply: []string{`<tool_call>{"name": "get_time", "arguments": "not json"}</tool_call>`}})
+
+		w := post(t, "/v1/messages", anthropicToolRequest(stream))
+		if w.Code != http.StatusOK {
+			t.Fatalf("stream=%v: status = %d, body = %s", stream, w.Code, w.Body.String())
+		}
+
+		var input strings.Builder
+		if stream {
+			for _, data := range sseData(t, w.Body.String()) {
+				var event struct {
+					Delta struct {
+						PartialJSON string `json:"partial_json"`
+					} `json:"delta"`
+				}
+				if err := json.Unmarshal([]byte(data), &event); err != nil {
+					t.Fatalf("invalid event %q: %v", data, err)
+				}
+				input.WriteString(event.Delta.PartialJSON)
+			}
+		} else {
+			var resp handlers.AnthropicResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid body %q: %v", w.Body.String(), err)
+			}
+			if len(resp.Content) != 1 {
+				t.Fatalf("content = %+v, want a single tool_use block", resp.Content)
+			}
+			input.Write(resp.Content[0].Input)
+		}
+		if input.String() != `{"raw":"not json"}` {
+			t.Errorf("stream=%v: input = %s, want the wrapped raw arguments", stream, input.String())
+		}
+	}
+}
+
+func TestMessagesStreaming(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"a", "b"}})
+
+	w := post(t, "/v1/messages", map[string]interface{}{
+		"model":      "claude-sonnet-4-5",
+		"max_tokens": 128,
+		"stream":     true,
+		"messages":   []map[string]string{{"role": "user", "content": "stream it"}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var text strings.Builder
+	var stopped bool
+	for _, data := range sseData(t, w.Body.String()) {
+		var event struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		switch event.Type {
+		case "content_block_delta":
+			text.WriteString(event.Delta.Text)
+		case "message_stop":
+			stopped = true
+		}
+	}
+	if text.String() != "ab" {
+		t.Errorf("streamed text = %q, want %q", text.String(), "ab")
+	}
+	if !stopped {
+		t.Error("stream did not end with message_stop")
+	}
+}
+
+func TestChatCompletionsReasoningContent(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{
+		Thinking: []string{"Look", "ing around"},
+		Reply:    []string{"Found it"},
+	})
+
+	cfg := config.Get()
+	cfg.ExposeReasoning = true
+	t.Cleanup(func() { cfg.ExposeReasoning = false })
+
+	w := post(t, "/v1/chat/completions", chatRequest("where is it", true))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var reasoning, text strings.Builder
+	for _, data := range sseData(t, w.Body.String()) {
+		if data == "[DONE]" {
+			continue
+		}
+		var chunk handlers.StreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		reasoning.WriteString(chunk.Choices[0].Delta.ReasoningContent)
+		text.WriteString(chunk.Choices[0].Delta.Content)
+	}
+	if reasoning.String() != "Looking around" {
+		t.Errorf("reasoning_content = %q, want %q", reasoning.String(), "Looking around")
+	}
+	if text.String() != "Found it" {
+		t.Errorf("content = %q, want %q", text.String(), "Found it")
+	}
+}
+
+func TestChatCompletionsHidesReasoningByDefault(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Thinking: []string{"secret plan"}, Reply: []string{"ok"}})
+
+	w := post(t, "/v1/chat/completions", chatRequest("hi", false))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "secret plan") {
+		t.Errorf("reasoning leaked into response: %s", w.Body.String())
+	}
+}
+
+func TestMessagesThinkingBlocks(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Thinking: []string{"hmm"}, Reply: []string{"Answer"}})
+
+	request := map[string]interface{}{
+		"model":      "claude-sonnet-4-5",
+		"max_tokens": 128,
+		"thinking":   map[string]interface{}{"type": "enabled", "budget_tokens": 1024},
+		"messages":   []map[string]string{{"role": "user", "content": "think first"}},
+	}
+
+	w := post(t, "/v1/messages", request)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp handlers.AnthropicResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Content) != 2 || resp.Content[0].Type != "thinking" || resp.Content[0].Thinking != "hmm" || resp.Content[1].Text != "Answer" {
+		t.Errorf("content = %+v, want a thinking block followed by the answer", resp.Content)
+	}
+
+	request["stream"] = true
+	w = post(t, "/v1/messages", request)
+	var types []string
+	for _, data := range sseData(t, w.Body.String()) {
+		var event struct {
+			Type         string `json:"type"`
+			ContentBlock struct {
+				Type string `json:"type"`
+			} `json:"content_block"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		if event.Type == "content_block_start" {
+			types = append(types, event.ContentBlock.Type)
+		}
+	}
+	if strings.Join(types, ",") != "thinking,text" {
+		t.Errorf("streamed blocks = %v, want [thinking text]", types)
+	}
+}
+
+// sendWithKey 使用指定的API密钥发送无请求体的请求
+func sendWithKey(t *testing.T, method, path, key string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// responseText 响应中所有message输出项的文本
+func responseText(t *testing.T, body []byte) (string, string) {
+	t.Helper()
+
+	var resp struct {
+		ID     string `json:"id"`
+		Output []struct {
+			Type    string `json:"type"`
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"output"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	var text strings.Builder
+	for _, item := range resp.Output {
+		for _, part := range item.Content {
+			text.WriteString(part.Text)
+		}
+	}
+	return resp.ID, text.String()
+}
+
+func TestResponses(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"Hello", ", world"}})
+
+	w := post(t, "/v1/responses", map[string]interface{}{"model": "gpt-5", "input": "hi there"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	id, text := responseText(t, w.Body.Bytes())
+	if text != "Hello, world" {
+		t.Errorf("output text = %q, want %q", text, "Hello, world")
+	}
+
+	w = sendWithKey(t, http.MethodGet, "/v1/responses/"+id, testAPIKey)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if gotID, gotText := responseText(t, w.Body.Bytes()); gotID != id || gotText != text {
+		t.Errorf("stored response = %s, %q", gotID, gotText)
+	}
+
+	// previous_response_id带上之前的对话，因此续接同一个上游会话，只发送新增的输入
+	first := upstream.Chats()[len(upstream.Chats())-1]
+	w = post(t, "/v1/responses", map[string]interface{}{"model": "gpt-5", "input": "follow up", "previous_response_id": id})
+	if w.Code != http.StatusOK {
+		t.Fatalf("chained status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if chained := upstream.Chats()[len(upstream.Chats())-1]; chained.ChatID != first.ChatID || chained.Prompt != "follow up" {
+		t.Errorf("chained chat = %+v, want chat %s continued with the new input", chained, first.ChatID)
+	}
+
+	// 其他API密钥看不到该响应
+	_, otherKey := createAPIKey(t, adminToken(t), map[string]interface{}{"name": "responses other"})
+	if w := sendWithKey(t, http.MethodGet, "/v1/responses/"+id, otherKey); w.Code != http.StatusNotFound {
+		t.Errorf("get with another key status = %d, want 404", w.Code)
+	}
+	if w := sendWithKey(t, http.MethodDelete, "/v1/responses/"+id, otherKey); w.Code != http.StatusNotFound {
+		t.Errorf("delete with another key status = %d, want 404", w.Code)
+	}
+	w = postWithKey(t, "/v1/responses", otherKey, map[string]interface{}{"model": "gpt-5", "input": "steal", "previous_response_id": id})
+	if w.Code != http.StatusNotFound || errorCode(t, w.Body.Bytes()) != "previous_response_not_found" {
+		t.Errorf("chain with another key status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	if w := sendWithKey(t, http.MethodDelete, "/v1/responses/"+id, testAPIKey); w.Code != http.StatusOK {
+		t.Fatalf("delete status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := sendWithKey(t, http.MethodGet, "/v1/responses/"+id, testAPIKey); w.Code != http.StatusNotFound {
+		t.Errorf("get after delete status = %d, want 404", w.Code)
+	}
+}
+
+func TestResponsesStreaming(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"Checking.", `<tool_call>{"name": "get_time"}</tool_call>`}})
+
+	w := post(t, "/v1/responses", map[string]interface{}{
+		"model":  "gpt-5",
+		"input":  "what time is it?",
+		"stream": true,
+		"tools":  []map[string]interface{}{{"type": "function", "name": "get_time"}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var types []string
+	var text strings.Builder
+	var completed json.RawMessage
+	for i, data := range sseData(t, w.Body.String()) {
+		var event struct {
+			Type     string          `json:"type"`
+			Sequence int             `json:"sequence_number"`
+			Delta    string          `json:"delta"`
+			Response json.RawMessage `json:"response"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		if event.Sequence != i {
+			t.Errorf("event %d (%s) sequence_number = %d", i, event.Type, event.Sequence)
+		}
+		if event.Type == "response.output_text.delta" {
+			text.WriteString(event.Delta)
+			// 连续的文本增量合并为一项再比较顺序
+			if types[len(types)-1] == event.Type {
+				continue
+			}
+		}
+		if event.Type == "response.completed" {
+			completed = event.Response
+		}
+		types = append(types, event.Type)
+	}
+
+	want := []string{
+		"response.created",
+		"response.in_progress",
+		"response.output_item.added",
+		"response.content_part.added",
+		"response.output_text.delta",
+		"response.output_text.done",
+		"response.content_part.done",
+		"response.output_item.done",
+		"response.output_item.added",
+		"response.function_call_arguments.delta",
+		"response.function_call_arguments.done",
+		"response.output_item.done",
+		"response.completed",
+	}
+	if strings.Join(types, "\n") != strings.Join(want, "\n") {
+		t.Errorf("event order:\n%s\nwant:\n%s", strings.Join(types, "\n"), strings.Join(want, "\n"))
+	}
+	if text.String() != "Checking." {
+		t.Errorf("streamed text = %q", text.String())
+	}
+
+	var resp struct {
+		Status string `json:"status"`
+		Output []struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+		} `json:"output"`
+	}
+	if err := json.Unmarshal(completed, &resp); err != nil {
+		t.Fatalf("invalid completed response %s: %v", completed, err)
+	}
+	if resp.Status != "completed" || len(resp.Output) != 2 || resp.Output[0].Type != "message" ||
+		resp.Output[1].Type != "function_call" || resp.Output[1].Name != "get_time" {
+		t.Errorf("completed response = %s", completed)
+	}
+}
+
+func TestCTOEvents(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Thinking: []string{"planning"}, Reply: []string{"done"}})
+
+	// API密钥只能订阅指定的聊天
+	if w := sendWithKey(t, http.MethodGet, "/v1/cto/events", testAPIKey); w.Code != http.StatusBadRequest {
+		t.Errorf("subscribe all with an API key: status = %d, want 400", w.Code)
+	}
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// 管理员可以订阅所有聊天
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/v1/cto/events", nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken(t))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+
+	// 订阅建立后再发起聊天
+	w := post(t, "/v1/chat/completions", chatRequest("watch me", false))
+	if w.Code != http.StatusOK {
+		t.Fatalf("chat status = %d, body = %s", w.Code, w.Body.String())
+	}
+	chatID := w.Header().Get("X-CTO2API-Chat-ID")
+	if chatID == "" {
+		t.Error("chat response has no X-CTO2API-Chat-ID header")
+	}
+
+	var types []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Type     string `json:"type"`
+			Content  string `json:"content"`
+			ChatID   string `json:"chat_id"`
+			APIKeyID string `json:"api_key_id"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", data, err)
+		}
+		if event.ChatID != chatID || event.APIKeyID != models.DefaultAPIKeyID {
+			t.Errorf("event chat = %s (key %s), want %s (key %s)", event.ChatID, event.APIKeyID, chatID, models.DefaultAPIKeyID)
+		}
+		types = append(types, event.Type+":"+event.Content)
+		if event.Type == "done" {
+			break
+		}
+	}
+
+	want := "reasoning:planning,text:done,done:"
+	if strings.Join(types, ",") != want {
+		t.Errorf("events = %v, want %s", types, want)
+	}
+}
+
+// adminToken 登录管理后台，返回会话token
+func adminToken(t *testing.T) string {
+	t.Helper()
+
+	w := postWithKey(t, "/api/admin/login", "", map[string]string{"password": testAdminPassword})
+	if w.Code != http.StatusOK {
+		t.Fatalf("login status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token
+}
+
+// createAPIKey 通过管理接口创建API密钥，返回密钥ID和明文密钥
+func createAPIKey(t *testing.T, token string, body map[string]interface{}) (string, string) {
+	t.Helper()
+
+	w := postWithKey(t, "/api/admin/keys", token, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create key status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.ID, resp.Key
+}
+
+func TestAdminAPIKeys(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"ok"}})
+	token := adminToken(t)
+
+	id, key := createAPIKey(t, token, map[string]interface{}{"name": "team-a", "owner": "alice"})
+	if w := postWithKey(t, "/v1/chat/completions", key, chatRequest("hi", false)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	// 列表只返回脱敏后的密钥，不包含明文和哈希
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/keys", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), key) || strings.Contains(w.Body.String(), models.HashAPIKey(key)) {
+		t.Errorf("key list leaks the key: %s", w.Body.String())
+	}
+	var keys []*models.APIKeyInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil {
+		t.Fatal(err)
+	}
+	var found *models.APIKeyInfo
+	for _, k := range keys {
+		if k.ID == id {
+			found = k
+		}
+	}
+	if found == nil {
+		t.Fatalf("key %s not listed: %s", id, w.Body.String())
+	}
+	if found.Owner != "alice" || found.Usage.RequestCount != 1 || found.Usage.Credits != 1 {
+		t.Errorf("listed key = %+v, want owner alice with 1 request and 1 credit", found)
+	}
+
+	// 撤销后立即失效
+	req = httptest.NewRequest(http.MethodDelete, "/api/admin/keys/"+id, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoke status = %d, body = %s", w.Code, w.Body.String())
+	}
+	w = postWithKey(t, "/v1/chat/completions", key, chatRequest("hi", false))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key status = %d, want 401", w.Code)
+	}
+}
+
+func TestAPIKeyLimits(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"ok"}})
+	token := adminToken(t)
+
+	tests := []struct {
+		name   string
+		key    map[string]interface{}
+		first  string // 第一次请求使用的模型
+		status int    // 第二次请求（gpt-5）的状态码
+		code   string
+	}{
+		{"allowed models", map[string]interface{}{"allowed_models": []string{"claude-sonnet-4-5"}}, "claude-sonnet-4-5", http.StatusForbidden, "model_not_allowed"},
+		{"rpm", map[string]interface{}{"rpm_limit": 1}, "gpt-5", http.StatusTooManyRequests, "rate_limit_exceeded"},
+		{"daily credits", map[string]interface{}{"daily_credit_limit": 1}, "gpt-5", http.StatusTooManyRequests, "daily_quota_exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.key["name"] = tt.name
+			_, key := createAPIKey(t, token, tt.key)
+
+			first := chatRequest("hi", false)
+			first["model"] = tt.first
+			if w := postWithKey(t, "/v1/chat/completions", key, first); w.Code != http.StatusOK {
+				t.Fatalf("first status = %d, body = %s", w.Code, w.Body.String())
+			}
+
+			w := postWithKey(t, "/v1/chat/completions", key, chatRequest("hi", false))
+			if w.Code != tt.status {
+				t.Fatalf("second status = %d, want %d, body = %s", w.Code, tt.status, w.Body.String())
+			}
+			if got := errorCode(t, w.Body.Bytes()); got != tt.code {
+				t.Errorf("code = %q, want %q", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestAPIKeyExpired(t *testing.T) {
+	useAccounts(t, &fakeupstream.Account{Reply: []string{"ok"}})
+
+	expired := time.Now().Add(-time.Minute)
+	if err := store.CreateAPIKey(&models.APIKeyInfo{ID: uuid.New().String(), Name: "expired", ExpiresAt: &expired}, "sk-expired"); err != nil {
+		t.Fatal(err)
+	}
+	w := postWithKey(t, "/v1/chat/completions", "sk-expired", chatRequest("hi", false))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	cookies := useAccounts(t, &fakeupstream.Account{Reply: []string{"ok"}})
+	store.SetUsage(cookies[0].ID, &models.UsageInfo{TaskCreditsUsage: 40, TaskCreditsLimit: 100})
+
+	cfg := config.Get()
+	cfg.MetricsToken = "metrics-secret"
+	t.Cleanup(func() { cfg.MetricsToken = "" })
+
+	scrape := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 请求指标在整个测试进程中累计，只比较本次请求带来的增量
+	series := []string{
+		`cto2api_requests_total{endpoint="/v1/chat/completions",model="gpt-5",status="200"}`,
+		`cto2api_request_duration_seconds_count{endpoint="/v1/chat/completions",model="gpt-5",status="200"}`,
+	}
+	before := scrape("metrics-secret").Body.String()
+
+	if w := post(t, "/v1/chat/completions", chatRequest("hi", true)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	if w := scrape(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("status without token = %d, want 401", w.Code)
+	}
+	w := scrape("metrics-secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	for _, name := range series {
+		if got := metricValue(w.Body.String(), name) - metricValue(before, name); got != 1 {
+			t.Errorf("%s increased by %v, want 1", name, got)
+		}
+	}
+	cookie := `cookie_id="` + cookies[0].ID + `",cookie_name="` + cookies[0].Name + `"`
+	for _, want := range []string{
+		`cto2api_time_to_first_token_seconds_count{model="gpt-5"}`,
+		`cto2api_stream_duration_seconds_count{model="gpt-5"}`,
+		`cto2api_requests_in_flight 0`,
+		`cto2api_cookie_requests_total{` + cookie + `} 1`,
+		`cto2api_cookie_errors_total{` + cookie + `} 0`,
+		`cto2api_cookie_health_state{` + cookie + `,state="healthy"} 1`,
+		`cto2api_cookie_credits_usage{` + cookie + `} 40`,
+		`cto2api_cookie_credits_limit{` + cookie + `} 100`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+// metricValue 从Prometheus文本输出中读取一个序列的值，不存在时返回0
+func metricValue(body, series string) float64 {
+	for _, line := range strings.Split(body, "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, _ := strconv.ParseFloat(value, 64)
+			return v
+		}
+	}
+	return 0
+}
+
+// captureLogs 将slog默认日志输出到缓冲区，测试结束后恢复
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(services.NewLogHandler(&buf, slog.LevelDebug)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// requestLogEntry 查找指定请求ID的请求日志
+func requestLogEntry(t *testing.T, logs *bytes.Buffer, id string) map[string]interface{} {
+	t.Helper()
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %s", line)
+		}
+		if entry["msg"] == "请求完成" && entry["request_id"] == id {
+			return entry
+		}
+	}
+	t.Fatalf("no request log for %s in:\n%s", id, logs.String())
+	return nil
+}
+
+func TestRequestLog(t *testing.T) {
+	cookies := useAccounts(t,
+		&fakeupstream.Account{NoSession: true},
+		&fakeupstream.Account{Reply: []string{"logged"}},
+	)
+	logs := captureLogs(t)
+
+	data, _ := json.Marshal(chatRequest("log me", false))
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	req.Header.Set("X-Request-ID", "req-123")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	// 请求ID由服务端生成，调用方的值只作为关联ID记录
+	id := w.Header().Get("X-Request-ID")
+	if id == "" || id == "req-123" {
+		t.Errorf("X-Request-ID = %q, want a server-generated ID", id)
+	}
+
+	chats := upstream.Chats()
+	entry := requestLogEntry(t, logs, id)
+	want := map[string]interface{}{
+		"client_request_id": "req-123",
+		"api_key_name":      "default",
+		"model":             "gpt-5",
+		"adapter":           "GPT5",
+		"cookie_id":         cookies[1].ID,
+		"chat_id":           chats[len(chats)-1].ChatID,
+		"attempts":          float64(2),
+		"status":            float64(200),
+		"outcome":           "success",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %v", key, entry[key], value)
+		}
+	}
+	for _, key := range []string{"clerk_ms", "jwt_ms", "create_chat_ms", "first_token_ms", "total_ms"} {
+		if _, ok := entry[key]; !ok {
+			t.Errorf("missing %s", key)
+		}
+	}
+
+	// 日志中不应出现Cookie值和API密钥
+	for _, secret := range []string{cookies[0].Cookie, cookies[1].Cookie, testAPIKey} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("logs contain %q", secret)
+		}
+	}
+}
+
+// adminGet 使用管理token发送GET请求并解析JSON响应
+func adminGet(t *testing.T, token, path string, v interface{}) int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+func TestRequestJournal(t *testing.T) {
+	cookies := useAccounts(t, &fakeupstream.Account{Reply: []string{"journaled ", "answer"}})
+	token := adminToken(t)
+
+	clientID := "journal-" + uuid.New().String()
+	data, _ := json.Marshal(chatRequest("remember this", true))
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	req.Header.Set("X-Request-ID", clientID)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	id := w.Header().Get("X-Request-ID")
+
+	var list struct {
+		Enabled bool                    `json:"enabled"`
+		Items   []services.JournalEntry `json:"items"`
+		Total   int                     `json:"total"`
+	}
+	// 按调用方的请求ID查询
+	if code := adminGet(t, token, "/api/admin/requests?model=gpt-5&q="+clientID, &list); code != http.StatusOK {
+		t.Fatalf("list status = %d", code)
+	}
+	if !list.Enabled || list.Total != 1 || len(list.Items) != 1 {
+		t.Fatalf("list = %+v, want the one journaled request", list)
+	}
+	item := list.Items[0]
+	if item.ID != id || item.ClientRequestID != clientID || item.CookieID != cookies[0].ID || item.Outcome != "success" || !item.Stream || !item.HasBody {
+		t.Errorf("item = %+v", item)
+	}
+
+	var entry services.JournalEntry
+	if code := adminGet(t, token, "/api/admin/requests/"+id, &entry); code != http.StatusOK {
+		t.Fatalf("get status = %d", code)
+	}
+	if !strings.Contains(entry.RequestBody, "remember this") {
+		t.Errorf("request body = %q", entry.RequestBody)
+	}
+	if entry.ResponseBody != "journaled answer" {
+		t.Errorf("response body = %q, want %q", entry.ResponseBody, "journaled answer")
+	}
+
+	if code := adminGet(t, token, "/api/admin/requests/missing", &entry); code != http.StatusNotFound {
+		t.Errorf("missing entry status = %d, want 404", code)
+	}
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"cto2api/services"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 请求记录分页
+const (
+	journalDefaultPageSize = 50
+	journalMaxPageSize     = 200
+)
+
+// UseJournal 开启请求记录
+func (h *APIHandler) UseJournal(journal *services.Journal) {
+	h.journal = journal
+}
+
+// recordJournal 保存请求记录，内容只在开启内容记录时保存
+func (h *APIHandler) recordJournal(c *gin.Context, entry *requestLog, start time.Time, requestBody []byte) {
+	record := services.JournalEntry{
+		ID:              entry.id,
+		ClientRequestID: entry.clientID,
+		Time:            start,
+		Method:          c.Request.Method,
+		Path:            c.FullPath(),
+		APIKeyName:      entry.keyName,
+		Model:           entry.model,
+		Adapter:         entry.adapter,
+		CookieID:        entry.cookieID,
+		ChatID:          entry.chatID,
+		Attempts:        entry.attempts,
+		Stream:          strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream"),
+		Status:          c.Writer.Status(),
+		Outcome:         requestOutcome(c.Writer.Status(), entry.err),
+		TotalMs:         time.Since(start).Milliseconds(),
+	}
+	if entry.firstToken > 0 {
+		record.FirstTokenMs = entry.firstToken.Milliseconds()
+	}
+	if entry.err != nil {
+		record.Error = services.RedactSecrets(entry.err.Error())
+	}
+	if h.journal.RecordsBodies() {
+		record.RequestBody = string(requestBody)
+		record.ResponseBody = entry.response
+	}
+
+	if err := h.journal.Record(record); err != nil {
+		slog.Error("保存请求记录失败", "request_id", record.ID, "error", err)
+	}
+}
+
+// ListRequests 分页查询请求记录（按时间倒序）
+// 查询参数：page、page_size、model、outcome、status、api_key、cookie_id、q、since、until（RFC3339）
+func (h *APIHandler) ListRequests(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(journalDefaultPageSize)))
+	if pageSize < 1 || pageSize > journalMaxPageSize {
+		pageSize = journalDefaultPageSize
+	}
+
+	if h.journal == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false, "items": []services.JournalEntry{}, "total": 0, "page": page, "page_size": pageSize})
+		return
+	}
+
+	filter := services.JournalFilter{
+		Model:    c.Query("model"),
+		Outcome:  c.Query("outcome"),
+		APIKey:   c.Query("api_key"),
+		CookieID: c.Query("cookie_id"),
+		Query:    c.Query("q"),
+		Offset:   (page - 1) * pageSize,
+		Limit:    pageSize,
+	}
+	if status := c.Query("status"); status != "" {
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的status"})
+			return
+		}
+		filter.Status = code
+	}
+	for name, field := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := c.Query(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "无效的" + name + "，需要RFC3339格式"})
+				return
+			}
+			*field = t
+		}
+	}
+
+	items, total := h.journal.List(filter)
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":   true,
+		"bodies":    h.journal.RecordsBodies(),
+		"items":     items,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// GetRequest 获取单条请求记录（包含未过期的请求和响应内容）
+func (h *APIHandler) GetRequest(c *gin.Context) {
+	if h.journal == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "未开启请求记录"})
+		return
+	}
+
+	entry, err := h.journal.Get(c.Param("id"))
+	if err != nil {
+		if errors.Is(err, services.ErrJournalEntryNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
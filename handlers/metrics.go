@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"cto2api/config"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelContextKey gin上下文中保存指标模型标签的键
+const modelContextKey = "metrics_model"
+
+// metricsModel 指标中的模型标签，未知模型统一为other，避免标签数量无限增长
+func metricsModel(model string) string {
+	if _, ok := modelMapping[model]; ok {
+		return model
+	}
+	return "other"
+}
+
+// RequestMetrics 记录API请求数、耗时和进行中的请求数
+func (h *APIHandler) RequestMetrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		h.metrics.RequestStarted()
+		c.Next()
+
+		model := c.GetString(modelContextKey)
+		if model == "" {
+			model = "none"
+		}
+		h.metrics.RequestFinished(c.FullPath(), model, c.Writer.Status(), time.Since(start))
+	}
+}
+
+// Metrics 输出Prometheus指标，配置了metrics_token时需要 Authorization: Bearer <token>
+func (h *APIHandler) Metrics(c *gin.Context) {
+	if token := config.Get().MetricsToken; token != "" {
+		got := extractBearerToken(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "无效的metrics token"})
+			return
+		}
+	}
+	h.metrics.Handler().ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"cto2api/services"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sessionClaimsKey gin上下文中保存管理会话声明的键
+const sessionClaimsKey = "admin_session"
+
+// AdminAuth 管理API认证中间件，校验Login签发的会话token
+func (h *APIHandler) AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := extractBearerToken(c.GetHeader("Authorization"))
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "未登录或登录已失效"})
+			return
+		}
+
+		claims, err := h.sessions.Validate(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "登录已失效: " + err.Error()})
+			return
+		}
+
+		c.Set(sessionClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// currentSession 获取当前请求的管理会话声明
+func currentSession(c *gin.Context) *services.SessionClaims {
+	if v, ok := c.Get(sessionClaimsKey); ok {
+		if claims, ok := v.(*services.SessionClaims); ok {
+			return claims
+		}
+	}
+	return nil
+}
+
+// extractBearerToken 从Authorization头提取Bearer token
+func extractBearerToken(header string) string {
+	parts := strings.SplitN(header, " ", 2)
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
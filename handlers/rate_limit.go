@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"cto2api/config"
+	"cto2api/models"
+	"cto2api/services"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// globalRateLimitKey 全局令牌桶的键
+const globalRateLimitKey = "global"
+
+// queueRetryAfter 排队已满或等待超时时建议的重试间隔
+const queueRetryAfter = time.Second
+
+// checkRateLimit 检查全局和API密钥的令牌桶，并写入 x-ratelimit-* 响应头；被限流时写入Retry-After
+func (h *APIHandler) checkRateLimit(c *gin.Context, key *models.APIKeyInfo) *chatError {
+	cfg := config.Get()
+	limits := []services.RateLimit{{Key: globalRateLimitKey, RPM: cfg.RateLimitGlobalRPM, Burst: cfg.RateLimitGlobalBurst}}
+	if key != nil {
+		rpm := key.RPMLimit
+		if rpm == 0 {
+			rpm = cfg.RateLimitKeyRPM
+		}
+		limits = append(limits, services.RateLimit{Key: "key:" + key.ID, RPM: rpm})
+	}
+
+	result := h.limiter.Allow(limits...)
+	if result.Limit > 0 {
+		c.Header("x-ratelimit-limit-requests", strconv.Itoa(result.Limit))
+		c.Header("x-ratelimit-remaining-requests", strconv.Itoa(result.Remaining))
+		c.Header("x-ratelimit-reset-requests", result.Reset.Round(time.Millisecond).String())
+	}
+	if result.Allowed {
+		return nil
+	}
+
+	setRetryAfter(c, result.RetryAfter)
+	return &chatError{status: http.StatusTooManyRequests, apiErr: &APIError{
+		Message: "请求过于频繁，请在" + result.RetryAfter.Round(time.Millisecond).String() + "后重试",
+		Type:    errTypeRateLimit,
+		Code:    errCodeRateLimitExceeded,
+	}}
+}
+
+// setRetryAfter 写入Retry-After响应头（秒，向上取整）
+func setRetryAfter(c *gin.Context, d time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// cookieQueue 所有Cookie都达到并发上限时的有界等待队列
+type cookieQueue struct {
+	mu      sync.Mutex
+	waiting int
+}
+
+// enter 进入队列，队列已满时返回false
+func (q *cookieQueue) enter(max int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.waiting >= max {
+		return false
+	}
+	q.waiting++
+	return true
+}
+
+// leave 离开队列
+func (q *cookieQueue) leave() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waiting--
+}
+
+// Len 正在排队的请求数
+func (q *cookieQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting
+}
+
+// waitForCookie 所有Cookie都达到并发上限时排队，直到有Cookie可以分配（释放并发占用、熔断恢复、新增或重新启用）、排队超时或客户端断开
+func (h *APIHandler) waitForCookie(ctx context.Context, c *gin.Context, tried map[string]bool) (*models.CookieInfo, *chatError) {
+	cfg := config.Get()
+	if cfg.QueueMaxSize <= 0 || !h.queue.enter(cfg.QueueMaxSize) {
+		setRetryAfter(c, queueRetryAfter)
+		return nil, &chatError{status: http.StatusTooManyRequests, apiErr: &APIError{
+			Message: "所有Cookie都已达到并发上限", Type: errTypeRateLimit, Code: errCodeConcurrencyLimit,
+		}}
+	}
+	defer h.queue.leave()
+
+	timer := time.NewTimer(time.Duration(cfg.QueueTimeoutSeconds) * time.Second)
+	defer timer.Stop()
+
+	for {
+		// 先取通道再检查，避免错过检查和等待之间的变化
+		available := h.store.CookieAvailable()
+		if cookie := h.store.GetNextCookieExcluding(tried); cookie != nil {
+			return cookie, nil
+		}
+		if !h.store.HasAvailableCookie(tried) {
+			// Cookie都被禁用或进入冷却，不再等待
+			return nil, nil
+		}
+		// 检查之后释放的Cookie会关闭available，下面的select立即返回并重新选择
+
+		select {
+		case <-available:
+		case <-timer.C:
+			setRetryAfter(c, queueRetryAfter)
+			return nil, &chatError{status: http.StatusTooManyRequests, apiErr: &APIError{
+				Message: "排队等待可用Cookie超时", Type: errTypeRateLimit, Code: errCodeQueueTimeout,
+			}}
+		case <-ctx.Done():
+			return nil, errClientClosed
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"cto2api/services"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// requestLogKey gin上下文中保存请求日志字段的键
+const requestLogKey = "request_log"
+
+// requestIDHeader 请求ID响应头（服务端生成）；调用方在请求头中提供的值作为关联ID单独记录
+const requestIDHeader = "X-Request-ID"
+
+// requestLog 一次请求的结构化日志字段，由startChat和consumeStream逐步填写
+type requestLog struct {
+	id         string
+	clientID   string // 调用方提供的X-Request-ID
+	keyName    string
+	model      string
+	adapter    string
+	cookieID   string
+	chatID     string
+	attempts   int
+	continued  bool // 续接了已有的上游会话
+	timings    services.CallTimings
+	firstToken time.Duration // 从收到请求到第一段文本或思考过程
+	err        error
+	response   string // 返回给调用方的文本（记录请求内容时使用）
+}
+
+// addTimings 累加一次尝试的上游调用耗时
+func (l *requestLog) addTimings(t services.CallTimings) {
+	l.timings.Clerk += t.Clerk
+	l.timings.JWT += t.JWT
+	l.timings.CreateChat += t.CreateChat
+}
+
+// currentRequestLog 当前请求的日志字段，没有经过RequestLogger时返回一个不会输出的记录
+func currentRequestLog(c *gin.Context) *requestLog {
+	if v, ok := c.Get(requestLogKey); ok {
+		return v.(*requestLog)
+	}
+	return &requestLog{}
+}
+
+// RequestLogger 为每个请求分配请求ID，结束后输出一条JSON日志（不包含Cookie、密钥和JWT）
+func (h *APIHandler) RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		entry := &requestLog{id: uuid.New().String(), clientID: clientRequestID(c.GetHeader(requestIDHeader))}
+		c.Set(requestLogKey, entry)
+		c.Header(requestIDHeader, entry.id)
+
+		journaled := h.journal != nil && c.Request.Method == http.MethodPost
+		var requestBody []byte
+		if journaled && h.journal.RecordsBodies() && c.Request.Body != nil {
+			requestBody, _ = io.ReadAll(c.Request.Body)
+			c.Request.Body = io.NopCloser(bytes.NewReader(requestBody))
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		if journaled {
+			h.recordJournal(c, entry, start, requestBody)
+		}
+		attrs := []any{
+			"request_id", entry.id,
+			"method", c.Request.Method,
+			"path", c.FullPath(),
+			"status", status,
+			"outcome", requestOutcome(status, entry.err),
+			"client_ip", c.ClientIP(),
+			"total_ms", time.Since(start).Milliseconds(),
+		}
+		if entry.clientID != "" {
+			attrs = append(attrs, "client_request_id", entry.clientID)
+		}
+		if entry.keyName != "" {
+			attrs = append(attrs, "api_key_name", entry.keyName)
+		}
+		if entry.model != "" {
+			attrs = append(attrs,
+				"model", entry.model,
+				"adapter", entry.adapter,
+				"cookie_id", entry.cookieID,
+				"chat_id", entry.chatID,
+				"attempts", entry.attempts,
+				"continued", entry.continued,
+				"clerk_ms", entry.timings.Clerk.Milliseconds(),
+				"jwt_ms", entry.timings.JWT.Milliseconds(),
+				"create_chat_ms", entry.timings.CreateChat.Milliseconds(),
+			)
+			if entry.firstToken > 0 {
+				attrs = append(attrs, "first_token_ms", entry.firstToken.Milliseconds())
+			}
+		}
+		if entry.err != nil {
+			attrs = append(attrs, "error", entry.err)
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest || entry.err != nil:
+			level = slog.LevelWarn
+		}
+		slog.Log(c.Request.Context(), level, "请求完成", attrs...)
+	}
+}
+
+// clientRequestID 调用方提供的请求ID（最长128个可见ASCII字符），不符合时忽略
+func clientRequestID(header string) string {
+	if len(header) > 128 {
+		return ""
+	}
+	for _, r := range header {
+		if r <= ' ' || r > '~' {
+			return ""
+		}
+	}
+	return header
+}
+
+// requestOutcome 请求结果：success、client_closed、rate_limited、upstream_error、client_error，
+// 响应开始后流中断时为stream_error
+func requestOutcome(status int, err error) string {
+	var chatErr *chatError
+	switch {
+	case status == statusClientClosed || errors.Is(err, context.Canceled):
+		return "client_closed"
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	case errors.As(err, &chatErr) && chatErr.stage != "", status >= http.StatusInternalServerError:
+		return "upstream_error"
+	case status >= http.StatusBadRequest:
+		return "client_error"
+	case err != nil:
+		return "stream_error"
+	}
+	return "success"
+}
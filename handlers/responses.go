@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"bytes"
+	"cto2api/services"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ResponsesRequest OpenAI Responses API请求
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              json.RawMessage   `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Stream             bool              `json:"stream"`
+	Store              *bool             `json:"store,omitempty"`
+	Tools              []ResponsesTool   `json:"tools,omitempty"`
+	ToolChoice         json.RawMessage   `json:"tool_choice,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// ResponsesTool Responses API工具定义（扁平格式）
+type ResponsesTool struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ResponseInputItem 输入项
+type ResponseInputItem struct {
+	Type      string         `json:"type"`
+	Role      string         `json:"role"`
+	Content   MessageContent `json:"content"`
+	CallID    string         `json:"call_id"`
+	Name      string         `json:"name"`
+	Arguments string         `json:"arguments"`
+	Output    string         `json:"output"`
+}
+
+// ResponseObject Responses API响应对象
+type ResponseObject struct {
+	ID                 string               `json:"id"`
+	Object             string               `json:"object"`
+	CreatedAt          int64                `json:"created_at"`
+	Status             string               `json:"status"`
+	Model              string               `json:"model"`
+	Instructions       *string              `json:"instructions"`
+	PreviousResponseID *string              `json:"previous_response_id"`
+	Output             []ResponseOutputItem `json:"output"`
+	Usage              *ResponseUsage       `json:"usage"`
+	Error              *APIError            `json:"error"`
+	Metadata           map[string]string    `json:"metadata"`
+}
+
+// ResponseOutputItem 输出项（message或function_call）
+type ResponseOutputItem struct {
+	Type      string
+	ID        string
+	Status    string
+	Text      string // message的文本
+	CallID    string // function_call
+	Name      string
+	Arguments string
+}
+
+// ResponseUsage 使用统计
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// MarshalJSON 按输出项类型输出对应字段
+func (item ResponseOutputItem) MarshalJSON() ([]byte, error) {
+	if item.Type == "function_call" {
+		return json.Marshal(gin.H{
+			"type":      item.Type,
+			"id":        item.ID,
+			"status":    item.Status,
+			"call_id":   item.CallID,
+			"name":      item.Name,
+			"arguments": item.Arguments,
+		})
+	}
+
+	content := []gin.H{}
+	if item.Status == "completed" {
+		content = append(content, outputTextPart(item.Text))
+	}
+	return json.Marshal(gin.H{
+		"type":    "message",
+		"id":      item.ID,
+		"status":  item.Status,
+		"role":    "assistant",
+		"content": content,
+	})
+}
+
+// outputTextPart output_text内容片段
+func outputTextPart(text string) gin.H {
+	return gin.H{"type": "output_text", "text": text, "annotations": []interface{}{}}
+}
+
+// CreateResponse OpenAI Responses API
+func (h *APIHandler) CreateResponse(c *gin.Context) {
+	if status, msg := h.validateAPIKey(c, extractBearerToken(c.GetHeader("Authorization"))); status != 0 {
+		respondAPIKeyError(c, status, msg)
+		return
+	}
+
+	var req ResponsesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondAPIError(c, http.StatusBadRequest, &APIError{Message: err.Error(), Type: errTypeInvalidRequest})
+		return
+	}
+
+	// 续接之前的响应
+	var history []services.PromptMessage
+	callNames := make(map[string]string)
+	if req.PreviousResponseID != "" {
+		prev := h.responses.Get(req.PreviousResponseID, responseOwner(c))
+		if prev == nil {
+			respondAPIError(c, http.StatusNotFound, &APIError{
+				Message: fmt.Sprintf("未找到响应 %q", req.PreviousResponseID),
+				Type:    errTypeInvalidRequest,
+				Param:   "previous_response_id",
+				Code:    "previous_response_not_found",
+			})
+			return
+		}
+		history = append(history, prev.Messages...)
+		for id, name := range prev.CallNames {
+			callNames[id] = name
+		}
+	}
+
+	input, apiErr := responsesInputMessages(req.Input, callNames)
+	if apiErr != nil {
+		respondAPIError(c, http.StatusBadRequest, apiErr)
+		return
+	}
+	history = append(history, input...)
+
+	// instructions只作用于本次请求，不随previous_response_id继承
+	messages := make([]services.PromptMessage, 0, len(history)+2)
+	if req.Instructions != "" {
+		messages = append(messages, services.PromptMessage{Role: "system", Content: req.Instructions})
+	}
+	toolInstructions, apiErr := toolPrompt(responsesTools(req.Tools), responsesToolChoice(req.ToolChoice))
+	if apiErr != nil {
+		respondAPIError(c, http.StatusBadRequest, apiErr)
+		return
+	}
+	if toolInstructions != "" {
+		messages = append(messages, services.PromptMessage{Role: "system", Content: toolInstructions})
+	}
+	messages = append(messages, history...)
+
+	chat, err := h.startChat(c, req.Model, messages)
+	if err != nil {
+		respondChatError(c, err)
+		return
+	}
+
+	var parser *services.ToolCallParser
+	if toolInstructions != "" {
+		parser = services.NewToolCallParser()
+	}
+
+	resp := &ResponseObject{
+		ID:        "resp_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Object:    "response",
+		CreatedAt: time.Now().Unix(),
+		Status:    "in_progress",
+		Model:     req.Model,
+		Output:    []ResponseOutputItem{},
+		Metadata:  req.Metadata,
+	}
+	if req.Instructions != "" {
+		resp.Instructions = stringPtr(req.Instructions)
+	}
+	if req.PreviousResponseID != "" {
+		resp.PreviousResponseID = stringPtr(req.PreviousResponseID)
+	}
+	if resp.Metadata == nil {
+		resp.Metadata = map[string]string{}
+	}
+
+	var result *streamResult
+	if req.Stream {
+		result, err = h.streamResponse(c, chat, parser, resp)
+	} else {
+		result, err = h.consumeStream(chat, parser, nil, nil, nil)
+	}
+	if err != nil {
+		if !req.Stream {
+			respondChatError(c, err)
+		}
+		return
+	}
+
+	if !req.Stream {
+		resp.Output = buildResponseOutput(result)
+	}
+	resp.Status = "completed"
+	resp.Usage = &ResponseUsage{
+		InputTokens:  len(chat.prompt) / 4,
+		OutputTokens: len(result.raw) / 4,
+		TotalTokens:  (len(chat.prompt) + len(result.raw)) / 4,
+	}
+
+	// 保存响应供续接
+	if req.Store == nil || *req.Store {
+		h.storeResponse(responseOwner(c), resp, history, result, callNames)
+	}
+
+	if req.Stream {
+		sendResponseEvent(c, "response.completed", gin.H{"response": resp})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// streamResponse 以Responses API事件序列流式输出，完成后resp.Output包含全部输出项
+func (h *APIHandler) streamResponse(c *gin.Context, chat *upstreamChat, parser *services.ToolCallParser, resp *ResponseObject) (*streamResult, error) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	sendResponseEvent(c, "response.created", gin.H{"response": resp})
+	sendResponseEvent(c, "response.in_progress", gin.H{"response": resp})
+
+	var message *ResponseOutputItem
+	var text strings.Builder
+	outputs := []ResponseOutputItem{}
+
+	closeMessage := func() {
+		if message == nil {
+			return
+		}
+		idx := len(outputs)
+		message.Status = "completed"
+		message.Text = text.String()
+		sendResponseEvent(c, "response.output_text.done", gin.H{
+			"item_id": message.ID, "output_index": idx, "content_index": 0, "text": message.Text,
+		})
+		sendResponseEvent(c, "response.content_part.done", gin.H{
+			"item_id": message.ID, "output_index": idx, "content_index": 0, "part": outputTextPart(message.Text),
+		})
+		sendResponseEvent(c, "response.output_item.done", gin.H{"output_index": idx, "item": message})
+		outputs = append(outputs, *message)
+		message = nil
+		text.Reset()
+	}
+
+	result, err := h.consumeStream(chat, parser,
+		func(delta string) {
+			idx := len(outputs)
+			if message == nil {
+				message = &ResponseOutputItem{Type: "message", ID: newOutputItemID("msg_"), Status: "in_progress"}
+				sendResponseEvent(c, "response.output_item.added", gin.H{"output_index": idx, "item": message})
+				sendResponseEvent(c, "response.content_part.added", gin.H{
+					"item_id": message.ID, "output_index": idx, "content_index": 0, "part": outputTextPart(""),
+				})
+			}
+			text.WriteString(delta)
+			sendResponseEvent(c, "response.output_text.delta", gin.H{
+				"item_id": message.ID, "output_index": idx, "content_index": 0, "delta": delta,
+			})
+		},
+		func(call services.ParsedToolCall) {
+			closeMessage()
+			idx := len(outputs)
+			item := functionCallItem(call)
+			added := item
+			added.Status = "in_progress"
+			added.Arguments = ""
+			sendResponseEvent(c, "response.output_item.added", gin.H{"output_index": idx, "item": added})
+			sendResponseEvent(c, "response.function_call_arguments.delta", gin.H{
+				"item_id": item.ID, "output_index": idx, "delta": item.Arguments,
+			})
+			sendResponseEvent(c, "response.function_call_arguments.done", gin.H{
+				"item_id": item.ID, "output_index": idx, "arguments": item.Arguments,
+			})
+			sendResponseEvent(c, "response.output_item.done", gin.H{"output_index": idx, "item": item})
+			outputs = append(outputs, item)
+		},
+		nil,
+	)
+	if err != nil {
+		resp.Status = "failed"
+		_, resp.Error = chatAPIError(err)
+		sendResponseEvent(c, "response.failed", gin.H{"response": resp})
+		return nil, err
+	}
+	closeMessage()
+
+	resp.Output = outputs
+	return result, nil
+}
+
+// storeResponse 保存响应及截至该响应的对话历史，owner为创建响应的API密钥ID
+func (h *APIHandler) storeResponse(owner string, resp *ResponseObject, history []services.PromptMessage, result *streamResult, callNames map[string]string) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+
+	for _, item := range resp.Output {
+		if item.Type == "function_call" {
+			callNames[item.CallID] = item.Name
+		}
+	}
+
+	messages := make([]services.PromptMessage, 0, len(history)+1)
+	messages = append(messages, history...)
+	messages = append(messages, services.PromptMessage{
+		Role:    "assistant",
+		Content: services.RenderToolCalls(result.text, result.calls),
+	})
+
+	h.responses.Put(&services.StoredResponse{
+		ID:        resp.ID,
+		OwnerKey:  owner,
+		Messages:  messages,
+		CallNames: callNames,
+		Body:      body,
+		CreatedAt: time.Now(),
+	})
+}
+
+// GetResponse 获取已保存的响应
+func (h *APIHandler) GetResponse(c *gin.Context) {
+	if status, msg := h.validateAPIKey(c, extractBearerToken(c.GetHeader("Authorization"))); status != 0 {
+		respondAPIKeyError(c, status, msg)
+		return
+	}
+
+	stored := h.responses.Get(c.Param("id"), responseOwner(c))
+	if stored == nil {
+		respondAPIError(c, http.StatusNotFound, &APIError{
+			Message: fmt.Sprintf("未找到响应 %q", c.Param("id")),
+			Type:    errTypeInvalidRequest,
+			Code:    "not_found",
+		})
+		return
+	}
+	c.Data(http.StatusOK, "application/json", stored.Body)
+}
+
+// DeleteResponse 删除已保存的响应
+func (h *APIHandler) DeleteResponse(c *gin.Context) {
+	if status, msg := h.validateAPIKey(c, extractBearerToken(c.GetHeader("Authorization"))); status != 0 {
+		respondAPIKeyError(c, status, msg)
+		return
+	}
+
+	id := c.Param("id")
+	if !h.responses.Delete(id, responseOwner(c)) {
+		respondAPIError(c, http.StatusNotFound, &APIError{
+			Message: fmt.Sprintf("未找到响应 %q", id),
+			Type:    errTypeInvalidRequest,
+			Code:    "not_found",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "response.deleted", "deleted": true})
+}
+
+// responseOwner 当前请求的API密钥ID，保存的响应只对创建它的密钥可见
+func responseOwner(c *gin.Context) string {
+	if key := currentAPIKey(c); key != nil {
+		return key.ID
+	}
+	return ""
+}
+
+// responsesInputMessages 解析input（字符串或输入项数组）
+func responsesInputMessages(raw json.RawMessage, callNames map[string]string) ([]services.PromptMessage, *APIError) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+
+	if raw[0] == '"' {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return nil, &APIError{Message: err.Error(), Type: errTypeInvalidRequest, Param: "input"}
+		}
+		return []services.PromptMessage{{Role: "user", Content: text}}, nil
+	}
+
+	var items []ResponseInputItem
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, &APIError{Message: "input必须是字符串或输入项数组: " + err.Error(), Type: errTypeInvalidRequest, Param: "input"}
+	}
+
+	messages := make([]services.PromptMessage, 0, len(items))
+	for i, item := range items {
+		switch item.Type {
+		case "", "message":
+			if idx := item.Content.unsupportedPart(); idx >= 0 {
+				return nil, &APIError{
+					Message: fmt.Sprintf("不支持的内容类型 %q：上游暂不支持图片等附件，请只发送文本内容", item.Content.Parts[idx].Type),
+					Type:    errTypeInvalidRequest,
+					Param:   fmt.Sprintf("input[%d].content[%d]", i, idx),
+					Code:    "unsupported_content_type",
+				}
+			}
+			role := item.Role
+			if role == "" {
+				role = "user"
+			}
+			messages = append(messages, services.PromptMessage{Role: role, Content: item.Content.String()})
+		case "function_call":
+			callNames[item.CallID] = item.Name
+			content := services.RenderToolCalls("", []services.ParsedToolCall{{Name: item.Name, Arguments: item.Arguments}})
+			// 连续的函数调用合并到同一条助手消息
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				messages[n-1].Content += "\n" + content
+			} else {
+				messages = append(messages, services.PromptMessage{Role: "assistant", Content: content})
+			}
+		case "function_call_output":
+			name := callNames[item.CallID]
+			if name == "" {
+				name = item.CallID
+			}
+			messages = append(messages, services.PromptMessage{Role: "tool", Name: name, Content: item.Output})
+		default:
+			return nil, &APIError{
+				Message: fmt.Sprintf("不支持的输入项类型 %q", item.Type),
+				Type:    errTypeInvalidRequest,
+				Param:   fmt.Sprintf("input[%d].type", i),
+			}
+		}
+	}
+	return messages, nil
+}
+
+// buildResponseOutput 根据上游输出构建输出项
+func buildResponseOutput(result *streamResult) []ResponseOutputItem {
+	outputs := []ResponseOutputItem{}
+	text := result.text
+	if len(result.calls) > 0 {
+		text = strings.TrimSpace(text)
+	}
+	if text != "" || len(result.calls) == 0 {
+		outputs = append(outputs, ResponseOutputItem{
+			Type:   "message",
+			ID:     newOutputItemID("msg_"),
+			Status: "completed",
+			Text:   text,
+		})
+	}
+	for _, call := range result.calls {
+		outputs = append(outputs, functionCallItem(call))
+	}
+	return outputs
+}
+
+// functionCallItem 创建function_call输出项
+func functionCallItem(call services.ParsedToolCall) ResponseOutputItem {
+	return ResponseOutputItem{
+		Type:      "function_call",
+		ID:        newOutputItemID("fc_"),
+		Status:    "completed",
+		CallID:    newToolCallID(),
+		Name:      call.Name,
+		Arguments: call.Arguments,
+	}
+}
+
+// responsesTools 转换为Chat Completions格式的工具定义
+func responsesTools(tools []ResponsesTool) []Tool {
+	result := make([]Tool, 0, len(tools))
+	for _, tool := range tools {
+		result = append(result, Tool{
+			Type: tool.Type,
+			Function: ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	return result
+}
+
+// responsesToolChoice 转换为Chat Completions格式的tool_choice
+func responsesToolChoice(raw json.RawMessage) json.RawMessage {
+	var named struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(raw, &named); err != nil || named.Name == "" {
+		return raw
+	}
+	data, _ := json.Marshal(gin.H{"type": "function", "function": gin.H{"name": named.Name}})
+	return data
+}
+
+// sendResponseEvent 发送Responses API流式事件
+func sendResponseEvent(c *gin.Context, event string, data gin.H) {
+	data["type"] = event
+	data["sequence_number"] = nextSequence(c)
+	c.SSEvent(event, data)
+}
+
+// nextSequence 当前请求的下一个事件序号
+func nextSequence(c *gin.Context) int {
+	seq := c.GetInt("response_sequence")
+	c.Set("response_sequence", seq+1)
+	return seq
+}
+
+// newOutputItemID 生成输出项ID
+func newOutputItemID(prefix string) string {
+	return prefix + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterRoutes 注册管理API和兼容API路由
+func (h *APIHandler) RegisterRoutes(r *gin.Engine) {
+	// 管理API路由
+	admin := r.Group("/api/admin")
+	{
+		admin.GET("/check-setup", h.CheckSetup)
+		admin.POST("/setup", h.Setup)
+		admin.POST("/login", h.Login)
+
+		// 需要认证的路由
+		authed := admin.Group("", h.AdminAuth())
+		authed.POST("/logout", h.Logout)
+		authed.POST("/sessions/revoke-all", h.RevokeAllSessions)
+		authed.GET("/cookies", h.ListCookies)
+		authed.POST("/cookies", h.AddCookie)
+		authed.PUT("/cookies/:id", h.UpdateCookie)
+		authed.DELETE("/cookies/:id", h.DeleteCookie)
+		authed.POST("/cookies/:id/test", h.TestCookie)
+		authed.GET("/cookies/:id/usage", h.GetCookieUsage)
+		authed.GET("/api-key", h.GetAPIKey)
+		authed.PUT("/api-key", h.UpdateAPIKey)
+		authed.GET("/keys", h.ListAPIKeys)
+		authed.POST("/keys", h.CreateAPIKey)
+		authed.DELETE("/keys/:id", h.RevokeAPIKey)
+		authed.GET("/usage", h.GetUsage)
+		authed.GET("/requests", h.ListRequests)
+		authed.GET("/requests/:id", h.GetRequest)
+	}
+
+	// Prometheus指标
+	r.GET("/metrics", h.Metrics)
+
+	// OpenAI兼容API路由
+	v1 := r.Group("/v1", h.RequestLogger(), h.RequestMetrics())
+	{
+		v1.GET("/models", h.ListModels)
+		v1.POST("/chat/completions", h.ChatCompletions)
+		v1.POST("/messages", h.Messages)
+		v1.POST("/responses", h.CreateResponse)
+		v1.GET("/responses/:id", h.GetResponse)
+		v1.DELETE("/responses/:id", h.DeleteResponse)
+	}
+
+	// 上游代理事件（供面板实时查看），长连接不计入请求指标
+	r.GET("/v1/cto/events", h.CTOEvents)
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"bytes"
+	"cto2api/services"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Tool 工具定义
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction 函数定义
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall 工具调用
+type ToolCall struct {
+	Index    *int             `json:"index,omitempty"` // 仅流式响应使用
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction 被调用的函数
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
+// toolPrompt 根据tools和tool_choice生成注入的工具说明，不需要注入时返回空字符串
+func toolPrompt(tools []Tool, toolChoice json.RawMessage) (string, *APIError) {
+	if len(tools) == 0 {
+		return "", nil
+	}
+
+	specs := make([]services.ToolSpec, 0, len(tools))
+	names := make(map[string]bool, len(tools))
+	for i, tool := range tools {
+		if tool.Type != "" && tool.Type != "function" {
+			return "", &APIError{
+				Message: fmt.Sprintf("不支持的工具类型 %q", tool.Type),
+				Type:    errTypeInvalidRequest,
+				Param:   fmt.Sprintf("tools[%d].type", i),
+			}
+		}
+		if tool.Function.Name == "" {
+			return "", &APIError{
+				Message: "工具缺少函数名称",
+				Type:    errTypeInvalidRequest,
+				Param:   fmt.Sprintf("tools[%d].function.name", i),
+			}
+		}
+		names[tool.Function.Name] = true
+		specs = append(specs, services.ToolSpec{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
+		})
+	}
+
+	forced := ""
+	choice := bytes.TrimSpace(toolChoice)
+	if len(choice) > 0 && !bytes.Equal(choice, []byte("null")) {
+		var mode string
+		if err := json.Unmarshal(choice, &mode); err == nil {
+			switch mode {
+			case "none":
+				return "", nil
+			case "auto", "":
+			case "required":
+				forced = "*"
+			default:
+				return "", &APIError{
+					Message: fmt.Sprintf("无效的tool_choice %q", mode),
+					Type:    errTypeInvalidRequest,
+					Param:   "tool_choice",
+				}
+			}
+		} else {
+			var named struct {
+				Function struct {
+					Name string `json:"name"`
+				} `json:"function"`
+			}
+			if err := json.Unmarshal(choice, &named); err != nil || !names[named.Function.Name] {
+				return "", &APIError{
+					Message: "tool_choice指定的工具不存在",
+					Type:    errTypeInvalidRequest,
+					Param:   "tool_choice",
+				}
+			}
+			forced = named.Function.Name
+		}
+	}
+
+	return services.BuildToolPrompt(specs, forced), nil
+}
+
+// toParsedToolCalls 转换为服务层的工具调用
+func toParsedToolCalls(calls []ToolCall) []services.ParsedToolCall {
+	result := make([]services.ParsedToolCall, 0, len(calls))
+	for _, call := range calls {
+		result = append(result, services.ParsedToolCall{
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	return result
+}
+
+// toToolCalls 将解析出的工具调用转换为OpenAI格式并分配ID
+func toToolCalls(calls []services.ParsedToolCall) []ToolCall {
+	result := make([]ToolCall, 0, len(calls))
+	for _, call := range calls {
+		result = append(result, ToolCall{
+			ID:   newToolCallID(),
+			Type: "function",
+			Function: ToolCallFunction{
+				Name:      call.Name,
+				Arguments: call.Arguments,
+			},
+		})
+	}
+	return result
+}
+
+// newToolCallID 生成工具调用ID
+func newToolCallID() string {
+	return "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
@@ -0,0 +1,483 @@
+package handlers
+
+import (
+	"context"
+	"cto2api/config"
+	"cto2api/models"
+	"cto2api/services"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// upstreamChat 一次上游聊天调用的上下文
+type upstreamChat struct {
+	ctx      context.Context // 客户端请求的上下文，断开时取消上游调用
+	client   *services.CTOClient
+	cookie   *models.CookieInfo
+	clerk    *services.ClerkInfo
+	chatID   string
+	prompt   string                   // 实际发送到上游的prompt
+	messages []services.PromptMessage // 本次请求的完整对话，用于记录会话亲和
+	adapter  string                   // 上游适配器，会话亲和只在相同适配器间续接
+	apiKeyID string                   // 发起聊天的API密钥ID，会话亲和和事件订阅按它隔离
+	model    string                   // 指标中的模型标签
+	started  time.Time                // 收到请求的时间，用于统计首个token延迟
+	log      *requestLog
+}
+
+// chatError 带HTTP状态码的聊天错误
+type chatError struct {
+	status int
+	apiErr *APIError
+	stage  string // 失败的阶段（clerk/jwt/create），用于尝试记录
+}
+
+func (e *chatError) Error() string {
+	return e.apiErr.Message
+}
+
+// upstreamChatError 按上游错误映射状态码的聊天错误
+func upstreamChatError(message, stage string, err error) *chatError {
+	status, apiErr := upstreamAPIError(message, err)
+	return &chatError{status: status, apiErr: apiErr, stage: stage}
+}
+
+// statusClientClosed 客户端在响应前断开连接（沿用nginx的499）
+const statusClientClosed = 499
+
+// errClientClosed 客户端已断开，不再尝试其他Cookie
+var errClientClosed = &chatError{status: statusClientClosed, apiErr: &APIError{Message: "客户端已断开连接", Type: errTypeInvalidRequest}}
+
+// attemptTrail 一次请求中各Cookie的尝试记录，通过响应头返回便于排查
+type attemptTrail struct {
+	entries []string
+}
+
+// add 记录一次尝试的结果
+func (t *attemptTrail) add(cookieID, result string) {
+	t.entries = append(t.entries, cookieID+"="+result)
+}
+
+// writeHeaders 写入尝试次数和尝试记录响应头
+func (t *attemptTrail) writeHeaders(c *gin.Context) {
+	if len(t.entries) == 0 {
+		return
+	}
+	c.Header("X-CTO2API-Attempts", strconv.Itoa(len(t.entries)))
+	c.Header("X-CTO2API-Attempt-Trail", strings.Join(t.entries, ", "))
+}
+
+// startChat 选择Cookie、完成认证并创建（或续接）上游聊天
+// 认证或创建失败时自动换用下一个Cookie重试，直到达到最大尝试次数或超时
+func (h *APIHandler) startChat(c *gin.Context, model string, messages []services.PromptMessage) (_ *upstreamChat, err error) {
+	adapter := modelMapping[model]
+	if adapter == "" {
+		adapter = "ClaudeSonnet4_5"
+	}
+
+	started := time.Now()
+	label := metricsModel(model)
+	c.Set(modelContextKey, label)
+
+	key := currentAPIKey(c)
+	reqLog := currentRequestLog(c)
+	reqLog.model, reqLog.adapter = model, adapter
+	if key != nil {
+		reqLog.keyName = key.Name
+	}
+
+	trail := &attemptTrail{}
+	reserved := false
+	defer func() {
+		trail.writeHeaders(c)
+		reqLog.attempts = len(trail.entries)
+		reqLog.err = err
+		// 没有创建上游聊天时退还预留的额度
+		if err != nil && reserved {
+			h.store.RefundAPIKeyCredit(key.ID, started)
+		}
+	}()
+
+	if err := h.checkAPIKeyQuota(c, key, model); err != nil {
+		return nil, err
+	}
+	reserved = key != nil
+
+	ctx := c.Request.Context()
+
+	// 会话亲和：优先续接已有的上游会话
+	owner := ""
+	if key != nil {
+		owner = key.ID
+	}
+	if chat := h.continueChat(ctx, owner, adapter, messages, trail, reqLog); chat != nil {
+		h.acceptChat(c, chat, label, started)
+		return chat, nil
+	}
+
+	prompt, err := h.prompts.Build(messages)
+	if err != nil {
+		return nil, &chatError{status: http.StatusBadRequest, apiErr: &APIError{Message: err.Error(), Type: errTypeInvalidRequest, Param: "messages"}}
+	}
+
+	cfg := config.Get()
+	maxAttempts := cfg.FailoverMaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	deadline := time.Now().Add(time.Duration(cfg.FailoverTimeoutSeconds) * time.Second)
+
+	tried := make(map[string]bool)
+	var lastErr *chatError
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 && time.Now().After(deadline) {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, errClientClosed
+		}
+
+		cookieInfo := h.store.GetNextCookieExcluding(tried)
+		if cookieInfo == nil && len(tried) == 0 && h.store.AllAtCapacity() {
+			// 所有Cookie都达到并发上限：排队等待释放
+			var queueErr *chatError
+			if cookieInfo, queueErr = h.waitForCookie(ctx, c, tried); queueErr != nil {
+				return nil, queueErr
+			}
+		}
+		if cookieInfo == nil {
+			break
+		}
+		tried[cookieInfo.ID] = true
+
+		chat := &upstreamChat{
+			ctx:      ctx,
+			client:   services.NewCTOClient(cookieInfo.Cookie, h.endpoints),
+			cookie:   cookieInfo,
+			chatID:   uuid.New().String(),
+			prompt:   prompt,
+			messages: messages,
+			adapter:  adapter,
+			apiKeyID: owner,
+			log:      reqLog,
+		}
+		if err := h.createChat(chat, adapter); err != nil {
+			h.store.ReleaseCookie(cookieInfo.ID)
+			if ctx.Err() != nil {
+				trail.add(cookieInfo.ID, "client_closed")
+				return nil, errClientClosed
+			}
+			trail.add(cookieInfo.ID, err.stage+"_failed")
+			slog.Debug("上游尝试失败", "request_id", reqLog.id, "cookie_id", cookieInfo.ID, "stage", err.stage, "error", err)
+			lastErr = err
+			continue
+		}
+
+		trail.add(cookieInfo.ID, "ok")
+		h.acceptChat(c, chat, label, started)
+		return chat, nil
+	}
+
+	if lastErr == nil {
+		return nil, &chatError{status: http.StatusServiceUnavailable, apiErr: &APIError{
+			Message: "没有可用的Cookie", Type: errTypeServer, Code: errCodeNoAvailableCookie,
+		}}
+	}
+	if len(trail.entries) > 1 {
+		lastErr.apiErr.Message = fmt.Sprintf("尝试%d个Cookie均失败，最后一次错误: %s", len(tried), lastErr.apiErr.Message)
+	}
+	return nil, lastErr
+}
+
+// acceptChat 上游聊天创建成功：记录指标和日志需要的信息
+// 响应头X-CTO2API-Chat-ID返回上游聊天ID，用于订阅/v1/cto/events
+func (h *APIHandler) acceptChat(c *gin.Context, chat *upstreamChat, model string, started time.Time) {
+	chat.model = model
+	chat.started = started
+	chat.log.cookieID = chat.cookie.ID
+	chat.log.chatID = chat.chatID
+	c.Header("X-CTO2API-Chat-ID", chat.chatID)
+}
+
+// continueChat 根据对话前缀查找owner用相同适配器创建的上游会话，只发送新的消息
+// 找不到映射、映射已过期或续接失败时返回nil，由调用方创建新会话
+func (h *APIHandler) continueChat(ctx context.Context, owner, adapter string, messages []services.PromptMessage, trail *attemptTrail, reqLog *requestLog) *upstreamChat {
+	if h.conversations == nil {
+		return nil
+	}
+
+	split := lastAssistantIndex(messages)
+	if split < 0 {
+		return nil
+	}
+
+	fingerprint := services.FingerprintMessages(messages[:split+1])
+	conv := h.conversations.Lookup(fingerprint, owner, adapter)
+	if conv == nil {
+		return nil
+	}
+
+	prompt, err := h.prompts.Build(messages[split+1:])
+	if err != nil {
+		return nil
+	}
+
+	cookieInfo := h.store.UseCookie(conv.CookieID)
+	if cookieInfo == nil {
+		h.conversations.Forget(fingerprint)
+		return nil
+	}
+
+	chat := &upstreamChat{
+		ctx:      ctx,
+		client:   services.NewCTOClient(cookieInfo.Cookie, h.endpoints),
+		cookie:   cookieInfo,
+		chatID:   conv.ChatID,
+		prompt:   prompt,
+		messages: messages,
+		adapter:  adapter,
+		apiKeyID: owner,
+		log:      reqLog,
+	}
+	if err := h.createChat(chat, adapter); err != nil {
+		h.store.ReleaseCookie(cookieInfo.ID)
+		if ctx.Err() != nil {
+			trail.add(cookieInfo.ID, "continue_client_closed")
+			return nil
+		}
+		trail.add(cookieInfo.ID, "continue_"+err.stage+"_failed")
+		h.conversations.Forget(fingerprint)
+		return nil
+	}
+
+	trail.add(cookieInfo.ID, "continue_ok")
+	reqLog.continued = true
+	return chat
+}
+
+// createChat 获取认证信息并向上游发送prompt，失败时记录到对应Cookie（客户端断开导致的失败不记录）
+func (h *APIHandler) createChat(chat *upstreamChat, adapter string) *chatError {
+	defer func() { chat.log.addTimings(chat.client.Timings()) }()
+
+	clerkInfo, jwt, err := chat.client.Authenticate(chat.ctx)
+	if err != nil {
+		h.recordChatFailure(chat, err)
+		stage := "clerk"
+		var authErr *services.AuthError
+		if errors.As(err, &authErr) {
+			stage = authErr.Stage
+		}
+		return upstreamChatError(err.Error(), stage, err)
+	}
+
+	if err := chat.client.CreateChat(chat.ctx, jwt, chat.prompt, adapter, chat.chatID); err != nil {
+		h.recordChatFailure(chat, err)
+		return upstreamChatError("创建聊天失败: "+err.Error(), "create", err)
+	}
+
+	h.store.RecordSuccess(chat.cookie.ID)
+	chat.clerk = clerkInfo
+	return nil
+}
+
+// recordFailure 按错误类型记录Cookie失败，触发冷却或隔离
+func (h *APIHandler) recordFailure(cookieID string, err error) {
+	h.store.RecordFailure(cookieID, services.ClassifyFailure(err), err.Error())
+}
+
+// recordChatFailure 记录聊天过程中的失败，客户端已断开时不计入Cookie健康状态
+func (h *APIHandler) recordChatFailure(chat *upstreamChat, err error) {
+	if chat.ctx.Err() != nil {
+		return
+	}
+	h.recordFailure(chat.cookie.ID, err)
+}
+
+// streamResult 上游输出的解析结果
+type streamResult struct {
+	text      string                    // 去除工具调用块后的文本
+	calls     []services.ParsedToolCall // 解析出的工具调用
+	raw       string                    // 上游原始输出
+	reasoning string                    // 代理的思考过程
+}
+
+// consumeStream 读取上游流式输出，按需解析工具调用并通过回调增量输出
+// parser为nil时不解析工具调用；回调可以为nil（非流式）。结束后释放Cookie的并发占用
+// 客户端断开时关闭上游连接并返回ctx的错误。所有代理事件同时发布到事件订阅
+// 上游没有公开的停止任务接口，断开后已提交的任务仍会在上游继续执行，这里只停止读取
+func (h *APIHandler) consumeStream(chat *upstreamChat, parser *services.ToolCallParser, onText func(string), onToolCall func(services.ParsedToolCall), onReasoning func(string)) (*streamResult, error) {
+	defer h.store.ReleaseCookie(chat.cookie.ID)
+
+	streamStart := time.Now()
+	defer func() { h.metrics.ObserveStream(chat.model, time.Since(streamStart)) }()
+	firstToken := false
+
+	result := &streamResult{}
+	var text, raw, reasoning strings.Builder
+
+	emit := func(chunk string, calls []services.ParsedToolCall) {
+		if chunk != "" {
+			text.WriteString(chunk)
+			if onText != nil {
+				onText(chunk)
+			}
+		}
+		for _, call := range calls {
+			result.calls = append(result.calls, call)
+			if onToolCall != nil {
+				onToolCall(call)
+			}
+		}
+	}
+
+	responseChan := make(chan services.StreamResponse, 100)
+	go chat.client.StreamChat(chat.ctx, chat.chatID, chat.clerk.UserID, responseChan)
+
+	for resp := range responseChan {
+		if resp.Error != nil {
+			chat.log.err = resp.Error
+			chat.log.response = text.String()
+			h.recordChatFailure(chat, resp.Error)
+			h.publishEvent(chat, services.AgentEvent{Type: services.AgentEventError, Content: resp.Error.Error()})
+			return nil, resp.Error
+		}
+
+		if resp.Done {
+			h.publishEvent(chat, services.AgentEvent{Type: services.AgentEventDone})
+			break
+		}
+
+		if !firstToken && (resp.Content != "" || (resp.Event != nil && resp.Event.Type == services.AgentEventReasoning && resp.Event.Content != "")) {
+			firstToken = true
+			chat.log.firstToken = time.Since(chat.started)
+			h.metrics.ObserveFirstToken(chat.model, chat.log.firstToken)
+		}
+
+		if resp.Event != nil {
+			h.publishEvent(chat, *resp.Event)
+			if resp.Event.Type == services.AgentEventReasoning && resp.Event.Content != "" {
+				reasoning.WriteString(resp.Event.Content)
+				if onReasoning != nil {
+					onReasoning(resp.Event.Content)
+				}
+			}
+		}
+
+		if resp.Content != "" {
+			raw.WriteString(resp.Content)
+			if parser != nil {
+				emit(parser.Feed(resp.Content))
+			} else {
+				emit(resp.Content, nil)
+			}
+		}
+	}
+
+	if err := chat.ctx.Err(); err != nil {
+		chat.log.err = err
+		chat.log.response = text.String()
+		return nil, err
+	}
+
+	if parser != nil {
+		emit(parser.Flush())
+	}
+
+	result.text = text.String()
+	result.raw = raw.String()
+	result.reasoning = reasoning.String()
+	chat.log.response = services.RenderToolCalls(result.text, result.calls)
+	h.finishChat(chat, chat.log.response)
+	return result, nil
+}
+
+// publishEvent 发布聊天的代理事件
+func (h *APIHandler) publishEvent(chat *upstreamChat, event services.AgentEvent) {
+	h.events.Publish(services.ChatEvent{ChatID: chat.chatID, CookieID: chat.cookie.ID, APIKeyID: chat.apiKeyID, AgentEvent: event})
+}
+
+// apiKeyContextKey gin上下文中保存调用方API密钥的键
+const apiKeyContextKey = "api_key"
+
+// validateAPIKey 校验调用方API密钥，通过后保存到上下文；失败时返回HTTP状态码和错误信息
+func (h *APIHandler) validateAPIKey(c *gin.Context, apiKey string) (int, string) {
+	if !h.store.HasAPIKeys() {
+		return http.StatusServiceUnavailable, "API密钥未设置，请先在管理页面设置"
+	}
+	if apiKey == "" {
+		return http.StatusUnauthorized, "缺少API密钥"
+	}
+	info, err := h.store.LookupAPIKey(apiKey)
+	if err != nil {
+		return http.StatusUnauthorized, err.Error()
+	}
+	c.Set(apiKeyContextKey, info)
+	return 0, ""
+}
+
+// currentAPIKey 当前请求使用的API密钥，未校验时为nil
+func currentAPIKey(c *gin.Context) *models.APIKeyInfo {
+	if v, ok := c.Get(apiKeyContextKey); ok {
+		return v.(*models.APIKeyInfo)
+	}
+	return nil
+}
+
+// checkAPIKeyQuota 检查API密钥的模型权限、请求频率和每日额度，通过后记录一次请求并预留一次额度
+func (h *APIHandler) checkAPIKeyQuota(c *gin.Context, key *models.APIKeyInfo, model string) *chatError {
+	if key != nil && !key.AllowsModel(model) {
+		return &chatError{status: http.StatusForbidden, apiErr: &APIError{
+			Message: fmt.Sprintf("API密钥不允许使用模型 %s", model), Type: errTypePermission, Param: "model", Code: errCodeModelNotAllowed,
+		}}
+	}
+	if err := h.checkRateLimit(c, key); err != nil {
+		return err
+	}
+	if key == nil {
+		return nil
+	}
+	switch err := h.store.ConsumeAPIKeyRequest(key.ID); {
+	case errors.Is(err, models.ErrAPIKeyDailyCredits):
+		return &chatError{status: http.StatusTooManyRequests, apiErr: &APIError{
+			Message: err.Error(), Type: errTypeInsufficientQuota, Code: errCodeDailyQuota,
+		}}
+	case err != nil:
+		return &chatError{status: http.StatusUnauthorized, apiErr: apiKeyError(http.StatusUnauthorized, err.Error())}
+	}
+	return nil
+}
+
+// finishChat 聊天完成后记录会话亲和，供下一轮续接
+func (h *APIHandler) finishChat(chat *upstreamChat, response string) {
+	if h.conversations == nil || response == "" {
+		return
+	}
+
+	history := make([]services.PromptMessage, 0, len(chat.messages)+1)
+	history = append(history, chat.messages...)
+	history = append(history, services.PromptMessage{Role: "assistant", Content: response})
+	h.conversations.Remember(services.FingerprintMessages(history), services.Conversation{
+		ChatID:   chat.chatID,
+		CookieID: chat.cookie.ID,
+		OwnerKey: chat.apiKeyID,
+		Adapter:  chat.adapter,
+	})
+}
+
+// lastAssistantIndex 最后一条助手消息的下标，没有时返回-1
+func lastAssistantIndex(messages []services.PromptMessage) int {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "assistant" {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,388 @@
+// Package fakeupstream 模拟cto.new上游（Clerk认证、聊天、用量和WebSocket流式输出），用于集成测试和本地调试
+package fakeupstream
+
+import (
+	"cto2api/services"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Account 模拟的cto.new账号，通过Cookie识别
+type Account struct {
+	Cookie    string
+	UserID    string
+	SessionID string
+
+	ClerkStatus int  // 非0时organization_memberships返回该状态码
+	NoSession   bool // organization_memberships不返回活动会话
+	TokenStatus int  // 非0时tokens返回该状态码
+	ChatStatus  int  // 非0时engine-agent/chat返回该状态码
+
+	Reply    []string // 回复内容，每一项作为一个update帧发送，最后发送inProgress=false的state帧
+	Thinking []string // 思考过程，在Reply之前作为thinking缓冲发送
+	Frames   []string // 原始WebSocket帧，设置后代替Reply原样发送
+	Abort    bool     // 发送完帧后直接断开连接（不发送关闭帧），模拟流中断
+	Hold     bool     // 发送完帧后保持连接，直到客户端关闭，模拟长时间运行的任务
+
+	Billing services.BillingInfo // billing接口返回的用量
+}
+
+// Chat 收到的一次engine-agent/chat请求
+type Chat struct {
+	Cookie  string
+	ChatID  string
+	Prompt  string
+	Adapter string
+}
+
+// Server 模拟上游服务
+type Server struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	accounts    map[string]*Account // Cookie -> 账号
+	tokens      map[string]*Account // JWT -> 账号
+	streams     map[string]*Account // chatHistoryId -> 账号
+	chats       []Chat
+	clerkCalls  int
+	tokenCalls  int
+	openStreams int
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// New 在随机端口启动模拟上游
+func New() *Server {
+	s := newServer()
+	s.Server = httptest.NewServer(s.handler())
+	return s
+}
+
+// NewOn 在指定地址启动模拟上游
+func NewOn(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newServer()
+	s.Server = httptest.NewUnstartedServer(s.handler())
+	s.Server.Listener.Close()
+	s.Server.Listener = listener
+	s.Server.Start()
+	return s, nil
+}
+
+func newServer() *Server {
+	return &Server{
+		accounts: make(map[string]*Account),
+		tokens:   make(map[string]*Account),
+		streams:  make(map[string]*Account),
+	}
+}
+
+// handler 上游路由
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/me/organization_memberships", s.handleMemberships)
+	mux.HandleFunc("/v1/client/sessions/", s.handleTokens)
+	mux.HandleFunc("/engine-agent/chat", s.handleChat)
+	mux.HandleFunc("/engine-agent/chat-histories/", s.handleStream)
+	mux.HandleFunc("/billing", s.handleBilling)
+	return mux
+}
+
+// Endpoints 指向模拟上游的地址
+func (s *Server) Endpoints() services.Endpoints {
+	return services.Endpoints{
+		ClerkBaseURL:  s.URL,
+		APIBaseURL:    s.URL,
+		StreamBaseURL: "ws" + strings.TrimPrefix(s.URL, "http"),
+	}
+}
+
+// AddAccount 注册账号，未设置的UserID和SessionID自动生成
+func (s *Server) AddAccount(account *Account) *Account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.accounts) + 1
+	if account.UserID == "" {
+		account.UserID = fmt.Sprintf("user_%d", n)
+	}
+	if account.SessionID == "" {
+		account.SessionID = fmt.Sprintf("sess_%d", n)
+	}
+	s.accounts[account.Cookie] = account
+	return account
+}
+
+// Chats 收到的所有聊天请求
+func (s *Server) Chats() []Chat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Chat(nil), s.chats...)
+}
+
+// ClerkCalls organization_memberships被调用的次数
+func (s *Server) ClerkCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clerkCalls
+}
+
+// TokenCalls tokens被调用的次数
+func (s *Server) TokenCalls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenCalls
+}
+
+// handleMemberships 返回Clerk客户端信息（会话ID和用户ID）
+func (s *Server) handleMemberships(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.clerkCalls++
+	account := s.accounts[r.Header.Get("Cookie")]
+	s.mu.Unlock()
+
+	if account == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if account.ClerkStatus != 0 {
+		http.Error(w, "clerk error", account.ClerkStatus)
+		return
+	}
+
+	sessions := []interface{}{}
+	if !account.NoSession {
+		sessions = append(sessions, map[string]interface{}{
+			"id": account.SessionID,
+			"user": map[string]interface{}{
+				"id":              account.UserID,
+				"first_name":      "Test",
+				"email_addresses": []interface{}{map[string]interface{}{"email_address": account.UserID + "@example.com"}},
+			},
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"response": []interface{}{},
+		"client": map[string]interface{}{
+			"last_active_session_id": account.SessionID,
+			"sessions":               sessions,
+		},
+	})
+}
+
+// handleTokens 为会话签发JWT
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.tokenCalls++
+	account := s.accounts[r.Header.Get("Cookie")]
+	s.mu.Unlock()
+
+	if r.Method != http.MethodPost || account == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if account.TokenStatus != 0 {
+		http.Error(w, "token error", account.TokenStatus)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v1/client/sessions/"+account.SessionID+"/tokens") {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	jwt := issueJWT(account, time.Now().Add(time.Minute))
+	s.mu.Lock()
+	s.tokens[jwt] = account
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{"object": "token", "jwt": jwt})
+}
+
+// handleChat 接收prompt，之后通过WebSocket输出回复
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	account := s.authorize(r)
+	if account == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if account.ChatStatus != 0 {
+		http.Error(w, `{"error":"chat error"}`, account.ChatStatus)
+		return
+	}
+
+	var body struct {
+		Prompt        string `json:"prompt"`
+		ChatHistoryID string `json:"chatHistoryId"`
+		AdapterName   string `json:"adapterName"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ChatHistoryID == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	s.streams[body.ChatHistoryID] = account
+	s.chats = append(s.chats, Chat{
+		Cookie:  account.Cookie,
+		ChatID:  body.ChatHistoryID,
+		Prompt:  body.Prompt,
+		Adapter: body.AdapterName,
+	})
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]interface{}{"chatHistoryId": body.ChatHistoryID})
+}
+
+// OpenStreams 当前仍然打开的WebSocket流数量
+func (s *Server) OpenStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.openStreams
+}
+
+// handleStream 按脚本发送update/state帧
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	chatID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/engine-agent/chat-histories/"), "/buffer/stream")
+
+	s.mu.Lock()
+	account := s.streams[chatID]
+	s.mu.Unlock()
+
+	if account == nil || r.URL.Query().Get("token") != account.UserID {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.openStreams++
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.openStreams--
+		s.mu.Unlock()
+	}()
+
+	for _, frame := range scriptFrames(account) {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			return
+		}
+	}
+	if account.Abort {
+		return
+	}
+	if account.Hold {
+		// 客户端不会发送消息，读取只用于等待连接关闭
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// handleBilling 返回账号用量
+func (s *Server) handleBilling(w http.ResponseWriter, r *http.Request) {
+	account := s.authorize(r)
+	if account == nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, account.Billing)
+}
+
+// authorize 根据Bearer JWT查找账号
+func (s *Server) authorize(r *http.Request) *Account {
+	jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokens[jwt]
+}
+
+// scriptFrames 账号的WebSocket帧脚本
+func scriptFrames(account *Account) []string {
+	if account.Frames != nil {
+		return account.Frames
+	}
+
+	frames := make([]string, 0, len(account.Thinking)+len(account.Reply)+1)
+	for _, content := range account.Thinking {
+		frames = append(frames, BufferFrame("thinking", content))
+	}
+	for _, content := range account.Reply {
+		frames = append(frames, UpdateFrame(content))
+	}
+	return append(frames, StateFrame(false))
+}
+
+// UpdateFrame 构造一个包含聊天内容的update帧
+func UpdateFrame(content string) string {
+	return BufferFrame("chat", content)
+}
+
+// BufferFrame 构造一个指定缓冲类型（chat、thinking等）的update帧
+func BufferFrame(kind, content string) string {
+	inner, _ := json.Marshal(map[string]interface{}{
+		"type": kind,
+		kind:   map[string]interface{}{"content": content},
+	})
+	frame, _ := json.Marshal(map[string]interface{}{
+		"type":   "update",
+		"buffer": string(inner),
+	})
+	return string(frame)
+}
+
+// StateFrame 构造一个state帧，inProgress为false表示回复结束
+func StateFrame(inProgress bool) string {
+	frame, _ := json.Marshal(map[string]interface{}{
+		"type":  "state",
+		"state": map[string]interface{}{"inProgress": inProgress},
+	})
+	return string(frame)
+}
+
+// issueJWT 签发一个只包含过期时间等声明的未签名JWT
+func issueJWT(account *Account, expiresAt time.Time) string {
+	encode := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	header := encode(map[string]string{"alg": "none", "typ": "JWT"})
+	payload := encode(map[string]interface{}{
+		"sub": account.UserID,
+		"sid": account.SessionID,
+		"exp": expiresAt.Unix(),
+		"iat": time.Now().Unix(),
+	})
+	return header + "." + payload + ".fake"
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
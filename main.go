@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
 	"cto2api/config"
 	"cto2api/handlers"
 	"cto2api/models"
+	"cto2api/services"
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -18,15 +25,107 @@ import (
 var webFS embed.FS
 
 func main() {
-	// 初始化数据存储
-	store := models.GetStore("data.json")
+	// 加载配置
+	cfg := config.Load()
 
-	// 创建Gin引擎
+	// 初始化JSON日志，标准库log的输出也经过同一个处理器
+	logger, err := services.NewLogger(services.LogOptions{
+		Level:      cfg.LogLevel,
+		File:       cfg.LogFile,
+		MaxSizeMB:  cfg.LogMaxSizeMB,
+		MaxBackups: cfg.LogMaxBackups,
+		MaxAgeDays: cfg.LogMaxAgeDays,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	// 初始化数据存储，第一次启动时从旧版data.json导入
+	storage, err := models.OpenBoltStorage(cfg.DBFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	imported, err := models.ImportJSONFile(storage, cfg.DataFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if imported {
+		log.Printf("已从 %s 导入数据到 %s", cfg.DataFile, cfg.DBFile)
+	}
+	store, err := models.GetStore(storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store.StartFlushing(time.Duration(cfg.StoreFlushSeconds) * time.Second)
+	defer store.Close()
+	store.SetHealthPolicy(models.HealthPolicy{
+		FailureThreshold: cfg.HealthFailureThreshold,
+		BaseCooldown:     time.Duration(cfg.HealthBaseCooldownSeconds) * time.Second,
+		MaxCooldown:      time.Duration(cfg.HealthMaxCooldownMinutes) * time.Minute,
+		DeadAfter:        cfg.HealthDeadAfter,
+	})
+	store.SetSelectionStrategy(cfg.CookieStrategy)
+
+	// 启动JWT后台提前刷新
+	tokens := services.SharedTokenCache()
+	tokens.Start()
+	defer tokens.Stop()
+
+	// 上游地址
+	endpoints := services.Endpoints{
+		ClerkBaseURL:      cfg.ClerkBaseURL,
+		APIBaseURL:        cfg.APIBaseURL,
+		StreamBaseURL:     cfg.StreamBaseURL,
+		ClerkAPIVersion:   cfg.ClerkAPIVersion,
+		ClerkJSVersion:    cfg.ClerkJSVersion,
+		ClerkJWTJSVersion: cfg.ClerkJWTJSVersion,
+	}
+
+	// 录制上游流量（用于离线回放和golden测试）
+	if cfg.RecordDir != "" {
+		recorder, err := services.NewRecorder(cfg.RecordDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		services.SetRecorder(recorder)
+		log.Printf("上游流量录制到: %s", cfg.RecordDir)
+	}
+
+	// 启动Cookie半开探测
+	prober := services.NewHealthProber(store, endpoints, time.Duration(cfg.HealthProbeIntervalSeconds)*time.Second)
+	prober.Start()
+	defer prober.Stop()
+
+	// 创建Gin引擎（/v1请求由RequestLogger输出结构化日志，不使用gin的访问日志）
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.Recovery())
 
 	// 创建API处理器
-	apiHandler := handlers.NewAPIHandler(store)
+	apiHandler := handlers.NewAPIHandler(store, endpoints)
+
+	// 启动Cookie用量后台刷新
+	usage := services.NewUsageManager(store, endpoints, time.Duration(cfg.UsageRefreshMinutes)*time.Minute)
+	usage.Start()
+	defer usage.Stop()
+	apiHandler.UseUsageManager(usage)
+
+	// 请求记录
+	if cfg.JournalEnabled {
+		journal, err := services.NewJournal(storage, services.JournalOptions{
+			Retention:     time.Duration(cfg.JournalRetentionDays) * 24 * time.Hour,
+			RecordBodies:  cfg.JournalBodies,
+			BodyMaxBytes:  cfg.JournalBodyMaxBytes,
+			BodyRetention: time.Duration(cfg.JournalBodyRetentionDays) * 24 * time.Hour,
+			MaxEntries:    cfg.JournalMaxEntries,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		apiHandler.UseJournal(journal)
+		log.Printf("请求记录已开启")
+	}
 
 	// 静态文件服务（管理前端）
 	webContent, err := fs.Sub(webFS, "web")
@@ -35,31 +134,8 @@ func main() {
 	}
 	r.StaticFS("/admin", http.FS(webContent))
 
-	// 管理API路由
-	admin := r.Group("/api/admin")
-	{
-		admin.GET("/check-setup", apiHandler.CheckSetup)
-		admin.POST("/setup", apiHandler.Setup)
-		admin.POST("/login", apiHandler.Login)
-
-		// 需要认证的路由（简化版，实际应该使用中间件）
-		admin.GET("/cookies", apiHandler.ListCookies)
-		admin.POST("/cookies", apiHandler.AddCookie)
-		admin.PUT("/cookies/:id", apiHandler.UpdateCookie)
-		admin.DELETE("/cookies/:id", apiHandler.DeleteCookie)
-		admin.POST("/cookies/:id/test", apiHandler.TestCookie)
-		admin.GET("/cookies/:id/usage", apiHandler.GetCookieUsage)
-		admin.GET("/api-key", apiHandler.GetAPIKey)
-		admin.PUT("/api-key", apiHandler.UpdateAPIKey)
-		admin.GET("/usage", apiHandler.GetUsage)
-	}
-
-	// OpenAI兼容API路由
-	v1 := r.Group("/v1")
-	{
-		v1.GET("/models", apiHandler.ListModels)
-		v1.POST("/chat/completions", apiHandler.ChatCompletions)
-	}
+	// 管理API和兼容API路由
+	apiHandler.RegisterRoutes(r)
 
 	// 根路径
 	r.GET("/", func(c *gin.Context) {
@@ -70,9 +146,6 @@ func main() {
 		})
 	})
 
-	// 加载配置
-	cfg := config.Load()
-
 	// 获取服务器URL（用于日志显示）
 	serverURL := getServerURL(cfg.Port)
 
@@ -83,10 +156,25 @@ func main() {
 	log.Printf("API端点: %s/v1/chat/completions", serverURL)
 	log.Println("============================================================")
 
-	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
-	if err := r.Run(addr); err != nil {
+	// 收到退出信号后停止接收请求，退出前写入未保存的数据
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
+		Handler: r,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
+	log.Println("服务器已停止")
 }
 
 // getServerURL 获取服务器URL用于日志显示
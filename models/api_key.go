@@ -0,0 +1,264 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+// DefaultAPIKeyID 初始设置和旧版单密钥使用的密钥ID
+const DefaultAPIKeyID = "default"
+
+// apiKeyDateLayout 每日额度的日期格式
+const apiKeyDateLayout = "2006-01-02"
+
+// API密钥错误
+var (
+	ErrAPIKeyInvalid      = errors.New("无效的API密钥")
+	ErrAPIKeyRevoked      = errors.New("API密钥已撤销")
+	ErrAPIKeyExpired      = errors.New("API密钥已过期")
+	ErrAPIKeyNotFound     = errors.New("API密钥不存在")
+	ErrAPIKeyDailyCredits = errors.New("超过API密钥每日额度")
+)
+
+// APIKeyInfo 调用方API密钥，只保存密钥的SHA-256哈希
+type APIKeyInfo struct {
+	ID               string      `json:"id"`
+	Name             string      `json:"name"`
+	Owner            string      `json:"owner,omitempty"`
+	KeyHash          string      `json:"key_hash,omitempty"` // 密钥的SHA-256（十六进制），管理接口不返回
+	Hint             string      `json:"hint"`               // 脱敏后的密钥，如 sk-abcd...
+	CreatedAt        time.Time   `json:"created_at"`
+	ExpiresAt        *time.Time  `json:"expires_at,omitempty"`     // 为空表示不过期
+	RevokedAt        *time.Time  `json:"revoked_at,omitempty"`     // 撤销时间，撤销后保留记录
+	AllowedModels    []string    `json:"allowed_models,omitempty"` // 允许使用的模型，为空表示不限制
+	RPMLimit         int         `json:"rpm_limit"`                // 每分钟请求数，0表示不限制
+	DailyCreditLimit int         `json:"daily_credit_limit"`       // 每日额度（每次上游聊天计1），0表示不限制
+	Usage            APIKeyUsage `json:"usage"`
+}
+
+// APIKeyUsage API密钥用量计数
+type APIKeyUsage struct {
+	RequestCount int       `json:"request_count"` // 请求次数
+	Credits      int       `json:"credits"`       // 累计消耗的额度
+	DailyCredits int       `json:"daily_credits"` // DailyDate当天消耗的额度
+	DailyDate    string    `json:"daily_date"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+}
+
+// Active 密钥是否可用（未撤销、未过期）
+func (k *APIKeyInfo) Active(now time.Time) bool {
+	return k.check(now) == nil
+}
+
+// check 检查密钥状态
+func (k *APIKeyInfo) check(now time.Time) error {
+	if k.RevokedAt != nil {
+		return ErrAPIKeyRevoked
+	}
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return ErrAPIKeyExpired
+	}
+	return nil
+}
+
+// AllowsModel 是否允许使用该模型
+func (k *APIKeyInfo) AllowsModel(model string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	for _, m := range k.AllowedModels {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// dailyCredits 当天已消耗的额度
+func (k *APIKeyInfo) dailyCredits(now time.Time) int {
+	if k.Usage.DailyDate != now.Format(apiKeyDateLayout) {
+		return 0
+	}
+	return k.Usage.DailyCredits
+}
+
+// copy 返回副本，避免调用方修改存储中的数据
+func (k *APIKeyInfo) copy() *APIKeyInfo {
+	c := *k
+	c.AllowedModels = append([]string(nil), k.AllowedModels...)
+	return &c
+}
+
+// GenerateAPIKey 生成随机API密钥
+func GenerateAPIKey() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "sk-" + hex.EncodeToString(buf), nil
+}
+
+// HashAPIKey 计算API密钥的哈希
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyHintLen 脱敏显示保留的前缀长度
+const apiKeyHintLen = 7
+
+// maskAPIKey 只保留固定长度的前缀；密钥太短时不显示任何字符
+func maskAPIKey(key string) string {
+	if len(key) < apiKeyHintLen*3 {
+		return "..."
+	}
+	return key[:apiKeyHintLen] + "..."
+}
+
+// HasAPIKeys 是否存在可用的API密钥
+func (s *DataStore) HasAPIKeys() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, k := range s.apiKeys {
+		if k.Active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupAPIKey 按密钥明文查找，密钥无效、已撤销或已过期时返回错误
+func (s *DataStore) LookupAPIKey(key string) (*APIKeyInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, ok := s.apiKeys[s.keyHashes[HashAPIKey(key)]]
+	if !ok {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err := info.check(time.Now()); err != nil {
+		return nil, err
+	}
+	return info.copy(), nil
+}
+
+// CreateAPIKey 保存新的API密钥，key为明文（只保存哈希）
+func (s *DataStore) CreateAPIKey(info *APIKeyInfo, key string) error {
+	return s.update(func() error {
+		s.putAPIKey(info, key)
+		return nil
+	})
+}
+
+// putAPIKey 设置哈希并加入索引，同ID的旧密钥被替换（调用方需持有写锁）
+func (s *DataStore) putAPIKey(info *APIKeyInfo, key string) {
+	if old, ok := s.apiKeys[info.ID]; ok {
+		delete(s.keyHashes, old.KeyHash)
+	}
+	if info.CreatedAt.IsZero() {
+		info.CreatedAt = time.Now()
+	}
+	info.setKey(key)
+	s.apiKeys[info.ID] = info
+	s.keyHashes[info.KeyHash] = info.ID
+	s.apiKeyChanged(info.ID)
+}
+
+// setKey 保存密钥的哈希和脱敏显示
+func (k *APIKeyInfo) setKey(key string) {
+	k.KeyHash = HashAPIKey(key)
+	k.Hint = maskAPIKey(key)
+}
+
+// ListAPIKeys 列出所有API密钥（按创建时间排序，返回副本）
+func (s *DataStore) ListAPIKeys() []*APIKeyInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]*APIKeyInfo, 0, len(s.apiKeys))
+	for _, k := range s.apiKeys {
+		keys = append(keys, k.copy())
+	}
+	sortAPIKeys(keys)
+	return keys
+}
+
+// RevokeAPIKey 撤销API密钥，撤销后保留记录和用量
+func (s *DataStore) RevokeAPIKey(id string) error {
+	return s.update(func() error {
+		info, ok := s.apiKeys[id]
+		if !ok {
+			return ErrAPIKeyNotFound
+		}
+		if info.RevokedAt == nil {
+			now := time.Now()
+			info.RevokedAt = &now
+			s.apiKeyChanged(id)
+		}
+		return nil
+	})
+}
+
+// ConsumeAPIKeyRequest 检查每日额度，通过后记录一次请求并预留一次上游聊天的额度（每分钟请求数由handlers中的令牌桶限制）
+// 检查和预留在同一把锁内完成，并发请求不会超过每日额度；没有创建上游聊天时调用RefundAPIKeyCredit退还
+func (s *DataStore) ConsumeAPIKeyRequest(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.apiKeys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	now := time.Now()
+
+	if info.DailyCreditLimit > 0 && info.dailyCredits(now) >= info.DailyCreditLimit {
+		return ErrAPIKeyDailyCredits
+	}
+
+	today := now.Format(apiKeyDateLayout)
+	if info.Usage.DailyDate != today {
+		info.Usage.DailyDate = today
+		info.Usage.DailyCredits = 0
+	}
+	info.Usage.DailyCredits++
+	info.Usage.Credits++
+	info.Usage.RequestCount++
+	info.Usage.LastUsedAt = now
+	s.apiKeyChanged(id)
+	return nil
+}
+
+// RefundAPIKeyCredit 退还ConsumeAPIKeyRequest预留的额度（请求最终没有创建或续接上游聊天）
+// 预留后已经跨天时只退还累计额度，当天的额度已经重新计算
+func (s *DataStore) RefundAPIKeyCredit(id string, reservedAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, ok := s.apiKeys[id]
+	if !ok {
+		return
+	}
+	if info.Usage.Credits > 0 {
+		info.Usage.Credits--
+	}
+	if info.Usage.DailyDate == reservedAt.Format(apiKeyDateLayout) && info.Usage.DailyCredits > 0 {
+		info.Usage.DailyCredits--
+	}
+	s.apiKeyChanged(id)
+}
+
+// sortAPIKeys 按创建时间排序
+func sortAPIKeys(keys []*APIKeyInfo) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+}
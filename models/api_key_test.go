@@ -0,0 +1,80 @@
+package models_test
+
+import (
+	"cto2api/models"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsumeAPIKeyRequestReservesCredits(t *testing.T) {
+	store := newCookieStore(t)
+	if err := store.CreateAPIKey(&models.APIKeyInfo{ID: "k1", Name: "k1", DailyCreditLimit: 5}, "sk-reserve-test-key-0001"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 并发请求的检查和预留在同一把锁内，通过的请求数不超过每日额度
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := store.ConsumeAPIKeyRequest("k1")
+			if err != nil && !errors.Is(err, models.ErrAPIKeyDailyCredits) {
+				t.Error(err)
+			}
+			if err == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 5 {
+		t.Errorf("allowed = %d concurrent requests, want 5", allowed)
+	}
+
+	// 没有创建上游聊天的请求退还额度
+	store.RefundAPIKeyCredit("k1", time.Now())
+	if err := store.ConsumeAPIKeyRequest("k1"); err != nil {
+		t.Errorf("request after refund: %v", err)
+	}
+	if err := store.ConsumeAPIKeyRequest("k1"); !errors.Is(err, models.ErrAPIKeyDailyCredits) {
+		t.Errorf("request over the limit: %v, want ErrAPIKeyDailyCredits", err)
+	}
+
+	usage := store.ListAPIKeys()[0].Usage
+	if usage.DailyCredits != 5 || usage.Credits != 5 || usage.RequestCount != 6 {
+		t.Errorf("usage = %+v, want 5 credits for 6 accepted requests", usage)
+	}
+
+	// 预留发生在前一天时不减少当天的额度
+	store.RefundAPIKeyCredit("k1", time.Now().AddDate(0, 0, -1))
+	if usage := store.ListAPIKeys()[0].Usage; usage.DailyCredits != 5 || usage.Credits != 4 {
+		t.Errorf("usage after refunding yesterday's reservation = %+v", usage)
+	}
+}
+
+func TestAPIKeyHint(t *testing.T) {
+	store := newCookieStore(t)
+	keys := map[string]string{
+		"long":  "sk-0123456789abcdef0123456789abcdef",
+		"short": "sk-short",
+	}
+	for id, key := range keys {
+		if err := store.CreateAPIKey(&models.APIKeyInfo{ID: id, Name: id}, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{"long": "sk-0123...", "short": "..."}
+	for _, info := range store.ListAPIKeys() {
+		if info.Hint != want[info.ID] {
+			t.Errorf("%s hint = %q, want %q", info.ID, info.Hint, want[info.ID])
+		}
+	}
+}
@@ -1,26 +1,27 @@
 package models
 
 import (
-	"encoding/json"
-	"os"
+	"log/slog"
 	"sync"
 	"time"
 )
 
 // CookieInfo Cookie信息
 type CookieInfo struct {
-	ID           string    `json:"id"`
-	Cookie       string    `json:"cookie"`
-	Name         string    `json:"name"`          // 用户自定义名称
-	Enabled      bool      `json:"enabled"`       // 是否启用
-	RequestCount int       `json:"request_count"` // 请求次数
-	ErrorCount   int       `json:"error_count"`   // 错误次数
-	LastUsedAt   time.Time `json:"last_used_at"`  // 最近使用时间
-	CreatedAt    time.Time `json:"created_at"`    // 创建时间
-	Usage        *UsageInfo `json:"usage,omitempty"` // 用量信息（不保存到文件）
-}
-
-// UsageInfo 用量信息（临时数据，不保存）
+	ID           string        `json:"id"`
+	Cookie       string        `json:"cookie"`
+	Name         string        `json:"name"`             // 用户自定义名称
+	Enabled      bool          `json:"enabled"`          // 是否启用
+	Weight       int           `json:"weight,omitempty"` // 选择权重（weighted策略），未设置时为1
+	RequestCount int           `json:"request_count"`    // 请求次数
+	ErrorCount   int           `json:"error_count"`      // 错误次数
+	LastUsedAt   time.Time     `json:"last_used_at"`     // 最近使用时间
+	CreatedAt    time.Time     `json:"created_at"`       // 创建时间
+	Usage        *UsageInfo    `json:"usage,omitempty"`  // 最后已知的用量信息（后台定期刷新）
+	Health       *CookieHealth `json:"health,omitempty"` // 健康状态（熔断）
+}
+
+// UsageInfo 用量信息（保存最后已知值，重启后在刷新前仍可用于选择Cookie）
 type UsageInfo struct {
 	TaskCreditsUsage     int    `json:"task_credits_usage"`
 	TaskCreditsLimit     int    `json:"task_credits_limit"`
@@ -29,141 +30,342 @@ type UsageInfo struct {
 	LastUpdate           string `json:"last_update"`
 }
 
-// AppData 应用数据（包含密码、API密钥和所有cookie）
+// AppData 应用数据（包含密码、API密钥和所有cookie），也是旧版data.json的格式
 type AppData struct {
-	PasswordHash string        `json:"password_hash"` // bcrypt hash
-	APIKey       string        `json:"api_key"`       // OpenAI API密钥
+	PasswordHash string        `json:"password_hash"`     // bcrypt hash
+	APIKey       string        `json:"api_key,omitempty"` // 旧版明文API密钥，导入时迁移到APIKeys
+	APIKeys      []*APIKeyInfo `json:"api_keys"`
 	Cookies      []*CookieInfo `json:"cookies"`
+	Sessions     *SessionState `json:"sessions,omitempty"`
 }
 
-// DataStore 数据存储
+// SessionState 管理会话的注销状态，持久化后重启仍然有效
+type SessionState struct {
+	Gen     int64                `json:"gen"`     // 会话代数，注销所有会话时递增
+	Revoked map[string]time.Time `json:"revoked"` // 已注销的会话ID -> 原过期时间
+}
+
+// copy 复制注销状态（包括map）
+func (s SessionState) copy() SessionState {
+	revoked := make(map[string]time.Time, len(s.Revoked))
+	for id, exp := range s.Revoked {
+		revoked[id] = exp
+	}
+	return SessionState{Gen: s.Gen, Revoked: revoked}
+}
+
+// DataStore 数据存储：全部数据保存在内存中，变更通过Storage持久化
+// 管理操作立即写入；请求计数、用量和健康状态等频繁变化的数据只标记为待写入，由后台定期批量写入
 type DataStore struct {
 	mu           sync.RWMutex
-	data         *AppData
+	passwordHash string
+	sessions     SessionState
 	cookies      map[string]*CookieInfo
 	enabledList  []string // 启用的cookie ID列表
 	currentIndex int
-	dataFile     string
+	healthPolicy HealthPolicy
+	strategy     string         // Cookie选择策略
+	inFlight     map[string]int // 每个Cookie进行中的请求数（不保存）
+	apiKeys      map[string]*APIKeyInfo
+	keyHashes    map[string]string // 密钥哈希 -> 密钥ID
+	available    chan struct{}     // Cookie可能变为可分配时关闭并替换，用于唤醒排队的请求
+
+	storage   Storage
+	writeMu   sync.Mutex     // 保证按变更顺序写入存储
+	pending   pendingChanges // 等待写入存储的变更
+	stopFlush chan struct{}
+	flushDone chan struct{}
+}
+
+// pendingChanges 等待写入存储的变更
+type pendingChanges struct {
+	password bool
+	sessions bool
+	cookies  map[string]bool // 变更或删除的Cookie ID
+	apiKeys  map[string]bool
 }
 
 var (
-	store *DataStore
-	once  sync.Once
+	store     *DataStore
+	storeErr  error
+	storeOnce sync.Once
 )
 
-// GetStore 获取数据存储单例
-func GetStore(dataFile string) *DataStore {
-	once.Do(func() {
-		store = &DataStore{
-			data: &AppData{
-				Cookies: []*CookieInfo{},
-			},
-			cookies:  make(map[string]*CookieInfo),
-			dataFile: dataFile,
-		}
-		store.Load()
+// GetStore 获取数据存储单例，第一次调用时从storage加载数据
+func GetStore(storage Storage) (*DataStore, error) {
+	storeOnce.Do(func() {
+		store, storeErr = NewDataStore(storage)
 	})
-	return store
+	return store, storeErr
 }
 
-// Load 从文件加载数据
-func (s *DataStore) Load() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// NewDataStore 创建数据存储并从storage加载数据
+func NewDataStore(storage Storage) (*DataStore, error) {
+	s := &DataStore{
+		cookies:      make(map[string]*CookieInfo),
+		healthPolicy: DefaultHealthPolicy(),
+		strategy:     StrategyRoundRobin,
+		inFlight:     make(map[string]int),
+		apiKeys:      make(map[string]*APIKeyInfo),
+		keyHashes:    make(map[string]string),
+		available:    make(chan struct{}),
+		storage:      storage,
+		pending: pendingChanges{
+			cookies: make(map[string]bool),
+			apiKeys: make(map[string]bool),
+		},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
 
-	data, err := os.ReadFile(s.dataFile)
+// load 从存储加载数据并重建索引
+func (s *DataStore) load() error {
+	data, err := s.storage.Load()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // 文件不存在，使用空数据
-		}
 		return err
 	}
 
-	if err := json.Unmarshal(data, s.data); err != nil {
-		return err
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// 重建索引
+	s.passwordHash = data.PasswordHash
+	if data.Sessions != nil {
+		s.sessions = *data.Sessions
+	}
 	s.cookies = make(map[string]*CookieInfo)
 	s.enabledList = []string{}
-	
-	for _, c := range s.data.Cookies {
+	for _, c := range data.Cookies {
 		s.cookies[c.ID] = c
 		if c.Enabled {
 			s.enabledList = append(s.enabledList, c.ID)
 		}
 	}
 
+	s.apiKeys = make(map[string]*APIKeyInfo)
+	s.keyHashes = make(map[string]string)
+	for _, k := range data.APIKeys {
+		s.apiKeys[k.ID] = k
+		s.keyHashes[k.KeyHash] = k.ID
+	}
 	return nil
 }
 
-// Save 保存数据到文件
-func (s *DataStore) save() error {
-	// 更新cookies列表
-	s.data.Cookies = make([]*CookieInfo, 0, len(s.cookies))
-	for _, c := range s.cookies {
-		s.data.Cookies = append(s.data.Cookies, c)
+// defaultFlushInterval 默认的批量写入间隔
+const defaultFlushInterval = 5 * time.Second
+
+// StartFlushing 启动后台定期写入等待写入的变更，interval<=0时使用默认间隔
+func (s *DataStore) StartFlushing(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultFlushInterval
 	}
+	s.stopFlush = make(chan struct{})
+	s.flushDone = make(chan struct{})
+	go func() {
+		defer close(s.flushDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stopFlush:
+				return
+			case <-ticker.C:
+				if err := s.Flush(); err != nil {
+					slog.Error("保存数据失败", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close 停止后台写入，写入剩余的变更并关闭存储
+func (s *DataStore) Close() error {
+	if s.stopFlush != nil {
+		close(s.stopFlush)
+		<-s.flushDone
+	}
+	err := s.Flush()
+	if closeErr := s.storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Flush 立即写入所有等待写入的变更，失败时保留这些变更等待下次写入
+func (s *DataStore) Flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
 
-	data, err := json.MarshalIndent(s.data, "", "  ")
+	s.mu.Lock()
+	batch := s.takePending()
+	s.mu.Unlock()
+	if batch.empty() {
+		return nil
+	}
+
+	if err := s.storage.Apply(batch); err != nil {
+		s.mu.Lock()
+		s.restorePending(batch)
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// update 在写锁内修改数据，然后立即写入存储
+func (s *DataStore) update(fn func() error) error {
+	s.mu.Lock()
+	err := fn()
+	s.mu.Unlock()
 	if err != nil {
 		return err
 	}
+	return s.Flush()
+}
+
+// takePending 取出等待写入的变更，复制当前数据（调用方需持有写锁）
+func (s *DataStore) takePending() *Batch {
+	batch := &Batch{}
+	if s.pending.password {
+		hash := s.passwordHash
+		batch.PasswordHash = &hash
+	}
+	if s.pending.sessions {
+		sessions := s.sessions.copy()
+		batch.Sessions = &sessions
+	}
+	for id := range s.pending.cookies {
+		if cookie, exists := s.cookies[id]; exists {
+			batch.Cookies = append(batch.Cookies, copyCookie(cookie))
+		} else {
+			batch.DeletedCookies = append(batch.DeletedCookies, id)
+		}
+	}
+	for id := range s.pending.apiKeys {
+		if key, exists := s.apiKeys[id]; exists {
+			batch.APIKeys = append(batch.APIKeys, key.copy())
+		}
+	}
 
-	return os.WriteFile(s.dataFile, data, 0644)
+	s.pending.password = false
+	s.pending.sessions = false
+	clear(s.pending.cookies)
+	clear(s.pending.apiKeys)
+	return batch
+}
+
+// restorePending 写入失败后重新标记为待写入（调用方需持有写锁）
+func (s *DataStore) restorePending(batch *Batch) {
+	if batch.PasswordHash != nil {
+		s.pending.password = true
+	}
+	if batch.Sessions != nil {
+		s.pending.sessions = true
+	}
+	for _, cookie := range batch.Cookies {
+		s.pending.cookies[cookie.ID] = true
+	}
+	for _, id := range batch.DeletedCookies {
+		s.pending.cookies[id] = true
+	}
+	for _, key := range batch.APIKeys {
+		s.pending.apiKeys[key.ID] = true
+	}
+}
+
+// cookieChanged 标记Cookie待写入（调用方需持有写锁）
+func (s *DataStore) cookieChanged(id string) {
+	s.pending.cookies[id] = true
+}
+
+// apiKeyChanged 标记API密钥待写入（调用方需持有写锁）
+func (s *DataStore) apiKeyChanged(id string) {
+	s.pending.apiKeys[id] = true
 }
 
 // GetPasswordHash 获取密码哈希
 func (s *DataStore) GetPasswordHash() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.data.PasswordHash
+	return s.passwordHash
 }
 
 // SetPasswordHash 设置密码哈希
 func (s *DataStore) SetPasswordHash(hash string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.data.PasswordHash = hash
-	return s.save()
+	return s.update(func() error {
+		s.passwordHash = hash
+		s.pending.password = true
+		return nil
+	})
+}
+
+// GetSessionState 获取管理会话的注销状态
+func (s *DataStore) GetSessionState() SessionState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sessions.copy()
 }
 
-// GetAPIKey 获取API密钥
+// SetSessionState 保存管理会话的注销状态
+func (s *DataStore) SetSessionState(state SessionState) error {
+	return s.update(func() error {
+		s.sessions = state.copy()
+		s.pending.sessions = true
+		return nil
+	})
+}
+
+// GetAPIKey 获取默认API密钥（初始设置的密钥）的脱敏显示，未设置时为空
 func (s *DataStore) GetAPIKey() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.data.APIKey
+	if info, ok := s.apiKeys[DefaultAPIKeyID]; ok && info.RevokedAt == nil {
+		return info.Hint
+	}
+	return ""
 }
 
-// SetAPIKey 设置API密钥
+// SetAPIKey 设置默认API密钥（替换之前的默认密钥，保留用量）
 func (s *DataStore) SetAPIKey(key string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.data.APIKey = key
-	return s.save()
+	return s.update(func() error {
+		info := &APIKeyInfo{ID: DefaultAPIKeyID, Name: DefaultAPIKeyID}
+		if old, ok := s.apiKeys[DefaultAPIKeyID]; ok {
+			info.CreatedAt = old.CreatedAt
+			info.Usage = old.Usage
+		}
+		s.putAPIKey(info, key)
+		return nil
+	})
 }
 
 // AddCookie 添加Cookie
 func (s *DataStore) AddCookie(cookie *CookieInfo) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.cookies[cookie.ID] = cookie
-	if cookie.Enabled {
-		s.enabledList = append(s.enabledList, cookie.ID)
-	}
-
-	return s.save()
+	return s.update(func() error {
+		s.cookies[cookie.ID] = cookie
+		if cookie.Enabled {
+			s.enabledList = append(s.enabledList, cookie.ID)
+			s.notifyAvailable()
+		}
+		s.cookieChanged(cookie.ID)
+		return nil
+	})
 }
 
 // UpdateCookie 更新Cookie
 func (s *DataStore) UpdateCookie(id string, updates map[string]interface{}) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.update(func() error {
+		s.updateCookie(id, updates)
+		return nil
+	})
+}
 
+// updateCookie 更新Cookie字段（调用方需持有写锁）
+func (s *DataStore) updateCookie(id string, updates map[string]interface{}) {
 	cookie, exists := s.cookies[id]
 	if !exists {
-		return nil
+		return
 	}
 
 	// 更新字段
@@ -173,75 +375,86 @@ func (s *DataStore) UpdateCookie(id string, updates map[string]interface{}) erro
 	if enabled, ok := updates["enabled"].(bool); ok {
 		oldEnabled := cookie.Enabled
 		cookie.Enabled = enabled
-		
+
 		// 更新启用列表
 		if enabled && !oldEnabled {
 			s.enabledList = append(s.enabledList, id)
+			// 重新启用时恢复健康状态
+			s.health(cookie).reset()
+			s.notifyAvailable()
 		} else if !enabled && oldEnabled {
 			s.removeFromEnabledList(id)
 		}
 	}
+	if weight, ok := updates["weight"].(int); ok {
+		cookie.Weight = weight
+	}
 	if cookieStr, ok := updates["cookie"].(string); ok {
 		cookie.Cookie = cookieStr
+		// 更换Cookie后恢复健康状态
+		s.health(cookie).reset()
+		s.notifyAvailable()
 	}
 
-	return s.save()
+	s.cookieChanged(id)
 }
 
 // DeleteCookie 删除Cookie
 func (s *DataStore) DeleteCookie(id string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if cookie, exists := s.cookies[id]; exists {
-		if cookie.Enabled {
-			s.removeFromEnabledList(id)
+	return s.update(func() error {
+		if cookie, exists := s.cookies[id]; exists {
+			if cookie.Enabled {
+				s.removeFromEnabledList(id)
+			}
+			delete(s.cookies, id)
+			s.cookieChanged(id)
 		}
-		delete(s.cookies, id)
-	}
-
-	return s.save()
+		return nil
+	})
 }
 
-// GetNextCookie 获取下一个可用的Cookie（轮询）
+// GetNextCookie 按选择策略获取下一个可用的Cookie
+// 返回的Cookie占用一个并发名额，使用完毕后需调用ReleaseCookie
 func (s *DataStore) GetNextCookie() *CookieInfo {
+	return s.GetNextCookieExcluding(nil)
+}
+
+// GetNextCookieExcluding 按选择策略获取下一个可用的Cookie，跳过exclude中的Cookie
+// 返回的Cookie占用一个并发名额，使用完毕后需调用ReleaseCookie
+func (s *DataStore) GetNextCookieExcluding(exclude map[string]bool) *CookieInfo {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if len(s.enabledList) == 0 {
+	cookie := s.selectCookie(s.candidates(exclude))
+	if cookie == nil {
 		return nil
 	}
 
-	id := s.enabledList[s.currentIndex]
-	s.currentIndex = (s.currentIndex + 1) % len(s.enabledList)
-
-	cookie := s.cookies[id]
-	cookie.RequestCount++
-	cookie.LastUsedAt = time.Now()
-
-	// 异步保存，避免阻塞
-	go func() {
-		s.mu.Lock()
-		defer s.mu.Unlock()
-		s.save()
-	}()
-
+	s.markUsed(cookie)
 	return cookie
 }
 
-// RecordError 记录错误
-func (s *DataStore) RecordError(id string) {
+// UseCookie 使用指定的Cookie（会话亲和），Cookie不存在、不可用或并发已满时返回nil
+// 返回的Cookie占用一个并发名额，使用完毕后需调用ReleaseCookie
+func (s *DataStore) UseCookie(id string) *CookieInfo {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if cookie, exists := s.cookies[id]; exists {
-		cookie.ErrorCount++
-		go func() {
-			s.mu.Lock()
-			defer s.mu.Unlock()
-			s.save()
-		}()
+	cookie, exists := s.cookies[id]
+	if !exists || !cookie.IsAvailable() || !s.hasCapacity(cookie) {
+		return nil
 	}
+
+	s.markUsed(cookie)
+	return cookie
+}
+
+// markUsed 记录Cookie使用并占用一个并发名额（调用方需持有写锁）
+func (s *DataStore) markUsed(cookie *CookieInfo) {
+	cookie.RequestCount++
+	cookie.LastUsedAt = time.Now()
+	s.inFlight[cookie.ID]++
+	s.cookieChanged(cookie.ID)
 }
 
 // ListCookies 获取所有Cookie列表
@@ -256,6 +469,32 @@ func (s *DataStore) ListCookies() []*CookieInfo {
 	return result
 }
 
+// CookieSnapshots 获取所有Cookie的副本（包括用量和健康状态），可在不持有锁的情况下读取
+func (s *DataStore) CookieSnapshots() []CookieInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]CookieInfo, 0, len(s.cookies))
+	for _, c := range s.cookies {
+		result = append(result, *copyCookie(c))
+	}
+	return result
+}
+
+// copyCookie 复制Cookie（包括用量和健康状态）
+func copyCookie(c *CookieInfo) *CookieInfo {
+	snapshot := *c
+	if c.Usage != nil {
+		usage := *c.Usage
+		snapshot.Usage = &usage
+	}
+	if c.Health != nil {
+		health := *c.Health
+		snapshot.Health = &health
+	}
+	return &snapshot
+}
+
 // GetCookie 获取指定Cookie
 func (s *DataStore) GetCookie(id string) *CookieInfo {
 	s.mu.RLock()
@@ -271,4 +510,4 @@ func (s *DataStore) removeFromEnabledList(id string) {
 			break
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,207 @@
+package models
+
+import (
+	"time"
+)
+
+// Cookie健康状态
+const (
+	HealthHealthy     = "healthy"      // 正常，可分配
+	HealthCoolingDown = "cooling_down" // 连续失败或被限流，冷却中
+	HealthQuarantined = "quarantined"  // 认证失败，隔离中
+	HealthDead        = "dead"         // 多次认证失败，需要人工更新Cookie
+)
+
+// FailureKind 失败类型
+type FailureKind string
+
+const (
+	FailureTransient FailureKind = "transient"  // 网络错误、上游5xx等临时错误
+	FailureRateLimit FailureKind = "rate_limit" // 429/402，限流或额度不足
+	FailureAuth      FailureKind = "auth"       // 401/403或没有活动会话，Cookie可能已失效
+)
+
+// CookieHealth Cookie健康状态
+type CookieHealth struct {
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"` // 连续失败次数
+	AuthFailures        int       `json:"auth_failures"`        // 连续认证失败次数
+	CooldownUntil       time.Time `json:"cooldown_until"`       // 冷却/隔离结束时间，之后进行半开探测
+	LastError           string    `json:"last_error,omitempty"`
+	LastFailureAt       time.Time `json:"last_failure_at"`
+	probing             bool      // 半开探测进行中
+}
+
+// HealthPolicy 熔断策略
+type HealthPolicy struct {
+	FailureThreshold int           // 连续临时失败达到该次数后进入冷却
+	BaseCooldown     time.Duration // 基础冷却时间，之后每次失败翻倍
+	MaxCooldown      time.Duration // 最长冷却时间
+	DeadAfter        int           // 连续认证失败达到该次数后标记为dead
+}
+
+// DefaultHealthPolicy 默认熔断策略
+func DefaultHealthPolicy() HealthPolicy {
+	return HealthPolicy{
+		FailureThreshold: 3,
+		BaseCooldown:     30 * time.Second,
+		MaxCooldown:      30 * time.Minute,
+		DeadAfter:        5,
+	}
+}
+
+// IsAvailable 是否可以分配给请求
+func (c *CookieInfo) IsAvailable() bool {
+	return c.Enabled && (c.Health == nil || c.Health.State == HealthHealthy)
+}
+
+// recordFailure 按策略更新健康状态
+func (h *CookieHealth) recordFailure(policy HealthPolicy, kind FailureKind, message string, now time.Time) {
+	h.ConsecutiveFailures++
+	h.LastError = message
+	h.LastFailureAt = now
+
+	switch kind {
+	case FailureAuth:
+		h.AuthFailures++
+		if policy.DeadAfter > 0 && h.AuthFailures >= policy.DeadAfter {
+			h.State = HealthDead
+			h.CooldownUntil = time.Time{}
+			return
+		}
+		h.State = HealthQuarantined
+		h.CooldownUntil = now.Add(policy.cooldown(h.AuthFailures + 1))
+	case FailureRateLimit:
+		h.State = HealthCoolingDown
+		h.CooldownUntil = now.Add(policy.cooldown(h.ConsecutiveFailures))
+	default:
+		h.AuthFailures = 0
+		if h.ConsecutiveFailures < policy.FailureThreshold && h.State == HealthHealthy {
+			return
+		}
+		h.State = HealthCoolingDown
+		h.CooldownUntil = now.Add(policy.cooldown(h.ConsecutiveFailures - policy.FailureThreshold + 1))
+	}
+}
+
+// reset 恢复为健康状态
+func (h *CookieHealth) reset() {
+	*h = CookieHealth{State: HealthHealthy}
+}
+
+// cooldown 第n次冷却的时长（指数退避）
+func (p HealthPolicy) cooldown(n int) time.Duration {
+	if n < 1 {
+		n = 1
+	}
+	d := p.BaseCooldown
+	for i := 1; i < n && d < p.MaxCooldown; i++ {
+		d *= 2
+	}
+	if p.MaxCooldown > 0 && d > p.MaxCooldown {
+		d = p.MaxCooldown
+	}
+	return d
+}
+
+// SetHealthPolicy 设置熔断策略
+func (s *DataStore) SetHealthPolicy(policy HealthPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthPolicy = policy
+}
+
+// RecordFailure 记录Cookie失败并更新健康状态
+func (s *DataStore) RecordFailure(id string, kind FailureKind, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cookie, exists := s.cookies[id]
+	if !exists {
+		return
+	}
+
+	cookie.ErrorCount++
+	s.health(cookie).recordFailure(s.healthPolicy, kind, message, time.Now())
+	s.cookieChanged(id)
+}
+
+// RecordSuccess 记录Cookie成功，连续失败计数清零
+func (s *DataStore) RecordSuccess(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cookie, exists := s.cookies[id]
+	if !exists || cookie.Health == nil || (cookie.Health.State == HealthHealthy && cookie.Health.ConsecutiveFailures == 0) {
+		return
+	}
+
+	cookie.Health.reset()
+	s.notifyAvailable()
+	s.cookieChanged(id)
+}
+
+// ResetHealth 人工恢复Cookie健康状态（更新Cookie或重新启用时）
+func (s *DataStore) ResetHealth(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cookie, exists := s.cookies[id]; exists {
+		s.health(cookie).reset()
+		s.notifyAvailable()
+		s.cookieChanged(id)
+	}
+}
+
+// ProbeCandidates 返回冷却/隔离已到期、需要半开探测的Cookie，并标记为探测中
+func (s *DataStore) ProbeCandidates() []*CookieInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var result []*CookieInfo
+	for _, cookie := range s.cookies {
+		h := cookie.Health
+		if !cookie.Enabled || h == nil || h.probing {
+			continue
+		}
+		if h.State != HealthCoolingDown && h.State != HealthQuarantined {
+			continue
+		}
+		if now.Before(h.CooldownUntil) {
+			continue
+		}
+		h.probing = true
+		result = append(result, cookie)
+	}
+	return result
+}
+
+// FinishProbe 记录半开探测结果：成功则重新启用，失败则继续冷却（退避时间翻倍）
+func (s *DataStore) FinishProbe(id string, kind FailureKind, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cookie, exists := s.cookies[id]
+	if !exists || cookie.Health == nil {
+		return
+	}
+
+	h := cookie.Health
+	h.probing = false
+	if err == nil {
+		h.reset()
+		s.notifyAvailable()
+	} else {
+		h.recordFailure(s.healthPolicy, kind, err.Error(), time.Now())
+	}
+	s.cookieChanged(id)
+}
+
+// health 获取Cookie健康状态，不存在时初始化（调用方需持有写锁）
+func (s *DataStore) health(cookie *CookieInfo) *CookieHealth {
+	if cookie.Health == nil {
+		cookie.Health = &CookieHealth{State: HealthHealthy}
+	}
+	return cookie.Health
+}
@@ -0,0 +1,182 @@
+package models_test
+
+import (
+	"cto2api/models"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newCookieStore 创建数据存储并添加给定ID的启用Cookie
+func newCookieStore(t *testing.T, ids ...string) *models.DataStore {
+	t.Helper()
+
+	store, _ := openTestStore(t, filepath.Join(t.TempDir(), "test.db"))
+	t.Cleanup(func() { store.Close() })
+	for _, id := range ids {
+		cookie := &models.CookieInfo{ID: id, Name: id, Cookie: "__client=" + id, Enabled: true, CreatedAt: time.Now()}
+		if err := store.AddCookie(cookie); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestCookieBreakerTransitions(t *testing.T) {
+	store := newCookieStore(t, "c1")
+	store.SetHealthPolicy(models.HealthPolicy{
+		FailureThreshold: 3,
+		BaseCooldown:     time.Minute,
+		MaxCooldown:      4 * time.Minute,
+		DeadAfter:        3,
+	})
+
+	// kind为空表示请求成功
+	steps := []struct {
+		name     string
+		kind     models.FailureKind
+		state    string
+		cooldown time.Duration // 0表示没有冷却
+	}{
+		{"first transient failure", models.FailureTransient, models.HealthHealthy, 0},
+		{"second transient failure", models.FailureTransient, models.HealthHealthy, 0},
+		{"threshold reached", models.FailureTransient, models.HealthCoolingDown, time.Minute},
+		{"cooling down backs off", models.FailureTransient, models.HealthCoolingDown, 2 * time.Minute},
+		{"success resets", "", models.HealthHealthy, 0},
+		{"rate limit cools down at once", models.FailureRateLimit, models.HealthCoolingDown, time.Minute},
+		{"success after rate limit", "", models.HealthHealthy, 0},
+		{"auth failure quarantines", models.FailureAuth, models.HealthQuarantined, 2 * time.Minute},
+		{"repeated auth failure backs off", models.FailureAuth, models.HealthQuarantined, 4 * time.Minute},
+		{"auth failures reach dead", models.FailureAuth, models.HealthDead, 0},
+	}
+
+	for _, step := range steps {
+		start := time.Now()
+		if step.kind == "" {
+			store.RecordSuccess("c1")
+		} else {
+			store.RecordFailure("c1", step.kind, step.name)
+		}
+
+		cookie := store.GetCookie("c1")
+		h := cookie.Health
+		if h == nil || h.State != step.state {
+			t.Fatalf("%s: health = %+v, want state %s", step.name, h, step.state)
+		}
+		if step.cooldown == 0 {
+			if !h.CooldownUntil.IsZero() {
+				t.Errorf("%s: cooldown until %v, want none", step.name, h.CooldownUntil)
+			}
+		} else if d := h.CooldownUntil.Sub(start); d < step.cooldown || d > step.cooldown+time.Second {
+			t.Errorf("%s: cooldown = %v, want %v", step.name, d, step.cooldown)
+		}
+		if cookie.IsAvailable() != (step.state == models.HealthHealthy) {
+			t.Errorf("%s: available = %v in state %s", step.name, cookie.IsAvailable(), step.state)
+		}
+	}
+
+	// dead的Cookie不参与半开探测，只能人工恢复
+	if candidates := store.ProbeCandidates(); len(candidates) != 0 {
+		t.Errorf("probe candidates = %d, want dead cookie skipped", len(candidates))
+	}
+	store.ResetHealth("c1")
+	if h := store.GetCookie("c1").Health; h.State != models.HealthHealthy || h.ConsecutiveFailures != 0 || h.AuthFailures != 0 {
+		t.Errorf("health after reset = %+v", h)
+	}
+}
+
+func TestCookieHalfOpenProbe(t *testing.T) {
+	// 冷却时间为0，失败后立即可以探测
+	store := newCookieStore(t, "c1", "c2")
+	store.SetHealthPolicy(models.HealthPolicy{FailureThreshold: 1, DeadAfter: 5})
+
+	store.RecordFailure("c1", models.FailureAuth, "session expired")
+	if cookie := store.GetNextCookie(); cookie == nil || cookie.ID != "c2" {
+		t.Fatalf("next cookie = %+v, want c2 while c1 is quarantined", cookie)
+	} else {
+		store.ReleaseCookie(cookie.ID)
+	}
+
+	// 冷却未到期的Cookie不探测
+	store.SetHealthPolicy(models.HealthPolicy{FailureThreshold: 1, BaseCooldown: time.Hour, MaxCooldown: time.Hour, DeadAfter: 5})
+	store.RecordFailure("c2", models.FailureRateLimit, "429")
+
+	candidates := store.ProbeCandidates()
+	if len(candidates) != 1 || candidates[0].ID != "c1" {
+		t.Fatalf("probe candidates = %+v, want only c1", candidates)
+	}
+	// 探测进行中时不会被重复选出
+	if again := store.ProbeCandidates(); len(again) != 0 {
+		t.Errorf("probe candidates while probing = %d, want 0", len(again))
+	}
+
+	// 探测失败：继续隔离并清除探测标记
+	store.SetHealthPolicy(models.HealthPolicy{FailureThreshold: 1, DeadAfter: 5})
+	store.FinishProbe("c1", models.FailureAuth, errors.New("still expired"))
+	if h := store.GetCookie("c1").Health; h.State != models.HealthQuarantined || h.AuthFailures != 2 || h.LastError != "still expired" {
+		t.Errorf("health after failed probe = %+v", h)
+	}
+	candidates = store.ProbeCandidates()
+	if len(candidates) != 1 || candidates[0].ID != "c1" {
+		t.Fatalf("probe candidates after failed probe = %+v, want c1 again", candidates)
+	}
+
+	// 探测成功：恢复为健康并重新参与轮询
+	store.FinishProbe("c1", "", nil)
+	if h := store.GetCookie("c1").Health; h.State != models.HealthHealthy || h.ConsecutiveFailures != 0 {
+		t.Errorf("health after successful probe = %+v", h)
+	}
+	if again := store.ProbeCandidates(); len(again) != 0 {
+		t.Errorf("probe candidates after recovery = %d, want 0", len(again))
+	}
+	if cookie := store.GetNextCookie(); cookie == nil || cookie.ID != "c1" {
+		t.Errorf("next cookie = %+v, want recovered c1", cookie)
+	}
+}
+
+// TestCookieAvailableSignals Cookie重新变为可分配时唤醒排队的请求
+func TestCookieAvailableSignals(t *testing.T) {
+	store := newCookieStore(t, "c1")
+	store.SetHealthPolicy(models.HealthPolicy{FailureThreshold: 1, DeadAfter: 5})
+
+	steps := []struct {
+		name   string
+		change func()
+	}{
+		{"probe recovery", func() {
+			store.RecordFailure("c1", models.FailureAuth, "session expired")
+			store.ProbeCandidates()
+			store.FinishProbe("c1", "", nil)
+		}},
+		{"success after failure", func() {
+			store.RecordFailure("c1", models.FailureRateLimit, "429")
+			store.RecordSuccess("c1")
+		}},
+		{"manual reset", func() { store.ResetHealth("c1") }},
+		{"new cookie", func() {
+			cookie := &models.CookieInfo{ID: "c2", Name: "c2", Cookie: "__client=c2", Enabled: true, CreatedAt: time.Now()}
+			if err := store.AddCookie(cookie); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"re-enable", func() {
+			if err := store.UpdateCookie("c2", map[string]interface{}{"enabled": false}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.UpdateCookie("c2", map[string]interface{}{"enabled": true}); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+
+	for _, step := range steps {
+		available := store.CookieAvailable()
+		step.change()
+		select {
+		case <-available:
+		default:
+			t.Errorf("%s: waiting channel not closed", step.name)
+		}
+	}
+}
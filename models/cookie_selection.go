@@ -0,0 +1,213 @@
+package models
+
+import (
+	"math/rand"
+)
+
+// Cookie选择策略
+const (
+	StrategyRoundRobin    = "round_robin"     // 按启用顺序轮询
+	StrategyWeighted      = "weighted"        // 按Cookie权重随机
+	StrategyLeastInFlight = "least_in_flight" // 进行中请求最少的优先
+	StrategyMostCredits   = "most_credits"    // 剩余额度最多的优先
+	StrategyRandom        = "random"          // 随机
+)
+
+// normalizeStrategy 未知策略回退为轮询
+func normalizeStrategy(strategy string) string {
+	switch strategy {
+	case StrategyRoundRobin, StrategyWeighted, StrategyLeastInFlight, StrategyMostCredits, StrategyRandom:
+		return strategy
+	default:
+		return StrategyRoundRobin
+	}
+}
+
+// RemainingCredits 剩余额度，用量未知时返回-1
+func (c *CookieInfo) RemainingCredits() int {
+	if c.Usage == nil || c.Usage.TaskCreditsLimit <= 0 {
+		return -1
+	}
+	remaining := c.Usage.TaskCreditsLimit - c.Usage.TaskCreditsUsage
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// concurrencyLimit 并发上限，用量未知时返回0（不限制）
+func (c *CookieInfo) concurrencyLimit() int {
+	if c.Usage == nil {
+		return 0
+	}
+	return c.Usage.TaskConcurrencyLimit
+}
+
+// selectionWeight 选择权重，未设置时为1
+func (c *CookieInfo) selectionWeight() int {
+	if c.Weight <= 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+// SetSelectionStrategy 设置Cookie选择策略
+func (s *DataStore) SetSelectionStrategy(strategy string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.strategy = normalizeStrategy(strategy)
+}
+
+// ReleaseCookie 请求结束，释放Cookie的一个并发占用
+func (s *DataStore) ReleaseCookie(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.notifyAvailable()
+
+	if s.inFlight[id] <= 1 {
+		delete(s.inFlight, id)
+		return
+	}
+	s.inFlight[id]--
+}
+
+// CookieAvailable 返回在Cookie可能变为可分配时关闭的通道：
+// 释放并发占用、熔断恢复、新增或重新启用Cookie、用量更新（并发上限可能变化）
+func (s *DataStore) CookieAvailable() <-chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.available
+}
+
+// notifyAvailable 唤醒等待CookieAvailable的请求（调用方需持有写锁）
+func (s *DataStore) notifyAvailable() {
+	close(s.available)
+	s.available = make(chan struct{})
+}
+
+// InFlight 获取Cookie当前进行中的请求数
+func (s *DataStore) InFlight(id string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.inFlight[id]
+}
+
+// AllAtCapacity 是否有可用的Cookie但都已达到并发上限
+func (s *DataStore) AllAtCapacity() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	available := false
+	for _, id := range s.enabledList {
+		cookie := s.cookies[id]
+		if !cookie.IsAvailable() {
+			continue
+		}
+		if s.hasCapacity(cookie) {
+			return false
+		}
+		available = true
+	}
+	return available
+}
+
+// HasAvailableCookie 除exclude外是否还有可用的Cookie（不论是否达到并发上限）
+func (s *DataStore) HasAvailableCookie(exclude map[string]bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, id := range s.enabledList {
+		if !exclude[id] && s.cookies[id].IsAvailable() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCapacity Cookie是否还能接受新请求（调用方需持有锁）
+func (s *DataStore) hasCapacity(cookie *CookieInfo) bool {
+	limit := cookie.concurrencyLimit()
+	return limit <= 0 || s.inFlight[cookie.ID] < limit
+}
+
+// candidates 可分配的Cookie，从轮询位置开始排列（调用方需持有写锁）
+func (s *DataStore) candidates(exclude map[string]bool) []*CookieInfo {
+	n := len(s.enabledList)
+	if n == 0 {
+		return nil
+	}
+	if s.currentIndex >= n {
+		s.currentIndex = 0
+	}
+
+	result := make([]*CookieInfo, 0, n)
+	for i := 0; i < n; i++ {
+		id := s.enabledList[(s.currentIndex+i)%n]
+		cookie := s.cookies[id]
+		if exclude[id] || !cookie.IsAvailable() || !s.hasCapacity(cookie) {
+			continue
+		}
+		result = append(result, cookie)
+	}
+	return result
+}
+
+// selectCookie 按策略从候选中选择一个Cookie，并推进轮询位置（调用方需持有写锁）
+func (s *DataStore) selectCookie(candidates []*CookieInfo) *CookieInfo {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var chosen *CookieInfo
+	switch s.strategy {
+	case StrategyWeighted:
+		chosen = pickWeighted(candidates)
+	case StrategyLeastInFlight:
+		chosen = pickBest(candidates, func(c *CookieInfo) int { return -s.inFlight[c.ID] })
+	case StrategyMostCredits:
+		chosen = pickBest(candidates, (*CookieInfo).RemainingCredits)
+	case StrategyRandom:
+		chosen = candidates[rand.Intn(len(candidates))]
+	default:
+		chosen = candidates[0]
+	}
+
+	// 下一次从被选中Cookie的后一个开始，保证同分时轮流分配
+	for i, id := range s.enabledList {
+		if id == chosen.ID {
+			s.currentIndex = (i + 1) % len(s.enabledList)
+			break
+		}
+	}
+	return chosen
+}
+
+// pickBest 选择得分最高的Cookie，同分时取排在前面的
+func pickBest(candidates []*CookieInfo, score func(*CookieInfo) int) *CookieInfo {
+	best := candidates[0]
+	bestScore := score(best)
+	for _, c := range candidates[1:] {
+		if s := score(c); s > bestScore {
+			best, bestScore = c, s
+		}
+	}
+	return best
+}
+
+// pickWeighted 按权重随机选择Cookie
+func pickWeighted(candidates []*CookieInfo) *CookieInfo {
+	total := 0
+	for _, c := range candidates {
+		total += c.selectionWeight()
+	}
+
+	n := rand.Intn(total)
+	for _, c := range candidates {
+		n -= c.selectionWeight()
+		if n < 0 {
+			return c
+		}
+	}
+	return candidates[len(candidates)-1]
+}
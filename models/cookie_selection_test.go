@@ -0,0 +1,164 @@
+package models_test
+
+import (
+	"cto2api/models"
+	"testing"
+)
+
+// nextIDs 连续获取n次Cookie并立即释放，返回选中的ID
+func nextIDs(t *testing.T, store *models.DataStore, n int) []string {
+	t.Helper()
+
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		cookie := store.GetNextCookie()
+		if cookie == nil {
+			t.Fatalf("selection %d: no cookie available", i)
+		}
+		store.ReleaseCookie(cookie.ID)
+		ids = append(ids, cookie.ID)
+	}
+	return ids
+}
+
+func TestCookieSelectionRoundRobin(t *testing.T) {
+	// 未知策略回退为轮询
+	for _, strategy := range []string{models.StrategyRoundRobin, "unknown"} {
+		store := newCookieStore(t, "c1", "c2", "c3")
+		store.SetSelectionStrategy(strategy)
+
+		got := nextIDs(t, store, 4)
+		want := []string{"c1", "c2", "c3", "c1"}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: selections = %v, want %v", strategy, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestCookieSelectionLeastInFlight(t *testing.T) {
+	store := newCookieStore(t, "c1", "c2", "c3")
+	store.SetSelectionStrategy(models.StrategyLeastInFlight)
+
+	// 占用c1和c2后，c3进行中的请求最少
+	for _, want := range []string{"c1", "c2", "c3"} {
+		if cookie := store.GetNextCookie(); cookie == nil || cookie.ID != want {
+			t.Fatalf("next cookie = %+v, want %s", cookie, want)
+		}
+	}
+	store.ReleaseCookie("c2")
+	if cookie := store.GetNextCookie(); cookie == nil || cookie.ID != "c2" {
+		t.Errorf("next cookie = %+v, want c2 with no requests in flight", cookie)
+	}
+	if n := store.InFlight("c1"); n != 1 {
+		t.Errorf("c1 in flight = %d, want 1", n)
+	}
+}
+
+func TestCookieSelectionMostCredits(t *testing.T) {
+	store := newCookieStore(t, "c1", "c2", "c3")
+	store.SetSelectionStrategy(models.StrategyMostCredits)
+	store.SetUsage("c1", &models.UsageInfo{TaskCreditsUsage: 90, TaskCreditsLimit: 100})
+	store.SetUsage("c2", &models.UsageInfo{TaskCreditsUsage: 20, TaskCreditsLimit: 100})
+
+	// 用量未知的c3排在最后
+	for i, id := range nextIDs(t, store, 3) {
+		if id != "c2" {
+			t.Errorf("selection %d = %s, want c2 with the most remaining credits", i, id)
+		}
+	}
+	if remaining := store.GetCookie("c3").RemainingCredits(); remaining != -1 {
+		t.Errorf("remaining credits without usage = %d, want -1", remaining)
+	}
+}
+
+func TestCookieSelectionWeighted(t *testing.T) {
+	store := newCookieStore(t, "c1", "c2")
+	store.SetSelectionStrategy(models.StrategyWeighted)
+	if err := store.UpdateCookie("c2", map[string]interface{}{"weight": 1000}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := make(map[string]int)
+	for _, id := range nextIDs(t, store, 200) {
+		counts[id]++
+	}
+	if counts["c2"] < 180 {
+		t.Errorf("selections = %v, want c2 (weight 1000) to dominate c1 (default weight 1)", counts)
+	}
+}
+
+func TestCookieSelectionSkipsUnavailable(t *testing.T) {
+	for _, strategy := range []string{models.StrategyRoundRobin, models.StrategyWeighted, models.StrategyLeastInFlight, models.StrategyMostCredits, models.StrategyRandom} {
+		store := newCookieStore(t, "c1", "c2", "c3")
+		store.SetSelectionStrategy(strategy)
+		store.RecordFailure("c2", models.FailureAuth, "session expired")
+		if err := store.UpdateCookie("c3", map[string]interface{}{"enabled": false}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, id := range nextIDs(t, store, 20) {
+			if id != "c1" {
+				t.Errorf("%s: selected unavailable cookie %s", strategy, id)
+				break
+			}
+		}
+	}
+}
+
+func TestCookieCapacity(t *testing.T) {
+	store := newCookieStore(t, "c1", "c2")
+	for _, id := range []string{"c1", "c2"} {
+		store.SetUsage(id, &models.UsageInfo{TaskConcurrencyLimit: 1})
+	}
+
+	first, second := store.GetNextCookie(), store.GetNextCookie()
+	if first == nil || second == nil || first.ID == second.ID {
+		t.Fatalf("selections = %+v, %+v, want both cookies", first, second)
+	}
+	if cookie := store.GetNextCookie(); cookie != nil {
+		t.Errorf("next cookie = %s, want none while all are at capacity", cookie.ID)
+	}
+	if !store.AllAtCapacity() {
+		t.Error("AllAtCapacity = false with every cookie busy")
+	}
+	// 达到并发上限的Cookie仍然可用，排队的请求应继续等待
+	if !store.HasAvailableCookie(nil) {
+		t.Error("HasAvailableCookie = false with every cookie busy")
+	}
+	if store.HasAvailableCookie(map[string]bool{"c1": true, "c2": true}) {
+		t.Error("HasAvailableCookie = true with every cookie excluded")
+	}
+
+	// 释放时关闭当前通道唤醒等待者，之后的等待使用新通道
+	available := store.CookieAvailable()
+	store.ReleaseCookie(first.ID)
+	select {
+	case <-available:
+	default:
+		t.Error("release did not close the waiting channel")
+	}
+	select {
+	case <-store.CookieAvailable():
+		t.Error("channel after release is already closed")
+	default:
+	}
+	if store.AllAtCapacity() {
+		t.Error("AllAtCapacity = true after a release")
+	}
+	if cookie := store.GetNextCookie(); cookie == nil || cookie.ID != first.ID {
+		t.Errorf("next cookie = %+v, want released %s", cookie, first.ID)
+	}
+
+	// 没有可用的Cookie时不是“已满”，而是无Cookie可用
+	store.RecordFailure("c1", models.FailureAuth, "session expired")
+	store.RecordFailure("c2", models.FailureAuth, "session expired")
+	if store.AllAtCapacity() {
+		t.Error("AllAtCapacity = true with no available cookies")
+	}
+	if store.HasAvailableCookie(nil) {
+		t.Error("HasAvailableCookie = true with no available cookies")
+	}
+}
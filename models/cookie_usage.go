@@ -0,0 +1,70 @@
+package models
+
+import (
+	"time"
+)
+
+// UsageTimeLayout 用量更新时间格式
+const UsageTimeLayout = "2006-01-02 15:04:05"
+
+// PoolUsage Cookie池用量汇总（字段名与上游billing接口保持一致）
+type PoolUsage struct {
+	Cookies              int    `json:"cookies"`              // 启用的Cookie数
+	ReportingCookies     int    `json:"reportingCookies"`     // 已获取到用量的Cookie数
+	TaskCreditsUsage     int    `json:"taskCreditsUsage"`     // 已使用额度合计
+	TaskCreditsLimit     int    `json:"taskCreditsLimit"`     // 额度上限合计
+	RemainingCredits     int    `json:"remainingCredits"`     // 剩余额度合计
+	TaskConcurrencyUsage int    `json:"taskConcurrencyUsage"` // 上游报告的并发使用合计
+	TaskConcurrencyLimit int    `json:"taskConcurrencyLimit"` // 并发上限合计
+	InFlight             int    `json:"inFlight"`             // 本地进行中的请求数
+	ConcurrencyHeadroom  int    `json:"concurrencyHeadroom"`  // 剩余可用并发（上限减去本地进行中的请求）
+	LastUpdate           string `json:"lastUpdate,omitempty"` // 最近一次用量更新时间
+}
+
+// SetUsage 更新Cookie的最后已知用量并保存
+func (s *DataStore) SetUsage(id string, usage *UsageInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cookie, exists := s.cookies[id]; exists {
+		cookie.Usage = usage
+		s.notifyAvailable()
+		s.cookieChanged(id)
+	}
+}
+
+// PoolUsage 汇总所有启用Cookie的最后已知用量
+func (s *DataStore) PoolUsage() *PoolUsage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	pool := &PoolUsage{}
+	var latest time.Time
+	for _, id := range s.enabledList {
+		cookie := s.cookies[id]
+		pool.Cookies++
+		pool.InFlight += s.inFlight[id]
+
+		usage := cookie.Usage
+		if usage == nil {
+			continue
+		}
+		pool.ReportingCookies++
+		pool.TaskCreditsUsage += usage.TaskCreditsUsage
+		pool.TaskCreditsLimit += usage.TaskCreditsLimit
+		if remaining := cookie.RemainingCredits(); remaining > 0 {
+			pool.RemainingCredits += remaining
+		}
+		pool.TaskConcurrencyUsage += usage.TaskConcurrencyUsage
+		pool.TaskConcurrencyLimit += usage.TaskConcurrencyLimit
+		if cookie.IsAvailable() && usage.TaskConcurrencyLimit > s.inFlight[id] {
+			pool.ConcurrencyHeadroom += usage.TaskConcurrencyLimit - s.inFlight[id]
+		}
+
+		if t, err := time.ParseInLocation(UsageTimeLayout, usage.LastUpdate, time.Local); err == nil && t.After(latest) {
+			latest = t
+			pool.LastUpdate = usage.LastUpdate
+		}
+	}
+	return pool
+}
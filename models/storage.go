@@ -0,0 +1,105 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrHistoryBodyNotFound 请求记录的内容不存在（未记录或已过期删除）
+var ErrHistoryBodyNotFound = errors.New("请求记录内容不存在")
+
+// Storage 数据持久化后端
+// DataStore在内存中保存全部数据和索引，变更按批次通过Apply写入，每个批次是一个事务
+type Storage interface {
+	// Load 读取全部数据，没有数据时返回空的AppData
+	Load() (*AppData, error)
+	// Apply 在一个事务中写入变更
+	Apply(batch *Batch) error
+	Close() error
+}
+
+// Batch 一次写入的变更
+type Batch struct {
+	PasswordHash   *string       // 为nil表示不修改
+	Cookies        []*CookieInfo // 新增或更新的Cookie
+	DeletedCookies []string
+	APIKeys        []*APIKeyInfo // 新增或更新的API密钥
+	Sessions       *SessionState // 为nil表示不修改
+}
+
+// empty 是否没有任何变更
+func (b *Batch) empty() bool {
+	return b.PasswordHash == nil && len(b.Cookies) == 0 && len(b.DeletedCookies) == 0 && len(b.APIKeys) == 0 && b.Sessions == nil
+}
+
+// HistoryStorage 请求记录的持久化，元数据和内容由调用方编码
+type HistoryStorage interface {
+	// AppendHistory 保存一条记录，Body为空表示没有内容
+	AppendHistory(rec *HistoryRecord) error
+	// ScanHistory 按时间顺序遍历所有记录的元数据（不读取内容，只设置HasBody），rec只在fn内有效
+	ScanHistory(fn func(rec *HistoryRecord) error) error
+	// HistoryBody 读取一条记录的内容，内容不存在时返回ErrHistoryBodyNotFound
+	HistoryBody(id string, t time.Time) ([]byte, error)
+	// PruneHistory 删除before之前的记录和bodiesBefore之前的内容，零值表示不删除
+	PruneHistory(before, bodiesBefore time.Time) error
+}
+
+// HistoryRecord 一条请求记录
+type HistoryRecord struct {
+	ID      string
+	Time    time.Time
+	Meta    []byte
+	Body    []byte
+	HasBody bool
+}
+
+// ImportJSONFile 存储中还没有任何数据时从旧版data.json导入，返回是否导入
+// 旧版的明文API密钥导入为哈希后的默认密钥；导入后保留原文件
+func ImportJSONFile(storage Storage, path string) (bool, error) {
+	current, err := storage.Load()
+	if err != nil {
+		return false, err
+	}
+	if current.PasswordHash != "" || len(current.Cookies) > 0 || len(current.APIKeys) > 0 {
+		return false, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var data AppData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return false, err
+	}
+
+	if data.APIKey != "" && !hasAPIKey(data.APIKeys, DefaultAPIKeyID) {
+		info := &APIKeyInfo{ID: DefaultAPIKeyID, Name: DefaultAPIKeyID, CreatedAt: time.Now()}
+		info.setKey(data.APIKey)
+		data.APIKeys = append(data.APIKeys, info)
+	}
+
+	batch := &Batch{Cookies: data.Cookies, APIKeys: data.APIKeys, Sessions: data.Sessions}
+	if data.PasswordHash != "" {
+		batch.PasswordHash = &data.PasswordHash
+	}
+	if batch.empty() {
+		return false, nil
+	}
+	return true, storage.Apply(batch)
+}
+
+// hasAPIKey 列表中是否有指定ID的密钥
+func hasAPIKey(keys []*APIKeyInfo, id string) bool {
+	for _, k := range keys {
+		if k.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,230 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bbolt中的bucket
+var (
+	bucketSettings      = []byte("settings")
+	bucketCookies       = []byte("cookies")
+	bucketAPIKeys       = []byte("api_keys")
+	bucketHistory       = []byte("history")        // 请求记录元数据，键为 时间(纳秒,大端序)+ID
+	bucketHistoryBodies = []byte("history_bodies") // 请求记录内容，键与元数据相同
+)
+
+// settings中的键
+var (
+	keyPasswordHash = []byte("password_hash")
+	keySessions     = []byte("sessions")
+)
+
+// BoltStorage 基于bbolt的嵌入式事务存储（单文件，同一时间只能被一个进程打开）
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+// OpenBoltStorage 打开或创建数据库文件
+func OpenBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketSettings, bucketCookies, bucketAPIKeys, bucketHistory, bucketHistoryBodies} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStorage{db: db}, nil
+}
+
+// Load 读取全部数据，Cookie按创建时间排序
+func (b *BoltStorage) Load() (*AppData, error) {
+	data := &AppData{Cookies: []*CookieInfo{}, APIKeys: []*APIKeyInfo{}}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		settings := tx.Bucket(bucketSettings)
+		data.PasswordHash = string(settings.Get(keyPasswordHash))
+		if raw := settings.Get(keySessions); raw != nil {
+			data.Sessions = &SessionState{}
+			if err := json.Unmarshal(raw, data.Sessions); err != nil {
+				return err
+			}
+		}
+
+		err := tx.Bucket(bucketCookies).ForEach(func(_, v []byte) error {
+			var cookie CookieInfo
+			if err := json.Unmarshal(v, &cookie); err != nil {
+				return err
+			}
+			data.Cookies = append(data.Cookies, &cookie)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(bucketAPIKeys).ForEach(func(_, v []byte) error {
+			var key APIKeyInfo
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			data.APIKeys = append(data.APIKeys, &key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(data.Cookies, func(i, j int) bool { return data.Cookies[i].CreatedAt.Before(data.Cookies[j].CreatedAt) })
+	return data, nil
+}
+
+// Apply 在一个事务中写入变更
+func (b *BoltStorage) Apply(batch *Batch) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if batch.PasswordHash != nil {
+			if err := tx.Bucket(bucketSettings).Put(keyPasswordHash, []byte(*batch.PasswordHash)); err != nil {
+				return err
+			}
+		}
+		if batch.Sessions != nil {
+			if err := putJSON(tx.Bucket(bucketSettings), string(keySessions), batch.Sessions); err != nil {
+				return err
+			}
+		}
+
+		cookies := tx.Bucket(bucketCookies)
+		for _, cookie := range batch.Cookies {
+			if err := putJSON(cookies, cookie.ID, cookie); err != nil {
+				return err
+			}
+		}
+		for _, id := range batch.DeletedCookies {
+			if err := cookies.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+
+		keys := tx.Bucket(bucketAPIKeys)
+		for _, key := range batch.APIKeys {
+			if err := putJSON(keys, key.ID, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close 关闭数据库
+func (b *BoltStorage) Close() error {
+	return b.db.Close()
+}
+
+// AppendHistory 保存一条请求记录（并发写入合并为一个事务）
+func (b *BoltStorage) AppendHistory(rec *HistoryRecord) error {
+	key := historyKey(rec.ID, rec.Time)
+	return b.db.Batch(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketHistory).Put(key, rec.Meta); err != nil {
+			return err
+		}
+		if len(rec.Body) == 0 {
+			return nil
+		}
+		return tx.Bucket(bucketHistoryBodies).Put(key, rec.Body)
+	})
+}
+
+// ScanHistory 按时间顺序遍历所有记录的元数据
+func (b *BoltStorage) ScanHistory(fn func(rec *HistoryRecord) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		bodies := tx.Bucket(bucketHistoryBodies)
+		return tx.Bucket(bucketHistory).ForEach(func(k, v []byte) error {
+			if len(k) < 8 {
+				return nil
+			}
+			rec := &HistoryRecord{
+				ID:      string(k[8:]),
+				Time:    time.Unix(0, int64(binary.BigEndian.Uint64(k[:8]))),
+				Meta:    v,
+				HasBody: bodies.Get(k) != nil,
+			}
+			return fn(rec)
+		})
+	})
+}
+
+// HistoryBody 读取一条请求记录的内容
+func (b *BoltStorage) HistoryBody(id string, t time.Time) ([]byte, error) {
+	var body []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketHistoryBodies).Get(historyKey(id, t))
+		if v == nil {
+			return ErrHistoryBodyNotFound
+		}
+		// 返回的切片只在事务内有效
+		body = append([]byte(nil), v...)
+		return nil
+	})
+	return body, err
+}
+
+// PruneHistory 删除过期的请求记录和内容
+func (b *BoltStorage) PruneHistory(before, bodiesBefore time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if !bodiesBefore.IsZero() {
+			if err := deleteBefore(tx.Bucket(bucketHistoryBodies), bodiesBefore); err != nil {
+				return err
+			}
+		}
+		if !before.IsZero() {
+			if err := deleteBefore(tx.Bucket(bucketHistory), before); err != nil {
+				return err
+			}
+			return deleteBefore(tx.Bucket(bucketHistoryBodies), before)
+		}
+		return nil
+	})
+}
+
+// historyKey 请求记录的键，按时间排序
+func historyKey(id string, t time.Time) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return append(key, id...)
+}
+
+// deleteBefore 删除键中时间早于cutoff的记录
+func deleteBefore(bucket *bolt.Bucket, cutoff time.Time) error {
+	limit := historyKey("", cutoff)
+	c := bucket.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putJSON 以JSON保存一个值
+func putJSON(bucket *bolt.Bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
@@ -0,0 +1,134 @@
+package models_test
+
+import (
+	"cto2api/models"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestStore 打开数据库并创建数据存储
+func openTestStore(t *testing.T, path string) (*models.DataStore, models.Storage) {
+	t.Helper()
+
+	storage, err := models.OpenBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := models.NewDataStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, storage
+}
+
+func TestImportJSONFile(t *testing.T) {
+	dir := t.TempDir()
+	dataFile := filepath.Join(dir, "data.json")
+	legacy := `{
+  "password_hash": "bcrypt-hash",
+  "api_key": "sk-legacy-plaintext",
+  "cookies": [
+    {"id": "c1", "name": "first", "cookie": "__client=a", "enabled": true, "request_count": 7, "created_at": "2024-01-01T00:00:00Z"},
+    {"id": "c2", "name": "second", "cookie": "__client=b", "enabled": false, "created_at": "2024-01-02T00:00:00Z"}
+  ],
+  "sessions": {"gen": 2, "revoked": {"abc": "2099-01-01T00:00:00Z"}}
+}`
+	if err := os.WriteFile(dataFile, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := models.OpenBoltStorage(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	imported, err := models.ImportJSONFile(storage, dataFile)
+	if err != nil || !imported {
+		t.Fatalf("import = %v, %v", imported, err)
+	}
+	// 已有数据时不再导入
+	if imported, err := models.ImportJSONFile(storage, dataFile); err != nil || imported {
+		t.Fatalf("second import = %v, %v, want skipped", imported, err)
+	}
+
+	store, err := models.NewDataStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.GetPasswordHash() != "bcrypt-hash" {
+		t.Errorf("password hash = %q", store.GetPasswordHash())
+	}
+	if c := store.GetCookie("c1"); c == nil || c.RequestCount != 7 || !c.Enabled {
+		t.Errorf("cookie c1 = %+v", c)
+	}
+	if len(store.ListCookies()) != 2 {
+		t.Errorf("cookies = %d, want 2", len(store.ListCookies()))
+	}
+	// 会话注销状态一起导入
+	if sessions := store.GetSessionState(); sessions.Gen != 2 || len(sessions.Revoked) != 1 {
+		t.Errorf("sessions = %+v", sessions)
+	}
+
+	// 旧版明文密钥导入为哈希
+	key, err := store.LookupAPIKey("sk-legacy-plaintext")
+	if err != nil || key.ID != models.DefaultAPIKeyID {
+		t.Fatalf("lookup legacy key = %+v, %v", key, err)
+	}
+	data, err := storage.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.APIKey != "" || data.APIKeys[0].KeyHash != models.HashAPIKey("sk-legacy-plaintext") {
+		t.Errorf("stored keys = %+v (legacy %q)", data.APIKeys, data.APIKey)
+	}
+}
+
+func TestDataStoreBatchesCounters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	store, storage := openTestStore(t, path)
+
+	for _, id := range []string{"c1", "c2"} {
+		cookie := &models.CookieInfo{ID: id, Name: id, Cookie: "__client=" + id, Enabled: true, CreatedAt: time.Now()}
+		if err := store.AddCookie(cookie); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.DeleteCookie("c2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 计数只在批量写入时保存
+	for i := 0; i < 3; i++ {
+		cookie := store.GetNextCookie()
+		if cookie == nil {
+			t.Fatal("no cookie available")
+		}
+		store.ReleaseCookie(cookie.ID)
+	}
+	store.RecordFailure("c1", models.FailureTransient, "timeout")
+	data, err := storage.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Cookies) != 1 || data.Cookies[0].RequestCount != 0 {
+		t.Fatalf("stored before flush = %+v, want c1 without counters", data.Cookies)
+	}
+
+	// 关闭时写入剩余的变更
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, _ = openTestStore(t, path)
+	defer store.Close()
+	cookies := store.ListCookies()
+	if len(cookies) != 1 || cookies[0].ID != "c1" {
+		t.Fatalf("cookies = %+v, want only c1", cookies)
+	}
+	if c := cookies[0]; c.RequestCount != 3 || c.ErrorCount != 1 || c.Health == nil || c.Health.ConsecutiveFailures != 1 {
+		t.Errorf("counters after reopen = %+v (health %+v)", c, c.Health)
+	}
+}
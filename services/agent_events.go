@@ -0,0 +1,142 @@
+package services
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// 代理事件类型
+const (
+	AgentEventText      = "text"      // 回复文本增量（chat缓冲）
+	AgentEventReasoning = "reasoning" // 思考过程增量（thinking/reasoning缓冲）
+	AgentEventActivity  = "activity"  // 其他代理活动（文件修改、命令执行等），Raw为原始缓冲
+	AgentEventDone      = "done"      // 回复结束
+	AgentEventError     = "error"     // 流出错，Content为错误信息
+)
+
+// AgentEvent 从上游缓冲解析出的代理事件
+type AgentEvent struct {
+	Type      string          `json:"type"`
+	Kind      string          `json:"kind,omitempty"`       // 上游缓冲类型，如 chat、thinking
+	MessageID string          `json:"message_id,omitempty"` // 上游消息ID
+	Content   string          `json:"content,omitempty"`    // 文本/思考的新增内容，活动事件为缓冲中的content字段
+	Raw       json.RawMessage `json:"raw,omitempty"`        // 上游原始缓冲
+}
+
+// isReasoningKind 是否是思考过程缓冲
+func isReasoningKind(kind string) bool {
+	return kind == "thinking" || kind == "reasoning"
+}
+
+// agentEvents 将解析后的帧转换为代理事件，文本和思考过程分别组装增量
+type agentEvents struct {
+	text          *StreamAssembler
+	reasoning     *StreamAssembler
+	reasoningKind string // 最近的思考过程缓冲类型，用于标注flush输出的事件
+}
+
+func newAgentEvents() *agentEvents {
+	return &agentEvents{text: NewStreamAssembler(), reasoning: NewStreamAssembler()}
+}
+
+// convert 转换一个update帧
+func (a *agentEvents) convert(frame streamFrame) *AgentEvent {
+	event := &AgentEvent{Kind: frame.kind, MessageID: frame.messageID, Raw: frame.raw}
+	switch {
+	case frame.kind == "chat":
+		event.Type = AgentEventText
+		event.Content = a.text.Feed(frame.messageID, frame.content)
+	case isReasoningKind(frame.kind):
+		event.Type = AgentEventReasoning
+		event.Content = a.reasoning.Feed(frame.messageID, frame.content)
+		a.reasoningKind = frame.kind
+	default:
+		event.Type = AgentEventActivity
+		event.Content = frame.content
+	}
+	return event
+}
+
+// flush 流结束时输出组装器暂存的文本和思考过程
+func (a *agentEvents) flush() []*AgentEvent {
+	var events []*AgentEvent
+	if content := a.reasoning.Flush(); content != "" {
+		events = append(events, &AgentEvent{Type: AgentEventReasoning, Kind: a.reasoningKind, Content: content})
+	}
+	if content := a.text.Flush(); content != "" {
+		events = append(events, &AgentEvent{Type: AgentEventText, Kind: "chat", Content: content})
+	}
+	return events
+}
+
+// ChatEvent 带聊天信息的代理事件，用于事件订阅
+type ChatEvent struct {
+	ChatID   string    `json:"chat_id"`
+	CookieID string    `json:"cookie_id"`
+	APIKeyID string    `json:"api_key_id,omitempty"` // 发起该聊天的API密钥ID
+	Time     time.Time `json:"time"`
+	AgentEvent
+}
+
+// EventFilter 订阅条件，为空的字段不过滤
+type EventFilter struct {
+	ChatID   string
+	APIKeyID string // 只接收该API密钥发起的聊天的事件
+}
+
+// match 事件是否符合订阅条件
+func (f EventFilter) match(event ChatEvent) bool {
+	return (f.ChatID == "" || f.ChatID == event.ChatID) && (f.APIKeyID == "" || f.APIKeyID == event.APIKeyID)
+}
+
+// eventBufferSize 每个订阅者的事件缓冲，订阅者处理不过来时丢弃新事件
+const eventBufferSize = 256
+
+// EventHub 将所有进行中聊天的代理事件广播给订阅者（如管理面板）
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan ChatEvent]EventFilter // 订阅者 -> 订阅条件
+}
+
+// NewEventHub 创建事件广播器
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[chan ChatEvent]EventFilter)}
+}
+
+// Subscribe 订阅符合条件的事件，条件为空时订阅所有聊天。返回的函数用于取消订阅
+func (h *EventHub) Subscribe(filter EventFilter) (<-chan ChatEvent, func()) {
+	ch := make(chan ChatEvent, eventBufferSize)
+
+	h.mu.Lock()
+	h.subscribers[ch] = filter
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subscribers, ch)
+			h.mu.Unlock()
+		})
+	}
+}
+
+// Publish 发布事件，不会阻塞
+func (h *EventHub) Publish(event ChatEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, filter := range h.subscribers {
+		if !filter.match(event) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package services_test
+
+import (
+	"context"
+	"cto2api/services"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStreamChatAgentEvents(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "streams", "agent_events.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture services.StreamFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := &services.Replay{}
+	replay.AddStream(&fixture)
+	client := services.NewCTOClient("cookie", services.Endpoints{}).UseReplay(replay)
+
+	responseChan := make(chan services.StreamResponse, 100)
+	go client.StreamChat(context.Background(), fixture.ChatID, "token", responseChan)
+
+	var reasoning, text string
+	var activities []string
+	for resp := range responseChan {
+		if resp.Error != nil {
+			t.Fatal(resp.Error)
+		}
+		if resp.Event == nil {
+			continue
+		}
+		switch resp.Event.Type {
+		case services.AgentEventReasoning:
+			reasoning += resp.Event.Content
+		case services.AgentEventText:
+			text += resp.Event.Content
+			if resp.Content != resp.Event.Content {
+				t.Errorf("Content = %q, event content = %q", resp.Content, resp.Event.Content)
+			}
+		case services.AgentEventActivity:
+			activities = append(activities, resp.Event.Kind)
+			if !json.Valid(resp.Event.Raw) {
+				t.Errorf("activity %s has invalid raw buffer %q", resp.Event.Kind, resp.Event.Raw)
+			}
+		}
+		if resp.Event.Type != services.AgentEventText && resp.Content != "" {
+			t.Errorf("%s event leaked into reply text: %q", resp.Event.Type, resp.Content)
+		}
+	}
+
+	if reasoning != "Reading the repo" {
+		t.Errorf("reasoning = %q, want %q", reasoning, "Reading the repo")
+	}
+	if text != "Fixed the nil check." {
+		t.Errorf("text = %q, want %q", text, "Fixed the nil check.")
+	}
+	if len(activities) != 2 || activities[0] != "file_edit" || activities[1] != "command" {
+		t.Errorf("activities = %v, want [file_edit command]", activities)
+	}
+}
+
+func TestEventHubFiltersByChat(t *testing.T) {
+	hub := services.NewEventHub()
+	all, unsubscribeAll := hub.Subscribe(services.EventFilter{})
+	defer unsubscribeAll()
+	one, unsubscribeOne := hub.Subscribe(services.EventFilter{ChatID: "chat-1"})
+	keyed, unsubscribeKeyed := hub.Subscribe(services.EventFilter{ChatID: "chat-2", APIKeyID: "key-a"})
+	defer unsubscribeKeyed()
+
+	hub.Publish(services.ChatEvent{ChatID: "chat-1", APIKeyID: "key-a", AgentEvent: services.AgentEvent{Type: services.AgentEventText}})
+	hub.Publish(services.ChatEvent{ChatID: "chat-2", APIKeyID: "key-b", AgentEvent: services.AgentEvent{Type: services.AgentEventText}})
+	hub.Publish(services.ChatEvent{ChatID: "chat-2", APIKeyID: "key-a", AgentEvent: services.AgentEvent{Type: services.AgentEventDone}})
+
+	if len(all) != 3 {
+		t.Errorf("unfiltered subscriber got %d events, want 3", len(all))
+	}
+	if len(one) != 1 || (<-one).ChatID != "chat-1" {
+		t.Error("filtered subscriber did not get exactly the chat-1 event")
+	}
+	// 其他API密钥发起的同一chatID的事件不推送
+	if len(keyed) != 1 || (<-keyed).Type != services.AgentEventDone {
+		t.Error("key-filtered subscriber did not get exactly key-a's chat-2 event")
+	}
+
+	unsubscribeOne()
+	hub.Publish(services.ChatEvent{ChatID: "chat-1"})
+	if len(one) != 0 {
+		t.Error("unsubscribed channel still receives events")
+	}
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Conversation 已创建的上游会话
+type Conversation struct {
+	ChatID    string    // 上游chatHistoryId
+	CookieID  string    // 创建该会话的Cookie
+	OwnerKey  string    // 创建该会话的API密钥ID，只有该密钥可以续接
+	Adapter   string    // 创建该会话的上游适配器，换模型时不续接
+	UpdatedAt time.Time // 最近一次使用时间
+}
+
+// defaultConversationTTL 默认的会话亲和有效期
+const defaultConversationTTL = time.Hour
+
+// ConversationStore 会话亲和性存储：对话前缀指纹 -> 上游会话
+type ConversationStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	entries  map[string]*Conversation
+	lastScan time.Time
+}
+
+// NewConversationStore 创建会话存储，ttl<=0时使用默认有效期
+func NewConversationStore(ttl time.Duration) *ConversationStore {
+	if ttl <= 0 {
+		ttl = defaultConversationTTL
+	}
+	return &ConversationStore{
+		ttl:     ttl,
+		entries: make(map[string]*Conversation),
+	}
+}
+
+// Lookup 根据对话前缀指纹查找owner用adapter创建的上游会话，
+// 不存在、已过期、属于其他API密钥或使用其他适配器时返回nil
+func (s *ConversationStore) Lookup(fingerprint, owner, adapter string) *Conversation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conv, ok := s.entries[fingerprint]
+	if !ok || conv.OwnerKey != owner || conv.Adapter != adapter {
+		return nil
+	}
+	if time.Since(conv.UpdatedAt) > s.ttl {
+		delete(s.entries, fingerprint)
+		return nil
+	}
+
+	result := *conv
+	return &result
+}
+
+// Remember 记录对话指纹对应的上游会话，UpdatedAt为当前时间
+func (s *ConversationStore) Remember(fingerprint string, conv Conversation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	conv.UpdatedAt = now
+	s.entries[fingerprint] = &conv
+
+	// 定期清理过期记录
+	if now.Sub(s.lastScan) > s.ttl {
+		for key, conv := range s.entries {
+			if now.Sub(conv.UpdatedAt) > s.ttl {
+				delete(s.entries, key)
+			}
+		}
+		s.lastScan = now
+	}
+}
+
+// Forget 删除对话指纹对应的记录
+func (s *ConversationStore) Forget(fingerprint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, fingerprint)
+}
+
+// FingerprintMessages 计算对话消息序列的指纹
+func FingerprintMessages(messages []PromptMessage) string {
+	h := sha256.New()
+	for _, m := range messages {
+		h.Write([]byte(m.Role))
+		h.Write([]byte{0})
+		h.Write([]byte(m.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(strings.TrimSpace(m.Content)))
+		h.Write([]byte{0x1e})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,71 @@
+package services_test
+
+import (
+	"cto2api/services"
+	"testing"
+	"time"
+)
+
+func TestConversationStoreLookup(t *testing.T) {
+	store := services.NewConversationStore(time.Hour)
+	history := []services.PromptMessage{
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "hello"},
+	}
+	fingerprint := services.FingerprintMessages(history)
+	store.Remember(fingerprint, services.Conversation{ChatID: "chat-1", CookieID: "cookie-a", OwnerKey: "key-a", Adapter: "GPT5"})
+
+	conv := store.Lookup(fingerprint, "key-a", "GPT5")
+	if conv == nil || conv.ChatID != "chat-1" || conv.CookieID != "cookie-a" {
+		t.Fatalf("lookup = %+v, want chat-1 on cookie-a", conv)
+	}
+
+	// 其他API密钥或其他适配器不能续接
+	if conv := store.Lookup(fingerprint, "key-b", "GPT5"); conv != nil {
+		t.Errorf("lookup with another key = %+v, want miss", conv)
+	}
+	if conv := store.Lookup(fingerprint, "key-a", "ClaudeSonnet4_5"); conv != nil {
+		t.Errorf("lookup with another adapter = %+v, want miss", conv)
+	}
+
+	// 首尾空白不影响指纹，内容、角色或名称不同则不匹配
+	same := []services.PromptMessage{{Role: "user", Content: " hi\n"}, {Role: "assistant", Content: "hello"}}
+	if services.FingerprintMessages(same) != fingerprint {
+		t.Error("fingerprint should ignore surrounding whitespace")
+	}
+	for _, other := range [][]services.PromptMessage{
+		{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "hello!"}},
+		{{Role: "system", Content: "hi"}, {Role: "assistant", Content: "hello"}},
+		{{Role: "user", Name: "bob", Content: "hi"}, {Role: "assistant", Content: "hello"}},
+		history[:1],
+	} {
+		if conv := store.Lookup(services.FingerprintMessages(other), "key-a", "GPT5"); conv != nil {
+			t.Errorf("lookup %+v = %+v, want miss", other, conv)
+		}
+	}
+
+	store.Forget(fingerprint)
+	if conv := store.Lookup(fingerprint, "key-a", "GPT5"); conv != nil {
+		t.Errorf("lookup after forget = %+v", conv)
+	}
+}
+
+func TestConversationStoreExpiry(t *testing.T) {
+	store := services.NewConversationStore(20 * time.Millisecond)
+	store.Remember("fp", services.Conversation{ChatID: "chat-1", CookieID: "cookie-a"})
+	if store.Lookup("fp", "", "") == nil {
+		t.Fatal("fresh conversation not found")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if conv := store.Lookup("fp", "", ""); conv != nil {
+		t.Errorf("expired conversation returned: %+v", conv)
+	}
+
+	// 有效期不为正数时使用默认值，而不是立即过期
+	store = services.NewConversationStore(0)
+	store.Remember("fp", services.Conversation{ChatID: "chat-1", CookieID: "cookie-a"})
+	if store.Lookup("fp", "", "") == nil {
+		t.Error("conversation with a zero TTL expired at once")
+	}
+}
@@ -2,10 +2,13 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,27 +20,125 @@ type ClerkInfo struct {
 	UserID    string
 }
 
+// Endpoints 上游地址，可指向测试镜像、录制回放服务或本地模拟服务
+type Endpoints struct {
+	ClerkBaseURL      string // Clerk认证服务，如 https://clerk.cto.new
+	APIBaseURL        string // 聊天和用量API，如 https://api.enginelabs.ai
+	StreamBaseURL     string // WebSocket流式输出，如 wss://api.enginelabs.ai
+	ClerkAPIVersion   string // __clerk_api_version 参数
+	ClerkJSVersion    string // _clerk_js_version 参数
+	ClerkJWTJSVersion string // 获取JWT时的 _clerk_js_version 参数，tokens接口沿用旧版本号
+}
+
+// DefaultEndpoints cto.new 官方地址
+func DefaultEndpoints() Endpoints {
+	return Endpoints{
+		ClerkBaseURL:      "https://clerk.cto.new",
+		APIBaseURL:        "https://api.enginelabs.ai",
+		StreamBaseURL:     "wss://api.enginelabs.ai",
+		ClerkAPIVersion:   "2025-04-10",
+		ClerkJSVersion:    "5.102.0",
+		ClerkJWTJSVersion: "5.101.1",
+	}
+}
+
+// withDefaults 未设置的字段使用官方地址，并去掉末尾的斜杠
+func (e Endpoints) withDefaults() Endpoints {
+	d := DefaultEndpoints()
+	pick := func(v, def string) string {
+		if v == "" {
+			return def
+		}
+		return strings.TrimRight(v, "/")
+	}
+	return Endpoints{
+		ClerkBaseURL:      pick(e.ClerkBaseURL, d.ClerkBaseURL),
+		APIBaseURL:        pick(e.APIBaseURL, d.APIBaseURL),
+		StreamBaseURL:     pick(e.StreamBaseURL, d.StreamBaseURL),
+		ClerkAPIVersion:   pick(e.ClerkAPIVersion, d.ClerkAPIVersion),
+		ClerkJSVersion:    pick(e.ClerkJSVersion, d.ClerkJSVersion),
+		ClerkJWTJSVersion: pick(e.ClerkJWTJSVersion, d.ClerkJWTJSVersion),
+	}
+}
+
+// clerkQuery Clerk请求附带的版本参数，jsVersion为该接口使用的 _clerk_js_version
+func (e Endpoints) clerkQuery(jsVersion string) string {
+	return "__clerk_api_version=" + url.QueryEscape(e.ClerkAPIVersion) + "&_clerk_js_version=" + url.QueryEscape(jsVersion)
+}
+
+// frameConn WebSocket帧来源（真实连接或回放）
+type frameConn interface {
+	ReadMessage() (int, []byte, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
 // CTOClient CTO.NEW客户端
 type CTOClient struct {
-	cookie string
-	client *http.Client
+	cookie     string
+	endpoints  Endpoints
+	client     *http.Client
+	tokens     *TokenCache
+	recorder   *Recorder // 非nil时录制上游交互
+	dialStream func(ctx context.Context, wsURL string, headers http.Header) (frameConn, error)
+	timings    CallTimings
+}
+
+// CallTimings 客户端各阶段上游调用的累计耗时（认证命中缓存时为0）
+type CallTimings struct {
+	Clerk      time.Duration
+	JWT        time.Duration
+	CreateChat time.Duration
+}
+
+// Timings 返回该客户端上游调用的累计耗时
+func (c *CTOClient) Timings() CallTimings {
+	return c.timings
+}
+
+// track 开始计时，返回的函数把耗时累加到d
+func track(d *time.Duration) func() {
+	start := time.Now()
+	return func() { *d += time.Since(start) }
 }
 
-// NewCTOClient 创建客户端
-func NewCTOClient(cookie string) *CTOClient {
-	return &CTOClient{
-		cookie: cookie,
+// NewCTOClient 创建客户端，设置了录制器（SetRecorder）时录制上游交互
+func NewCTOClient(cookie string, endpoints Endpoints) *CTOClient {
+	c := &CTOClient{
+		cookie:    cookie,
+		endpoints: endpoints.withDefaults(),
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 		},
+		tokens:     sharedTokenCache,
+		recorder:   currentRecorder(),
+		dialStream: dialWebSocket,
+	}
+	if c.recorder != nil {
+		c.client.Transport = c.recorder.RoundTripper(nil)
+	}
+	return c
+}
+
+// dialWebSocket 建立真实的WebSocket连接
+func dialWebSocket(ctx context.Context, wsURL string, headers http.Header) (frameConn, error) {
+	dialer := websocket.Dialer{
+		HandshakeTimeout: 30 * time.Second,
+	}
+
+	conn, _, err := dialer.DialContext(ctx, wsURL, headers)
+	if err != nil {
+		return nil, err
 	}
+	return conn, nil
 }
 
 // GetClerkInfo 获取Clerk会话信息
-func (c *CTOClient) GetClerkInfo() (*ClerkInfo, error) {
-	url := "https://clerk.cto.new/v1/me/organization_memberships?paginated=true&limit=10&offset=0&__clerk_api_version=2025-04-10&_clerk_js_version=5.102.0"
+func (c *CTOClient) GetClerkInfo(ctx context.Context) (*ClerkInfo, error) {
+	defer track(&c.timings.Clerk)()
+	url := c.endpoints.ClerkBaseURL + "/v1/me/organization_memberships?paginated=true&limit=10&offset=0&" + c.endpoints.clerkQuery(c.endpoints.ClerkJSVersion)
 	
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -53,7 +154,7 @@ func (c *CTOClient) GetClerkInfo() (*ClerkInfo, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("clerk API返回错误: %d", resp.StatusCode)
+		return nil, &UpstreamError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("clerk API返回错误: %d", resp.StatusCode)}
 	}
 
 	var result map[string]interface{}
@@ -70,7 +171,7 @@ func (c *CTOClient) GetClerkInfo() (*ClerkInfo, error) {
 	
 	sessions, _ := client["sessions"].([]interface{})
 	if len(sessions) == 0 {
-		return nil, fmt.Errorf("没有活动会话")
+		return nil, ErrNoSession
 	}
 	
 	session, _ := sessions[0].(map[string]interface{})
@@ -84,10 +185,11 @@ func (c *CTOClient) GetClerkInfo() (*ClerkInfo, error) {
 }
 
 // GetJWT 获取JWT token
-func (c *CTOClient) GetJWT(sessionID string) (string, error) {
-	url := fmt.Sprintf("https://clerk.cto.new/v1/client/sessions/%s/tokens?__clerk_api_version=2025-04-10&_clerk_js_version=5.101.1", sessionID)
+func (c *CTOClient) GetJWT(ctx context.Context, sessionID string) (string, error) {
+	defer track(&c.timings.JWT)()
+	url := fmt.Sprintf("%s/v1/client/sessions/%s/tokens?%s", c.endpoints.ClerkBaseURL, sessionID, c.endpoints.clerkQuery(c.endpoints.ClerkJWTJSVersion))
 	
-	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte{}))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader([]byte{}))
 	if err != nil {
 		return "", err
 	}
@@ -104,7 +206,7 @@ func (c *CTOClient) GetJWT(sessionID string) (string, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("获取JWT失败: %d", resp.StatusCode)
+		return "", &UpstreamError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("获取JWT失败: %d", resp.StatusCode)}
 	}
 
 	var result map[string]interface{}
@@ -121,8 +223,9 @@ func (c *CTOClient) GetJWT(sessionID string) (string, error) {
 }
 
 // CreateChat 创建聊天会话
-func (c *CTOClient) CreateChat(jwt, prompt, adapter, chatID string) error {
-	url := "https://api.enginelabs.ai/engine-agent/chat"
+func (c *CTOClient) CreateChat(ctx context.Context, jwt, prompt, adapter, chatID string) error {
+	defer track(&c.timings.CreateChat)()
+	url := c.endpoints.APIBaseURL + "/engine-agent/chat"
 	
 	data := map[string]interface{}{
 		"prompt":        prompt,
@@ -135,7 +238,7 @@ func (c *CTOClient) CreateChat(jwt, prompt, adapter, chatID string) error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonData))
 	if err != nil {
 		return err
 	}
@@ -157,7 +260,9 @@ func (c *CTOClient) CreateChat(jwt, prompt, adapter, chatID string) error {
 	
 	// 接受200和202状态码
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
-		return fmt.Errorf("创建聊天失败: HTTP %d, 响应: %s", resp.StatusCode, string(body))
+		err := &UpstreamError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("创建聊天失败: HTTP %d, 响应: %s", resp.StatusCode, string(body))}
+		c.invalidateOn401(err)
+		return err
 	}
 
 	return nil
@@ -168,102 +273,130 @@ type StreamResponse struct {
 	Content      string
 	Done         bool
 	Error        error
+	Event        *AgentEvent // 该帧对应的代理事件（文本、思考过程、其他活动），没有时为nil
 }
 
-// StreamChat 流式获取聊天响应
-func (c *CTOClient) StreamChat(chatID, wsUserToken string, responseChan chan<- StreamResponse) {
+// StreamChat 流式获取聊天响应，Content为新增的回复文本，Event为每个update帧解析出的代理事件
+// ctx取消（如客户端断开）时关闭WebSocket连接并立即返回；上游任务不会因此停止（没有公开的停止接口）
+func (c *CTOClient) StreamChat(ctx context.Context, chatID, wsUserToken string, responseChan chan<- StreamResponse) {
 	defer close(responseChan)
 
-	wsURL := fmt.Sprintf("wss://api.enginelabs.ai/engine-agent/chat-histories/%s/buffer/stream?token=%s", chatID, wsUserToken)
+	// 调用方可能已经停止读取，发送时同时等待ctx取消，避免goroutine阻塞
+	send := func(resp StreamResponse) bool {
+		select {
+		case responseChan <- resp:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	wsURL := fmt.Sprintf("%s/engine-agent/chat-histories/%s/buffer/stream?token=%s", c.endpoints.StreamBaseURL, chatID, wsUserToken)
 	
 	// 添加请求头
 	headers := http.Header{}
 	headers.Set("Origin", "https://cto.new")
 	headers.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
 	
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 30 * time.Second,
-	}
-	
-	conn, _, err := dialer.Dial(wsURL, headers)
+	conn, err := c.dialStream(ctx, wsURL, headers)
 	if err != nil {
-		responseChan <- StreamResponse{Error: fmt.Errorf("WebSocket连接失败: %v", err)}
+		send(StreamResponse{Error: &StreamError{Op: "dial", Err: err}})
 		return
 	}
+	if c.recorder != nil {
+		conn = &recordingConn{frameConn: conn, recorder: c.recorder, chatID: chatID}
+	}
 	defer conn.Close()
 
+	// ctx取消时关闭连接，打断阻塞中的ReadMessage
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
 	// 设置读取超时
 	conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
 
+	// 只输出真正新增的文本，流式和非流式得到相同的结果
+	events := newAgentEvents()
+	// finish 输出组装器暂存的内容后结束
+	finish := func() {
+		for _, event := range events.flush() {
+			resp := StreamResponse{Event: event}
+			if event.Type == AgentEventText {
+				resp.Content = event.Content
+			}
+			if !send(resp) {
+				return
+			}
+		}
+		send(StreamResponse{Done: true})
+	}
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
+			if ctx.Err() != nil {
+				send(StreamResponse{Error: ctx.Err()})
+				return
+			}
 			// 如果是正常关闭，不报错
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
-				responseChan <- StreamResponse{Done: true}
+				finish()
 				return
 			}
-			responseChan <- StreamResponse{Error: fmt.Errorf("读取WebSocket消息失败: %v", err)}
+			send(StreamResponse{Error: &StreamError{Op: "read", Err: err}})
 			return
 		}
 
 		// 重置读取超时
 		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
 
-		var data map[string]interface{}
-		if err := json.Unmarshal(message, &data); err != nil {
+		frame, ok := decodeFrame(message)
+		if !ok {
 			continue
 		}
-
-		// 处理更新消息
-		if data["type"] == "update" {
-			if buffer, ok := data["buffer"].(string); ok {
-				var inner map[string]interface{}
-				if err := json.Unmarshal([]byte(buffer), &inner); err != nil {
-					continue
-				}
-
-				if inner["type"] == "chat" {
-					if chat, ok := inner["chat"].(map[string]interface{}); ok {
-						if content, ok := chat["content"].(string); ok && content != "" {
-							responseChan <- StreamResponse{Content: content}
-						}
-					}
-				}
-			}
+		if frame.done {
+			finish()
+			return
 		}
-
-		// 处理状态消息
-		if data["type"] == "state" {
-			if state, ok := data["state"].(map[string]interface{}); ok {
-				if inProgress, ok := state["inProgress"].(bool); ok && !inProgress {
-					responseChan <- StreamResponse{Done: true}
-					return
-				}
-			}
+		event := events.convert(frame)
+		resp := StreamResponse{Event: event}
+		if event.Type == AgentEventText {
+			resp.Content = event.Content
+		}
+		if !send(resp) {
+			return
 		}
 	}
 }
 
 // GetFullResponse 获取完整响应（非流式）
-func (c *CTOClient) GetFullResponse(chatID, wsUserToken string) (string, error) {
+func (c *CTOClient) GetFullResponse(ctx context.Context, chatID, wsUserToken string) (string, error) {
 	responseChan := make(chan StreamResponse, 100)
-	go c.StreamChat(chatID, wsUserToken, responseChan)
+	go c.StreamChat(ctx, chatID, wsUserToken, responseChan)
 
+	// 读到通道关闭为止，返回时连接已经关闭（录制的帧已写入）
 	var fullResponse string
 	for resp := range responseChan {
 		if resp.Error != nil {
 			return "", resp.Error
 		}
-		if resp.Done {
-			break
-		}
 		fullResponse += resp.Content
 	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 
 	return fullResponse, nil
 }
 
+// ProbeCookie 重新获取Clerk会话和JWT，检查Cookie是否有效
+func (c *CTOClient) ProbeCookie(ctx context.Context) error {
+	c.tokens.Invalidate(c.cookie)
+	_, _, err := c.Authenticate(ctx)
+	return err
+}
+
 // BillingInfo 用量信息
 type BillingInfo struct {
 	Active                        bool    `json:"active"`
@@ -284,10 +417,10 @@ type BillingInfo struct {
 }
 
 // GetBillingInfo 获取用量信息
-func (c *CTOClient) GetBillingInfo(jwt string) (*BillingInfo, error) {
-	url := "https://api.enginelabs.ai/billing"
+func (c *CTOClient) GetBillingInfo(ctx context.Context, jwt string) (*BillingInfo, error) {
+	url := c.endpoints.APIBaseURL + "/billing"
 	
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -306,7 +439,9 @@ func (c *CTOClient) GetBillingInfo(jwt string) (*BillingInfo, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("获取用量信息失败: HTTP %d, 响应: %s", resp.StatusCode, string(body))
+		err := &UpstreamError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("获取用量信息失败: HTTP %d, 响应: %s", resp.StatusCode, string(body))}
+		c.invalidateOn401(err)
+		return nil, err
 	}
 
 	var billing BillingInfo
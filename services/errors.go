@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"cto2api/models"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrNoSession Cookie没有活动的Clerk会话（通常是Cookie已失效）
+var ErrNoSession = errors.New("没有活动会话")
+
+// UpstreamError 上游返回的非成功HTTP响应
+type UpstreamError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Message
+}
+
+// AuthError Clerk认证失败，Stage为失败的阶段（clerk/jwt）
+type AuthError struct {
+	Stage string
+	Err   error
+}
+
+func (e *AuthError) Error() string {
+	if e.Stage == "jwt" {
+		return "获取JWT失败: " + e.Err.Error()
+	}
+	return "获取认证信息失败: " + e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// StreamError WebSocket流失败，Op为失败的操作（dial/read）
+type StreamError struct {
+	Op  string
+	Err error
+}
+
+func (e *StreamError) Error() string {
+	if e.Op == "dial" {
+		return "WebSocket连接失败: " + e.Err.Error()
+	}
+	return "读取WebSocket消息失败: " + e.Err.Error()
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// IsTimeout 是否是超时错误（请求超时或WebSocket读取超时）
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ClassifyFailure 判断错误的失败类型，用于Cookie熔断
+func ClassifyFailure(err error) models.FailureKind {
+	if errors.Is(err, ErrNoSession) {
+		return models.FailureAuth
+	}
+
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		switch upstreamErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return models.FailureAuth
+		case http.StatusTooManyRequests, http.StatusPaymentRequired:
+			return models.FailureRateLimit
+		}
+	}
+
+	return models.FailureTransient
+}
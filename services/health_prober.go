@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"cto2api/models"
+	"log/slog"
+	"time"
+)
+
+// HealthProber 半开探测：定期检查冷却/隔离到期的Cookie，探测成功后重新加入轮询
+type HealthProber struct {
+	store     *models.DataStore
+	endpoints Endpoints
+	interval  time.Duration
+	stop      chan struct{}
+}
+
+// NewHealthProber 创建健康探测器，interval<=0时使用默认的15秒
+func NewHealthProber(store *models.DataStore, endpoints Endpoints, interval time.Duration) *HealthProber {
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	return &HealthProber{
+		store:     store,
+		endpoints: endpoints,
+		interval:  interval,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start 启动后台探测
+func (p *HealthProber) Start() {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.probeAll()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止后台探测
+func (p *HealthProber) Stop() {
+	close(p.stop)
+}
+
+// probeAll 探测所有到期的Cookie
+func (p *HealthProber) probeAll() {
+	for _, cookie := range p.store.ProbeCandidates() {
+		go p.probe(cookie.ID, cookie.Cookie)
+	}
+}
+
+// probe 探测单个Cookie并记录结果
+func (p *HealthProber) probe(id, cookie string) {
+	err := NewCTOClient(cookie, p.endpoints).ProbeCookie(context.Background())
+	if err != nil {
+		slog.Warn("Cookie探测失败", "cookie_id", id, "error", err)
+		p.store.FinishProbe(id, ClassifyFailure(err), err)
+		return
+	}
+
+	slog.Info("Cookie探测成功，恢复分配", "cookie_id", id)
+	p.store.FinishProbe(id, "", nil)
+}
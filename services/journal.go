@@ -0,0 +1,306 @@
+package services
+
+import (
+	"cto2api/models"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// journalPruneInterval 清理过期记录的间隔
+const journalPruneInterval = time.Hour
+
+// ErrJournalEntryNotFound 请求记录不存在
+var ErrJournalEntryNotFound = errors.New("请求记录不存在")
+
+// JournalOptions 请求记录配置
+type JournalOptions struct {
+	Retention     time.Duration // 元数据保留时间，0表示不删除
+	RecordBodies  bool          // 是否记录请求和响应内容
+	BodyMaxBytes  int           // 请求和响应内容各自的最大字节数，超过后截断
+	BodyRetention time.Duration // 请求和响应内容的保留时间，0表示与元数据相同
+	MaxEntries    int           // 最多保留的记录数，超过后批量删除最早的记录，0表示不限制
+}
+
+// JournalEntry 一次请求的记录
+type JournalEntry struct {
+	ID              string    `json:"id"`                          // 记录ID，由服务端生成，与响应头X-Request-ID相同
+	ClientRequestID string    `json:"client_request_id,omitempty"` // 调用方提供的X-Request-ID，只用于关联查询
+	Time            time.Time `json:"time"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	APIKeyName      string    `json:"api_key_name,omitempty"`
+	Model           string    `json:"model,omitempty"`
+	Adapter         string    `json:"adapter,omitempty"`
+	CookieID        string    `json:"cookie_id,omitempty"`
+	ChatID          string    `json:"chat_id,omitempty"`
+	Attempts        int       `json:"attempts"`
+	Stream          bool      `json:"stream"`
+	Status          int       `json:"status"`
+	Outcome         string    `json:"outcome"`
+	Error           string    `json:"error,omitempty"`
+	TotalMs         int64     `json:"total_ms"`
+	FirstTokenMs    int64     `json:"first_token_ms,omitempty"`
+	HasBody         bool      `json:"has_body"`
+
+	// 以下字段只在记录内容时存在，单独保存
+	RequestBody  string `json:"request_body,omitempty"`
+	ResponseBody string `json:"response_body,omitempty"`
+	Truncated    bool   `json:"truncated,omitempty"`
+}
+
+// JournalFilter 查询条件，空字段不过滤
+type JournalFilter struct {
+	Model    string
+	Outcome  string
+	Status   int
+	APIKey   string // API密钥名称
+	CookieID string
+	Query    string // 匹配请求ID、调用方请求ID、聊天ID或错误信息
+	Since    time.Time
+	Until    time.Time
+	Offset   int
+	Limit    int
+}
+
+// match 是否满足查询条件
+func (f *JournalFilter) match(e *JournalEntry) bool {
+	switch {
+	case f.Model != "" && e.Model != f.Model,
+		f.Outcome != "" && e.Outcome != f.Outcome,
+		f.Status != 0 && e.Status != f.Status,
+		f.APIKey != "" && e.APIKeyName != f.APIKey,
+		f.CookieID != "" && e.CookieID != f.CookieID,
+		!f.Since.IsZero() && e.Time.Before(f.Since),
+		!f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	if f.Query != "" {
+		return strings.Contains(e.ID, f.Query) || strings.Contains(e.ClientRequestID, f.Query) ||
+			strings.Contains(e.ChatID, f.Query) || strings.Contains(e.Error, f.Query)
+	}
+	return true
+}
+
+// journalBody 单独保存的请求和响应内容
+type journalBody struct {
+	RequestBody  string `json:"request_body"`
+	ResponseBody string `json:"response_body"`
+	Truncated    bool   `json:"truncated,omitempty"`
+}
+
+// Journal 请求记录：元数据和内容分别保存在存储中，元数据索引保存在内存中，内容按需读取。
+// 过期的记录和内容按保留时间删除，记录数超过MaxEntries时删除最早的记录，使索引和查询的开销有上限
+type Journal struct {
+	mu       sync.Mutex
+	history  models.HistoryStorage
+	opts     JournalOptions
+	entries  []*JournalEntry // 按时间顺序，不包含内容
+	byID     map[string]*JournalEntry
+	prunedAt time.Time // 最近一次清理的时间
+}
+
+// NewJournal 创建请求记录，清理过期记录后加载保留期内的元数据
+func NewJournal(history models.HistoryStorage, opts JournalOptions) (*Journal, error) {
+	j := &Journal{history: history, opts: opts, byID: make(map[string]*JournalEntry)}
+	if err := j.prune(time.Now()); err != nil {
+		return nil, err
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	if err := j.trim(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// RecordsBodies 是否记录请求和响应内容
+func (j *Journal) RecordsBodies() bool {
+	return j.opts.RecordBodies
+}
+
+// Record 保存一条记录，未开启内容记录时忽略内容字段
+func (j *Journal) Record(entry JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.prune(entry.Time); err != nil {
+		return err
+	}
+
+	rec := &models.HistoryRecord{ID: entry.ID, Time: entry.Time}
+	if j.opts.RecordBodies && (entry.RequestBody != "" || entry.ResponseBody != "") {
+		var body journalBody
+		body.RequestBody, body.Truncated = truncateBody(entry.RequestBody, j.opts.BodyMaxBytes)
+		var truncated bool
+		body.ResponseBody, truncated = truncateBody(entry.ResponseBody, j.opts.BodyMaxBytes)
+		body.Truncated = body.Truncated || truncated
+
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rec.Body = data
+		entry.HasBody = true
+	}
+
+	entry.RequestBody, entry.ResponseBody, entry.Truncated = "", "", false
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	rec.Meta = meta
+	if err := j.history.AppendHistory(rec); err != nil {
+		return err
+	}
+	j.add(&entry)
+	return j.trim()
+}
+
+// List 按时间倒序分页查询，返回当前页和满足条件的总数（不包含内容）
+func (j *Journal) List(filter JournalFilter) ([]JournalEntry, int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := []JournalEntry{}
+	total := 0
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		entry := j.entries[i]
+		if !filter.match(entry) {
+			continue
+		}
+		if total >= filter.Offset && (filter.Limit <= 0 || len(entries) < filter.Limit) {
+			entries = append(entries, *entry)
+		}
+		total++
+	}
+	return entries, total
+}
+
+// Get 获取一条记录，内容未过期时一并返回
+func (j *Journal) Get(id string) (*JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stored, ok := j.byID[id]
+	if !ok {
+		return nil, ErrJournalEntryNotFound
+	}
+	entry := *stored
+	if !entry.HasBody {
+		return &entry, nil
+	}
+
+	data, err := j.history.HistoryBody(entry.ID, entry.Time)
+	if errors.Is(err, models.ErrHistoryBodyNotFound) {
+		entry.HasBody = false
+		return &entry, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var body journalBody
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	entry.RequestBody = body.RequestBody
+	entry.ResponseBody = body.ResponseBody
+	entry.Truncated = body.Truncated
+	return &entry, nil
+}
+
+func (j *Journal) add(entry *JournalEntry) {
+	j.entries = append(j.entries, entry)
+	j.byID[entry.ID] = entry
+}
+
+// load 读取存储中的元数据
+func (j *Journal) load() error {
+	return j.history.ScanHistory(func(rec *models.HistoryRecord) error {
+		var entry JournalEntry
+		if err := json.Unmarshal(rec.Meta, &entry); err != nil {
+			return fmt.Errorf("读取请求记录 %s 失败: %w", rec.ID, err)
+		}
+		entry.HasBody = rec.HasBody
+		j.add(&entry)
+		return nil
+	})
+}
+
+// prune 每小时一次删除过期的记录和内容（调用方需持有锁或在初始化时调用）
+func (j *Journal) prune(now time.Time) error {
+	if now.Sub(j.prunedAt) < journalPruneInterval {
+		return nil
+	}
+
+	var before, bodiesBefore time.Time
+	if j.opts.Retention > 0 {
+		before = now.Add(-j.opts.Retention)
+	}
+	bodiesBefore = before
+	if j.opts.BodyRetention > 0 {
+		bodiesBefore = now.Add(-j.opts.BodyRetention)
+	}
+	if before.IsZero() && bodiesBefore.IsZero() {
+		return nil
+	}
+	if err := j.history.PruneHistory(before, bodiesBefore); err != nil {
+		return err
+	}
+	j.prunedAt = now
+
+	kept := j.entries[:0]
+	for _, entry := range j.entries {
+		if !before.IsZero() && entry.Time.Before(before) {
+			delete(j.byID, entry.ID)
+			continue
+		}
+		if !bodiesBefore.IsZero() && entry.Time.Before(bodiesBefore) {
+			entry.HasBody = false
+		}
+		kept = append(kept, entry)
+	}
+	j.entries = kept
+	return nil
+}
+
+// trim 记录数超过上限的十分之一后，删除最早的记录直到回到上限，避免每条记录都写一次存储
+// （调用方需持有锁或在初始化时调用）
+func (j *Journal) trim() error {
+	limit := j.opts.MaxEntries
+	if limit <= 0 || len(j.entries) <= limit+limit/10 {
+		return nil
+	}
+
+	before := j.entries[len(j.entries)-limit].Time
+	if err := j.history.PruneHistory(before, time.Time{}); err != nil {
+		return err
+	}
+	kept := j.entries[:0]
+	for _, entry := range j.entries {
+		if entry.Time.Before(before) {
+			delete(j.byID, entry.ID)
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	j.entries = kept
+	return nil
+}
+
+// truncateBody 截断到最多maxBytes字节（不拆分UTF-8字符），maxBytes<=0时不截断
+func truncateBody(s string, maxBytes int) (string, bool) {
+	if maxBytes <= 0 || len(s) <= maxBytes {
+		return s, false
+	}
+	n := maxBytes
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n], true
+}
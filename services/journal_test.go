@@ -0,0 +1,162 @@
+package services_test
+
+import (
+	"cto2api/models"
+	"cto2api/services"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestStorage 打开数据库，测试结束时关闭
+func openTestStorage(t *testing.T, path string) *models.BoltStorage {
+	t.Helper()
+
+	storage, err := models.OpenBoltStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func newTestJournal(t *testing.T, storage models.HistoryStorage) *services.Journal {
+	t.Helper()
+
+	journal, err := services.NewJournal(storage, services.JournalOptions{
+		Retention:     30 * 24 * time.Hour,
+		RecordBodies:  true,
+		BodyMaxBytes:  16,
+		BodyRetention: 7 * 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return journal
+}
+
+func TestJournalListAndGet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	storage := openTestStorage(t, path)
+	journal := newTestJournal(t, storage)
+
+	now := time.Now()
+	for i, model := range []string{"gpt-5", "claude-sonnet-4-5", "gpt-5"} {
+		entry := services.JournalEntry{
+			ID:           "req-" + string(rune('a'+i)),
+			Time:         now.Add(time.Duration(i) * time.Second),
+			Path:         "/v1/chat/completions",
+			Model:        model,
+			Status:       200,
+			Outcome:      "success",
+			RequestBody:  `{"model":"` + model + `"}`,
+			ResponseBody: "答案是四十二，没有别的",
+		}
+		if err := journal.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, total := journal.List(services.JournalFilter{Model: "gpt-5", Limit: 1})
+	if total != 2 || len(items) != 1 || items[0].ID != "req-c" {
+		t.Fatalf("list = %+v (total %d), want newest gpt-5 request req-c of 2", items, total)
+	}
+	if items[0].RequestBody != "" || !items[0].HasBody {
+		t.Errorf("list should omit bodies but mark has_body: %+v", items[0])
+	}
+	if items, _ := journal.List(services.JournalFilter{Model: "gpt-5", Offset: 1, Limit: 1}); len(items) != 1 || items[0].ID != "req-a" {
+		t.Errorf("second page = %+v, want req-a", items)
+	}
+
+	// 重新打开数据库后仍能读取元数据和内容
+	storage.Close()
+	reloaded := newTestJournal(t, openTestStorage(t, path))
+	entry, err := reloaded.Get("req-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Model != "claude-sonnet-4-5" || entry.RequestBody != `{"model":"claude` {
+		t.Errorf("entry = %+v", entry)
+	}
+	// 截断不拆分UTF-8字符
+	if !entry.Truncated || entry.ResponseBody != "答案是四十" {
+		t.Errorf("response body = %q (truncated %v), want 答案是四十", entry.ResponseBody, entry.Truncated)
+	}
+	if _, err := reloaded.Get("missing"); err != services.ErrJournalEntryNotFound {
+		t.Errorf("get missing = %v", err)
+	}
+}
+
+func TestJournalRetention(t *testing.T) {
+	storage := openTestStorage(t, filepath.Join(t.TempDir(), "test.db"))
+	journal := newTestJournal(t, storage)
+
+	now := time.Now()
+	for id, age := range map[string]time.Duration{"old": 10 * 24 * time.Hour, "expired": 40 * 24 * time.Hour} {
+		entry := services.JournalEntry{ID: id, Time: now.Add(-age), Status: 200, RequestBody: "{}"}
+		if err := journal.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 重新加载时删除超过30天的记录和超过7天的内容
+	journal = newTestJournal(t, storage)
+	if _, err := journal.Get("expired"); err != services.ErrJournalEntryNotFound {
+		t.Errorf("get expired = %v, want not found", err)
+	}
+	entry, err := journal.Get("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.HasBody || entry.RequestBody != "" {
+		t.Errorf("expired body still returned: %+v", entry)
+	}
+	if _, err := storage.HistoryBody("old", entry.Time); err != models.ErrHistoryBodyNotFound {
+		t.Errorf("body of old entry = %v, want deleted", err)
+	}
+}
+
+func TestJournalMaxEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	storage := openTestStorage(t, path)
+	opts := services.JournalOptions{MaxEntries: 10}
+	journal, err := services.NewJournal(storage, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 12; i++ {
+		entry := services.JournalEntry{
+			ID:              fmt.Sprintf("req-%02d", i),
+			ClientRequestID: fmt.Sprintf("client-%02d", i),
+			Time:            now.Add(time.Duration(i) * time.Second),
+			Status:          200,
+		}
+		if err := journal.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 超过上限的十分之一后删除最早的记录，回到上限
+	if _, total := journal.List(services.JournalFilter{}); total != 10 {
+		t.Errorf("total = %d, want 10", total)
+	}
+	if _, err := journal.Get("req-01"); err != services.ErrJournalEntryNotFound {
+		t.Errorf("get trimmed entry = %v, want not found", err)
+	}
+	items, total := journal.List(services.JournalFilter{Query: "client-11"})
+	if total != 1 || items[0].ID != "req-11" {
+		t.Errorf("query by client request ID = %+v, want req-11", items)
+	}
+
+	// 删除的记录不会在重新加载后出现
+	journal, err = services.NewJournal(storage, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, total := journal.List(services.JournalFilter{}); total != 10 {
+		t.Errorf("total after reload = %d, want 10", total)
+	}
+}
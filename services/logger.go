@@ -0,0 +1,97 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// redactedValue 脱敏后的占位值
+const redactedValue = "[REDACTED]"
+
+// LogOptions 日志配置
+type LogOptions struct {
+	Level      string // debug / info / warn / error
+	File       string // 为空时输出到标准输出
+	MaxSizeMB  int    // 单个日志文件的最大大小，超过后轮转
+	MaxBackups int    // 保留的旧日志文件数，0表示全部保留
+	MaxAgeDays int    // 旧日志文件保留天数，0表示不按时间删除
+}
+
+// redactedKeys 值总是被脱敏的属性名（小写）
+var redactedKeys = map[string]bool{
+	"cookie":        true,
+	"set-cookie":    true,
+	"authorization": true,
+	"x-api-key":     true,
+	"api_key":       true,
+	"jwt":           true,
+	"token":         true,
+}
+
+// secretPatterns 日志文本中需要脱敏的内容（上游错误信息可能包含JWT或Cookie）
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redactedValue},
+	{regexp.MustCompile(`(?i)\b(bearer\s+)[^\s"',;]+`), "${1}" + redactedValue},
+	{regexp.MustCompile(`\b(__client|__client_uat|__session)=[^;\s"',]+`), "${1}=" + redactedValue},
+}
+
+// RedactSecrets 替换文本中的JWT、Bearer token和Clerk会话Cookie
+func RedactSecrets(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// redactAttr slog.HandlerOptions.ReplaceAttr：按属性名或内容脱敏
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redactedValue)
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, RedactSecrets(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, RedactSecrets(err.Error()))
+		}
+	}
+	return a
+}
+
+// NewLogHandler 创建JSON日志处理器，自动脱敏Cookie、Authorization和JWT
+func NewLogHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr})
+}
+
+// NewLogger 按配置创建JSON日志，File非空时写入文件并按大小轮转
+func NewLogger(opts LogOptions) (*slog.Logger, error) {
+	var level slog.Level
+	if opts.Level != "" {
+		if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+			return nil, fmt.Errorf("无效的日志级别 %q", opts.Level)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if opts.File != "" {
+		w = &lumberjack.Logger{
+			Filename:   opts.File,
+			MaxSize:    opts.MaxSizeMB,
+			MaxBackups: opts.MaxBackups,
+			MaxAge:     opts.MaxAgeDays,
+			LocalTime:  true,
+		}
+	}
+	return slog.New(NewLogHandler(w, level)), nil
+}
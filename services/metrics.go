@@ -0,0 +1,175 @@
+package services
+
+import (
+	"cto2api/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace 指标名前缀
+const metricsNamespace = "cto2api"
+
+// cookieHealthStates 导出的Cookie健康状态（每个状态一条时间序列，当前状态为1）
+var cookieHealthStates = []string{models.HealthHealthy, models.HealthCoolingDown, models.HealthQuarantined, models.HealthDead}
+
+// Metrics 代理的Prometheus指标，使用独立的注册表
+type Metrics struct {
+	registry       *prometheus.Registry
+	requests       *prometheus.CounterVec
+	latency        *prometheus.HistogramVec
+	inFlight       prometheus.Gauge
+	ttft           *prometheus.HistogramVec
+	streamDuration *prometheus.HistogramVec
+}
+
+// NewMetrics 创建指标，Cookie池指标在抓取时从store读取
+func NewMetrics(store *models.DataStore) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "API请求数",
+		}, []string{"endpoint", "model", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "API请求耗时（流式请求到流结束）",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+		}, []string{"endpoint", "model", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_in_flight",
+			Help:      "进行中的API请求数",
+		}),
+		ttft: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "time_to_first_token_seconds",
+			Help:      "从收到请求到上游返回第一段文本或思考过程的时间",
+			Buckets:   []float64{0.25, 0.5, 1, 2, 3, 5, 8, 13, 20, 30, 60},
+		}, []string{"model"}),
+		streamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "stream_duration_seconds",
+			Help:      "上游WebSocket流从连接到结束的时间",
+			Buckets:   []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600},
+		}, []string{"model"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.latency, m.inFlight, m.ttft, m.streamDuration,
+		newCookieCollector(store),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// RequestStarted 请求开始
+func (m *Metrics) RequestStarted() {
+	m.inFlight.Inc()
+}
+
+// RequestFinished 请求结束，记录请求数和耗时
+func (m *Metrics) RequestFinished(endpoint, model string, status int, d time.Duration) {
+	m.inFlight.Dec()
+	code := strconv.Itoa(status)
+	m.requests.WithLabelValues(endpoint, model, code).Inc()
+	m.latency.WithLabelValues(endpoint, model, code).Observe(d.Seconds())
+}
+
+// ObserveFirstToken 记录首个token的延迟
+func (m *Metrics) ObserveFirstToken(model string, d time.Duration) {
+	m.ttft.WithLabelValues(model).Observe(d.Seconds())
+}
+
+// ObserveStream 记录上游流的持续时间
+func (m *Metrics) ObserveStream(model string, d time.Duration) {
+	m.streamDuration.WithLabelValues(model).Observe(d.Seconds())
+}
+
+// Handler Prometheus文本格式的指标输出
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// cookieCollector 抓取时读取Cookie池状态
+type cookieCollector struct {
+	store          *models.DataStore
+	requests       *prometheus.Desc
+	errors         *prometheus.Desc
+	enabled        *prometheus.Desc
+	health         *prometheus.Desc
+	inFlight       *prometheus.Desc
+	creditsUsage   *prometheus.Desc
+	creditsLimit   *prometheus.Desc
+	usageUpdated   *prometheus.Desc
+	concurrencyCap *prometheus.Desc
+}
+
+func newCookieCollector(store *models.DataStore) *cookieCollector {
+	labels := []string{"cookie_id", "cookie_name"}
+	desc := func(name, help string, extra ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "cookie", name), help, append(labels, extra...), nil)
+	}
+	return &cookieCollector{
+		store:          store,
+		requests:       desc("requests_total", "Cookie的请求次数（CookieInfo.RequestCount）"),
+		errors:         desc("errors_total", "Cookie的错误次数（CookieInfo.ErrorCount）"),
+		enabled:        desc("enabled", "Cookie是否启用"),
+		health:         desc("health_state", "Cookie健康状态，当前状态为1", "state"),
+		inFlight:       desc("in_flight", "Cookie进行中的请求数"),
+		creditsUsage:   desc("credits_usage", "最后一次轮询的已用额度"),
+		creditsLimit:   desc("credits_limit", "最后一次轮询的额度上限"),
+		usageUpdated:   desc("usage_updated_timestamp_seconds", "最后一次轮询用量的时间"),
+		concurrencyCap: desc("concurrency_limit", "最后一次轮询的并发上限"),
+	}
+}
+
+// Describe 实现prometheus.Collector
+func (c *cookieCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.requests, c.errors, c.enabled, c.health, c.inFlight, c.creditsUsage, c.creditsLimit, c.usageUpdated, c.concurrencyCap} {
+		ch <- d
+	}
+}
+
+// Collect 实现prometheus.Collector
+func (c *cookieCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, cookie := range c.store.CookieSnapshots() {
+		labels := []string{cookie.ID, cookie.Name}
+		ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(cookie.RequestCount), labels...)
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(cookie.ErrorCount), labels...)
+		ch <- prometheus.MustNewConstMetric(c.enabled, prometheus.GaugeValue, boolValue(cookie.Enabled), labels...)
+		ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(c.store.InFlight(cookie.ID)), labels...)
+
+		state := models.HealthHealthy
+		if cookie.Health != nil {
+			state = cookie.Health.State
+		}
+		for _, s := range cookieHealthStates {
+			ch <- prometheus.MustNewConstMetric(c.health, prometheus.GaugeValue, boolValue(s == state), append(labels, s)...)
+		}
+
+		if cookie.Usage == nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.creditsUsage, prometheus.GaugeValue, float64(cookie.Usage.TaskCreditsUsage), labels...)
+		ch <- prometheus.MustNewConstMetric(c.creditsLimit, prometheus.GaugeValue, float64(cookie.Usage.TaskCreditsLimit), labels...)
+		ch <- prometheus.MustNewConstMetric(c.concurrencyCap, prometheus.GaugeValue, float64(cookie.Usage.TaskConcurrencyLimit), labels...)
+		if updated, err := time.ParseInLocation(models.UsageTimeLayout, cookie.Usage.LastUpdate, time.Local); err == nil {
+			ch <- prometheus.MustNewConstMetric(c.usageUpdated, prometheus.GaugeValue, float64(updated.Unix()), labels...)
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
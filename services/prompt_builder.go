@@ -0,0 +1,223 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 提示词模板
+const (
+	PromptTemplatePlain    = "plain"     // 角色标记的纯文本对话记录
+	PromptTemplateXML      = "xml"       // XML标签包裹的对话记录
+	PromptTemplateLastUser = "last_user" // 仅发送最后一条用户消息（旧行为）
+)
+
+// 截断策略
+const (
+	TruncateDropOldest = "drop_oldest" // 从最早的消息开始丢弃
+	TruncateDropMiddle = "drop_middle" // 保留第一条对话消息，丢弃中间的消息
+	TruncateTail       = "tail"        // 不丢弃消息，直接截取渲染结果的末尾
+)
+
+// truncatedMarker 截断位置的提示
+const truncatedMarker = "\n...[内容过长，已截断]...\n"
+
+// PromptMessage 提示词消息（与具体API格式无关）
+type PromptMessage struct {
+	Role    string
+	Name    string
+	Content string
+}
+
+// PromptBuilder 将完整对话历史组装为上游prompt
+type PromptBuilder struct {
+	template   string
+	truncation string
+	maxBytes   int // prompt最大字节数，0表示不限制
+}
+
+// NewPromptBuilder 创建提示词组装器
+func NewPromptBuilder(template, truncation string, maxBytes int) *PromptBuilder {
+	switch template {
+	case PromptTemplatePlain, PromptTemplateXML, PromptTemplateLastUser:
+	default:
+		template = PromptTemplatePlain
+	}
+	switch truncation {
+	case TruncateDropOldest, TruncateDropMiddle, TruncateTail:
+	default:
+		truncation = TruncateDropOldest
+	}
+	return &PromptBuilder{
+		template:   template,
+		truncation: truncation,
+		maxBytes:   maxBytes,
+	}
+}
+
+// Build 组装prompt
+func (b *PromptBuilder) Build(messages []PromptMessage) (string, error) {
+	if b.template == PromptTemplateLastUser {
+		for i := len(messages) - 1; i >= 0; i-- {
+			if messages[i].Role == "user" && strings.TrimSpace(messages[i].Content) != "" {
+				return b.truncateText(messages[i].Content), nil
+			}
+		}
+		return "", fmt.Errorf("没有找到用户消息")
+	}
+
+	// 过滤空消息，至少需要一条用户消息或工具结果
+	kept := make([]PromptMessage, 0, len(messages))
+	hasTurn := false
+	for _, m := range messages {
+		if strings.TrimSpace(m.Content) == "" {
+			continue
+		}
+		if m.Role == "user" || m.Role == "tool" || m.Role == "function" {
+			hasTurn = true
+		}
+		kept = append(kept, m)
+	}
+	if !hasTurn {
+		return "", fmt.Errorf("没有找到用户消息")
+	}
+
+	if b.maxBytes > 0 && b.truncation != TruncateTail {
+		kept = b.dropMessages(kept)
+	}
+
+	return b.truncateText(b.render(kept)), nil
+}
+
+// render 按模板渲染消息
+func (b *PromptBuilder) render(messages []PromptMessage) string {
+	// 只有一条用户消息时直接发送原文
+	if len(messages) == 1 && messages[0].Role == "user" {
+		return messages[0].Content
+	}
+
+	parts := make([]string, 0, len(messages))
+	for _, m := range messages {
+		if b.template == PromptTemplateXML {
+			parts = append(parts, renderXML(m))
+		} else {
+			parts = append(parts, renderPlain(m))
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// renderPlain 渲染为 "Role: 内容" 形式
+func renderPlain(m PromptMessage) string {
+	label := roleLabel(m.Role)
+	if m.Name != "" {
+		label += " (" + m.Name + ")"
+	}
+	return label + ": " + m.Content
+}
+
+// renderXML 渲染为 <role>内容</role> 形式
+func renderXML(m PromptMessage) string {
+	tag := m.Role
+	if tag == "" {
+		tag = "user"
+	}
+	attr := ""
+	if m.Name != "" {
+		attr = fmt.Sprintf(" name=%q", m.Name)
+	}
+	return fmt.Sprintf("<%s%s>\n%s\n</%s>", tag, attr, m.Content, tag)
+}
+
+// roleLabel 角色显示名称
+func roleLabel(role string) string {
+	switch role {
+	case "system", "developer":
+		return "System"
+	case "assistant":
+		return "Assistant"
+	case "tool", "function":
+		return "Tool"
+	default:
+		return "User"
+	}
+}
+
+// dropMessages 按策略丢弃消息直到长度满足限制
+// 系统消息和最后一条消息始终保留
+func (b *PromptBuilder) dropMessages(messages []PromptMessage) []PromptMessage {
+	for len(b.render(messages)) > b.maxBytes {
+		idx := b.dropIndex(messages)
+		if idx < 0 {
+			break
+		}
+		messages = append(messages[:idx:idx], messages[idx+1:]...)
+	}
+	return messages
+}
+
+// dropIndex 下一条可丢弃消息的下标，没有可丢弃的消息时返回-1
+func (b *PromptBuilder) dropIndex(messages []PromptMessage) int {
+	first := -1
+	for i := 0; i < len(messages)-1; i++ {
+		if messages[i].Role == "system" || messages[i].Role == "developer" {
+			continue
+		}
+		if b.truncation == TruncateDropMiddle && first < 0 {
+			// 保留第一条非系统消息
+			first = i
+			continue
+		}
+		return i
+	}
+	// drop_middle 下只剩第一条消息可丢时也丢弃
+	return first
+}
+
+// truncateText 超出长度时保留首尾，截断中间部分
+func (b *PromptBuilder) truncateText(text string) string {
+	if b.maxBytes <= 0 || len(text) <= b.maxBytes {
+		return text
+	}
+
+	if b.truncation == TruncateTail {
+		return truncatedMarker + validUTF8Suffix(text, b.maxBytes-len(truncatedMarker))
+	}
+
+	half := (b.maxBytes - len(truncatedMarker)) / 2
+	return validUTF8Prefix(text, half) + truncatedMarker + validUTF8Suffix(text, half)
+}
+
+// validUTF8Prefix 截取不超过n字节的前缀，不切断多字节字符
+func validUTF8Prefix(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if n >= len(s) {
+		return s
+	}
+	for n > 0 && !isRuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// validUTF8Suffix 截取不超过n字节的后缀，不切断多字节字符
+func validUTF8Suffix(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if n >= len(s) {
+		return s
+	}
+	start := len(s) - n
+	for start < len(s) && !isRuneStart(s[start]) {
+		start++
+	}
+	return s[start:]
+}
+
+// isRuneStart 判断字节是否为UTF-8字符起始字节
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
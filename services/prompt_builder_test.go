@@ -0,0 +1,147 @@
+package services_test
+
+import (
+	"cto2api/services"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestPromptBuilderTemplates(t *testing.T) {
+	conversation := []services.PromptMessage{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello!"},
+		{Role: "tool", Name: "lookup", Content: "42"},
+		{Role: "user", Content: "  "},
+		{Role: "user", Content: "And now?"},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		messages []services.PromptMessage
+		want     string
+	}{
+		{
+			name:     "plain",
+			template: services.PromptTemplatePlain,
+			messages: conversation,
+			want:     "System: Be brief.\n\nUser: Hi\n\nAssistant: Hello!\n\nTool (lookup): 42\n\nUser: And now?",
+		},
+		{
+			name:     "xml",
+			template: services.PromptTemplateXML,
+			messages: conversation[1:4],
+			want:     "<user>\nHi\n</user>\n\n<assistant>\nHello!\n</assistant>\n\n<tool name=\"lookup\">\n42\n</tool>",
+		},
+		{
+			name:     "last user",
+			template: services.PromptTemplateLastUser,
+			messages: conversation,
+			want:     "And now?",
+		},
+		{
+			name:     "single user message is sent verbatim",
+			template: services.PromptTemplatePlain,
+			messages: []services.PromptMessage{{Role: "user", Content: "Just this"}},
+			want:     "Just this",
+		},
+		{
+			name:     "unknown template falls back to plain",
+			template: "unknown",
+			messages: conversation[:2],
+			want:     "System: Be brief.\n\nUser: Hi",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := services.NewPromptBuilder(tt.template, "", 0).Build(tt.messages)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("prompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptBuilderRequiresUserTurn(t *testing.T) {
+	messages := []services.PromptMessage{
+		{Role: "system", Content: "Be brief."},
+		{Role: "assistant", Content: "Hello!"},
+		{Role: "user", Content: "   "},
+	}
+	for _, template := range []string{services.PromptTemplatePlain, services.PromptTemplateLastUser} {
+		if _, err := services.NewPromptBuilder(template, "", 0).Build(messages); err == nil {
+			t.Errorf("%s: expected an error without a user message", template)
+		}
+	}
+}
+
+func TestPromptBuilderDropMessages(t *testing.T) {
+	messages := []services.PromptMessage{
+		{Role: "system", Content: "sys"},
+		{Role: "user", Content: "first question"},
+		{Role: "assistant", Content: "first answer"},
+		{Role: "user", Content: "second question"},
+		{Role: "assistant", Content: "second answer"},
+		{Role: "user", Content: "last"},
+	}
+
+	tests := []struct {
+		truncation string
+		maxBytes   int
+		want       string
+	}{
+		{
+			truncation: services.TruncateDropOldest,
+			maxBytes:   60,
+			want:       "System: sys\n\nAssistant: second answer\n\nUser: last",
+		},
+		{
+			truncation: services.TruncateDropMiddle,
+			maxBytes:   60,
+			want:       "System: sys\n\nUser: first question\n\nUser: last",
+		},
+		{
+			// 系统消息和最后一条消息始终保留
+			truncation: services.TruncateDropOldest,
+			maxBytes:   30,
+			want:       "System: sys\n\nUser: last",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := services.NewPromptBuilder(services.PromptTemplatePlain, tt.truncation, tt.maxBytes).Build(messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%s/%d: prompt = %q, want %q", tt.truncation, tt.maxBytes, got, tt.want)
+		}
+	}
+}
+
+func TestPromptBuilderTruncateText(t *testing.T) {
+	long := strings.Repeat("中文", 100) // 600字节
+	messages := []services.PromptMessage{{Role: "user", Content: long}}
+
+	for _, truncation := range []string{services.TruncateDropOldest, services.TruncateTail} {
+		got, err := services.NewPromptBuilder(services.PromptTemplatePlain, truncation, 100).Build(messages)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) > 100 || !utf8.ValidString(got) || !strings.Contains(got, "已截断") {
+			t.Errorf("%s: truncated prompt = %q (%d bytes)", truncation, got, len(got))
+		}
+		if truncation == services.TruncateTail && !strings.HasSuffix(got, "中文") {
+			t.Errorf("tail truncation should keep the end: %q", got)
+		}
+		if truncation == services.TruncateDropOldest && !strings.HasPrefix(got, "中文") {
+			t.Errorf("middle truncation should keep the start: %q", got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit 一个令牌桶的限制，RPM为每分钟补充的令牌数，Burst为桶容量（<=0时等于RPM）
+type RateLimit struct {
+	Key   string
+	RPM   int
+	Burst int
+}
+
+// burst 桶容量
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.RPM)
+}
+
+// RateLimitResult 限流检查结果，用于填写 x-ratelimit-* 和 Retry-After 响应头
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int           // 最严格的限制（每分钟请求数）
+	Remaining  int           // 剩余令牌数
+	Reset      time.Duration // 令牌桶补满所需时间
+	RetryAfter time.Duration // 被拒绝时距离下一个令牌的时间
+}
+
+// rateLimitSweepInterval 清理已补满的令牌桶的间隔
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket 令牌桶状态
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit // 最近一次使用的限制，用于判断是否已补满
+}
+
+// RateLimiter 按键区分的令牌桶限流器，补满后闲置的令牌桶会被删除（与新建的桶等价）
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter 创建限流器
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow 同时检查多个令牌桶（如全局和API密钥），全部有令牌时各取一个
+// 任一桶没有令牌时都不扣除；RPM<=0的限制被忽略。没有生效的限制时Limit为0
+func (l *RateLimiter) Allow(limits ...RateLimit) RateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	result := RateLimitResult{Allowed: true, Remaining: math.MaxInt}
+	active := make([]*tokenBucket, 0, len(limits))
+	for _, limit := range limits {
+		if limit.RPM <= 0 {
+			continue
+		}
+		bucket := l.refill(limit, now)
+		rate := float64(limit.RPM) / float64(time.Minute)
+
+		if bucket.tokens < 1 {
+			wait := time.Duration(math.Ceil((1 - bucket.tokens) / rate))
+			if !result.Allowed && wait <= result.RetryAfter {
+				continue
+			}
+			// 记录等待时间最长的拒绝
+			result.Allowed = false
+			result.Limit = limit.RPM
+			result.Remaining = 0
+			result.Reset = time.Duration(math.Ceil((limit.burst() - bucket.tokens) / rate))
+			result.RetryAfter = wait
+			continue
+		}
+		active = append(active, bucket)
+
+		remaining := int(bucket.tokens) - 1
+		if result.Allowed && remaining < result.Remaining {
+			result.Limit = limit.RPM
+			result.Remaining = remaining
+			result.Reset = time.Duration(math.Ceil((limit.burst() - bucket.tokens + 1) / rate))
+		}
+	}
+
+	if result.Limit == 0 {
+		result.Remaining = 0
+	}
+	if result.Allowed {
+		for _, bucket := range active {
+			bucket.tokens--
+		}
+	}
+	return result
+}
+
+// refill 按经过的时间补充令牌（调用方需持有锁）
+func (l *RateLimiter) refill(limit RateLimit, now time.Time) *tokenBucket {
+	capacity := limit.burst()
+	bucket, ok := l.buckets[limit.Key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, last: now, limit: limit}
+		l.buckets[limit.Key] = bucket
+		return bucket
+	}
+
+	elapsed := now.Sub(bucket.last)
+	bucket.last = now
+	bucket.limit = limit
+	bucket.tokens = math.Min(capacity, bucket.tokens+elapsed.Minutes()*float64(limit.RPM))
+	return bucket
+}
+
+// sweep 删除已经补满的令牌桶，避免已删除或不再使用的API密钥一直占用内存（调用方需持有锁）
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Minutes()*float64(bucket.limit.RPM) >= bucket.limit.burst() {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
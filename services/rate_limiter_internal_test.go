@@ -0,0 +1,35 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRateLimiterSweep 只删除已经补满的令牌桶
+func TestRateLimiterSweep(t *testing.T) {
+	limiter := NewRateLimiter()
+	idle := RateLimit{Key: "key:deleted", RPM: 60, Burst: 3}
+	busy := RateLimit{Key: "key:busy", RPM: 1, Burst: 3}
+	limiter.Allow(idle)
+	for i := 0; i < 3; i++ {
+		limiter.Allow(busy)
+	}
+
+	// 10秒后：idle已补满（每秒1个令牌），busy每分钟只补充1个
+	limiter.mu.Lock()
+	limiter.sweep(time.Now().Add(10 * time.Second))
+	_, idleKept := limiter.buckets[idle.Key]
+	_, busyKept := limiter.buckets[busy.Key]
+	limiter.mu.Unlock()
+	if idleKept {
+		t.Error("refilled bucket was not evicted")
+	}
+	if !busyKept {
+		t.Error("bucket still refilling was evicted")
+	}
+
+	// 删除后重新创建的桶是满的
+	if result := limiter.Allow(idle); !result.Allowed || result.Remaining != 2 {
+		t.Errorf("recreated bucket = %+v, want full", result)
+	}
+}
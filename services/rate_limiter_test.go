@@ -0,0 +1,63 @@
+package services_test
+
+import (
+	"cto2api/services"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := services.NewRateLimiter()
+	limit := services.RateLimit{Key: "k", RPM: 60, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		result := limiter.Allow(limit)
+		if !result.Allowed {
+			t.Fatalf("request %d rejected", i)
+		}
+		if result.Remaining != 2-i {
+			t.Errorf("request %d remaining = %d, want %d", i, result.Remaining, 2-i)
+		}
+	}
+
+	result := limiter.Allow(limit)
+	if result.Allowed {
+		t.Fatal("request beyond burst allowed")
+	}
+	// 每秒补充1个令牌
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Errorf("retry after = %v, want (0, 1s]", result.RetryAfter)
+	}
+}
+
+// TestRateLimiterAllOrNothing 任一桶拒绝时其他桶的令牌不被扣除
+func TestRateLimiterAllOrNothing(t *testing.T) {
+	limiter := services.NewRateLimiter()
+	global := services.RateLimit{Key: "global", RPM: 10}
+	key := services.RateLimit{Key: "key", RPM: 1}
+
+	if !limiter.Allow(global, key).Allowed {
+		t.Fatal("first request rejected")
+	}
+	result := limiter.Allow(global, key)
+	if result.Allowed {
+		t.Fatal("second request allowed by the per-key bucket")
+	}
+	if result.Limit != 1 {
+		t.Errorf("limit = %d, want the per-key limit 1", result.Limit)
+	}
+
+	// 全局桶只被第一次请求扣除
+	if got := limiter.Allow(global).Remaining; got != 8 {
+		t.Errorf("global remaining = %d, want 8", got)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := services.NewRateLimiter()
+	for i := 0; i < 100; i++ {
+		if result := limiter.Allow(services.RateLimit{Key: "k"}); !result.Allowed || result.Limit != 0 {
+			t.Fatalf("unlimited request %d = %+v", i, result)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPFixture 一次录制的HTTP请求和响应（已脱敏）
+type HTTPFixture struct {
+	Method       string `json:"method"`
+	URL          string `json:"url"`
+	Status       int    `json:"status"`
+	RequestBody  string `json:"request_body,omitempty"`
+	ResponseBody string `json:"response_body"`
+}
+
+// StreamFixture 一次录制的WebSocket流（已脱敏）
+type StreamFixture struct {
+	ChatID string   `json:"chat_id"`
+	Frames []string `json:"frames"`
+}
+
+// redactPatterns 录制时需要脱敏的内容
+var redactPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`"jwt"\s*:\s*"[^"]*"`), `"jwt":"REDACTED"`},
+	{regexp.MustCompile(`([?&]token=)[^&]*`), `${1}REDACTED`},
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), `REDACTED_JWT`},
+	// Clerk返回的个人信息
+	{regexp.MustCompile(`"(email_address|first_name|last_name|username|phone_number|identifier|image_url|profile_image_url)"\s*:\s*"[^"]*"`), `"$1":"REDACTED"`},
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), `REDACTED_EMAIL`},
+}
+
+// clerkIDPattern Clerk对象ID（用户、会话、客户端、组织等），至少包含一个数字以免匹配字段名
+var clerkIDPattern = regexp.MustCompile(`\b(user|sess|client|idn|orgmem|org|img)_[A-Za-z0-9]*[0-9][A-Za-z0-9]*`)
+
+// sanitize 去除JWT、WebSocket token和Clerk账号的个人信息。
+// Clerk ID替换为由原ID哈希得到的假名：同一ID在所有fixture中一致，回放时会话路径仍能匹配
+func sanitize(s string) string {
+	for _, p := range redactPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return clerkIDPattern.ReplaceAllStringFunc(s, func(id string) string {
+		prefix := id[:strings.IndexByte(id, '_')]
+		sum := sha256.Sum256([]byte(id))
+		return prefix + "_redacted" + hex.EncodeToString(sum[:6])
+	})
+}
+
+// Recorder 将上游HTTP交互和WebSocket帧录制为fixture文件，用于离线回放
+// 目录结构：<dir>/http/<序号>-<方法>.json 和 <dir>/stream/<序号>-<chatID>.json
+type Recorder struct {
+	mu  sync.Mutex
+	dir string
+	seq int
+}
+
+var (
+	recorderMu     sync.RWMutex
+	activeRecorder *Recorder
+)
+
+// NewRecorder 创建录制器
+func NewRecorder(dir string) (*Recorder, error) {
+	for _, sub := range []string{"http", "stream"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Recorder{dir: dir}, nil
+}
+
+// SetRecorder 设置之后创建的CTOClient使用的录制器，nil表示关闭录制
+func SetRecorder(r *Recorder) {
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+	activeRecorder = r
+}
+
+// currentRecorder 当前的录制器
+func currentRecorder() *Recorder {
+	recorderMu.RLock()
+	defer recorderMu.RUnlock()
+	return activeRecorder
+}
+
+// RoundTripper 包装HTTP传输层，录制每一次请求和响应
+func (r *Recorder) RoundTripper(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &recordingTransport{base: base, recorder: r}
+}
+
+// nextName 生成下一个fixture文件名
+func (r *Recorder) nextName(suffix string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	return fmt.Sprintf("%s-%04d-%s.json", time.Now().Format("20060102T150405"), r.seq, suffix)
+}
+
+// write 写入fixture文件
+func (r *Recorder) write(sub, name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return
+	}
+	os.WriteFile(filepath.Join(r.dir, sub, name), data, 0644)
+}
+
+// recordHTTP 录制一次HTTP交互
+func (r *Recorder) recordHTTP(fixture *HTTPFixture) {
+	r.write("http", r.nextName(strings.ToLower(fixture.Method)), fixture)
+}
+
+// recordStream 录制一次WebSocket流
+func (r *Recorder) recordStream(chatID string, frames []string) {
+	r.write("stream", r.nextName(chatID), &StreamFixture{ChatID: chatID, Frames: frames})
+}
+
+// recordingTransport 录制HTTP交互的传输层
+type recordingTransport struct {
+	base     http.RoundTripper
+	recorder *Recorder
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		reqBody, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	if err != nil {
+		return resp, nil
+	}
+
+	t.recorder.recordHTTP(&HTTPFixture{
+		Method:       req.Method,
+		URL:          sanitize(req.URL.String()),
+		Status:       resp.StatusCode,
+		RequestBody:  sanitize(string(reqBody)),
+		ResponseBody: sanitize(string(respBody)),
+	})
+	return resp, nil
+}
+
+// recordingConn 录制收到的WebSocket帧，关闭时写入fixture
+// （客户端断开时Close在另一个goroutine中调用，与ReadMessage并发，frames由mu保护）
+type recordingConn struct {
+	frameConn
+	recorder *Recorder
+	chatID   string
+	mu       sync.Mutex
+	frames   []string
+	once     sync.Once
+}
+
+func (c *recordingConn) ReadMessage() (int, []byte, error) {
+	messageType, message, err := c.frameConn.ReadMessage()
+	if err == nil {
+		frame := sanitize(string(message))
+		c.mu.Lock()
+		c.frames = append(c.frames, frame)
+		c.mu.Unlock()
+	}
+	return messageType, message, err
+}
+
+func (c *recordingConn) Close() error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		frames := append([]string(nil), c.frames...)
+		c.mu.Unlock()
+		c.recorder.recordStream(c.chatID, frames)
+	})
+	return c.frameConn.Close()
+}
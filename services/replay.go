@@ -0,0 +1,186 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Replay 回放Recorder录制的fixture，代替真实上游
+// HTTP请求按方法和路径匹配，同一路径的录制按顺序返回（用完后重复最后一条）；
+// WebSocket流优先按chatID匹配，否则按录制顺序依次返回
+type Replay struct {
+	mu      sync.Mutex
+	http    map[string][]*HTTPFixture
+	streams []*StreamFixture
+}
+
+// LoadReplay 从录制目录加载fixture
+func LoadReplay(dir string) (*Replay, error) {
+	r := &Replay{http: make(map[string][]*HTTPFixture)}
+
+	httpFiles, err := fixtureFiles(filepath.Join(dir, "http"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range httpFiles {
+		var fixture HTTPFixture
+		if err := readFixture(file, &fixture); err != nil {
+			return nil, err
+		}
+		key, err := replayKey(fixture.Method, fixture.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		r.http[key] = append(r.http[key], &fixture)
+	}
+
+	streamFiles, err := fixtureFiles(filepath.Join(dir, "stream"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range streamFiles {
+		var fixture StreamFixture
+		if err := readFixture(file, &fixture); err != nil {
+			return nil, err
+		}
+		r.AddStream(&fixture)
+	}
+
+	return r, nil
+}
+
+// AddStream 添加一段WebSocket流
+func (r *Replay) AddStream(fixture *StreamFixture) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streams = append(r.streams, fixture)
+}
+
+// RoundTrip 返回录制的HTTP响应
+func (r *Replay) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := replayKey(req.Method, req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	fixtures := r.http[key]
+	var fixture *HTTPFixture
+	if len(fixtures) > 0 {
+		fixture = fixtures[0]
+		if len(fixtures) > 1 {
+			r.http[key] = fixtures[1:]
+		}
+	}
+	r.mu.Unlock()
+
+	if fixture == nil {
+		return nil, fmt.Errorf("回放中没有录制的请求: %s", key)
+	}
+
+	return &http.Response{
+		StatusCode: fixture.Status,
+		Status:     fmt.Sprintf("%d %s", fixture.Status, http.StatusText(fixture.Status)),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader([]byte(fixture.ResponseBody))),
+		Request:    req,
+	}, nil
+}
+
+// dial 返回录制的WebSocket流
+func (r *Replay) dial(_ context.Context, wsURL string, _ http.Header) (frameConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.streams) == 0 {
+		return nil, fmt.Errorf("回放中没有录制的WebSocket流: %s", wsURL)
+	}
+
+	index := 0
+	chatID := chatIDFromStreamURL(wsURL)
+	for i, fixture := range r.streams {
+		if fixture.ChatID == chatID {
+			index = i
+			break
+		}
+	}
+	fixture := r.streams[index]
+	r.streams = append(r.streams[:index], r.streams[index+1:]...)
+	return &replayConn{frames: fixture.Frames}, nil
+}
+
+// UseReplay 让客户端使用回放代替真实上游
+func (c *CTOClient) UseReplay(r *Replay) *CTOClient {
+	c.client.Transport = r
+	c.dialStream = r.dial
+	return c
+}
+
+// replayConn 依次返回录制的帧，之后正常关闭
+type replayConn struct {
+	frames []string
+	pos    int
+}
+
+func (c *replayConn) ReadMessage() (int, []byte, error) {
+	if c.pos >= len(c.frames) {
+		return 0, nil, &websocket.CloseError{Code: websocket.CloseNormalClosure}
+	}
+	frame := c.frames[c.pos]
+	c.pos++
+	return websocket.TextMessage, []byte(frame), nil
+}
+
+func (c *replayConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *replayConn) Close() error { return nil }
+
+// replayKey 按方法和路径匹配请求，忽略查询参数
+func replayKey(method, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return method + " " + u.Path, nil
+}
+
+// chatIDFromStreamURL 从流式URL中取出chatHistoryId
+func chatIDFromStreamURL(wsURL string) string {
+	u, err := url.Parse(wsURL)
+	if err != nil {
+		return ""
+	}
+	path := strings.TrimSuffix(u.Path, "/buffer/stream")
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// fixtureFiles 目录下按文件名排序的fixture，目录不存在时返回空
+func fixtureFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func readFixture(file string, v interface{}) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
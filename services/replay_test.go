@@ -0,0 +1,148 @@
+package services_test
+
+import (
+	"context"
+	"cto2api/internal/fakeupstream"
+	"cto2api/services"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "重新生成golden文件")
+
+// loadStreamFixtures 加载testdata/streams下录制的帧序列
+func loadStreamFixtures(t *testing.T) []*services.StreamFixture {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join("testdata", "streams", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no stream fixtures found")
+	}
+
+	fixtures := make([]*services.StreamFixture, 0, len(files))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fixture services.StreamFixture
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+		// 以文件名作为chatID，对应同名的.golden文件
+		fixture.ChatID = strings.TrimSuffix(filepath.Base(file), ".json")
+		fixtures = append(fixtures, &fixture)
+	}
+	return fixtures
+}
+
+// TestStreamGolden 回放testdata/streams下录制的帧序列，输出需要与对应的.golden文件一致
+func TestStreamGolden(t *testing.T) {
+	for _, fixture := range loadStreamFixtures(t) {
+		t.Run(fixture.ChatID, func(t *testing.T) {
+			replay := &services.Replay{}
+			replay.AddStream(fixture)
+			client := services.NewCTOClient("cookie", services.Endpoints{}).UseReplay(replay)
+
+			got, err := client.GetFullResponse(context.Background(), fixture.ChatID, "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "streams", fixture.ChatID+".golden")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("output = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestRecordAndReplay 录制一次完整的聊天交互，再离线回放得到相同的结果
+func TestRecordAndReplay(t *testing.T) {
+	upstream := fakeupstream.New()
+	defer upstream.Close()
+	// 认证缓存在进程内共享，重复运行时不能沿用上一次录制的JWT
+	services.SharedTokenCache().Invalidate("record-cookie")
+	upstream.AddAccount(&fakeupstream.Account{
+		Cookie: "record-cookie",
+		Reply:  []string{"recorded ", "reply"},
+	})
+
+	dir := t.TempDir()
+	recorder, err := services.NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services.SetRecorder(recorder)
+	client := services.NewCTOClient("record-cookie", upstream.Endpoints())
+	services.SetRecorder(nil)
+
+	clerk, jwt, err := client.Authenticate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateChat(context.Background(), jwt, "hello", "GPT5", "chat-1"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := client.GetFullResponse(context.Background(), "chat-1", clerk.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 录制内容不应包含JWT、WebSocket token和账号信息
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if len(files) == 0 {
+		t.Fatal("nothing was recorded")
+	}
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		for _, secret := range []string{jwt, clerk.UserID, clerk.SessionID, "@example.com", "Test"} {
+			if strings.Contains(string(data), secret) {
+				t.Errorf("%s contains unredacted %q", filepath.Base(file), secret)
+			}
+		}
+	}
+
+	// 回放时不访问上游
+	replay, err := services.LoadReplay(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Close()
+
+	replayed := services.NewCTOClient("replay-cookie", upstream.Endpoints()).UseReplay(replay)
+	replayedClerk, replayedJWT, err := replayed.Authenticate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 回放得到的是假名，会话路径仍能匹配录制的JWT请求
+	if replayedClerk.UserID == "" || replayedClerk.UserID == clerk.UserID {
+		t.Errorf("replayed user id = %q, want a pseudonym for %q", replayedClerk.UserID, clerk.UserID)
+	}
+	if err := replayed.CreateChat(context.Background(), replayedJWT, "hello", "GPT5", "chat-1"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := replayed.GetFullResponse(context.Background(), "chat-1", replayedClerk.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("replayed output = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// StoredResponse 已完成的Responses API响应，用于previous_response_id续接
+type StoredResponse struct {
+	ID        string
+	OwnerKey  string            // 创建该响应的API密钥ID，只有该密钥可以读取、删除和续接
+	Messages  []PromptMessage   // 截至该响应（含输出）的完整对话，不含instructions
+	CallNames map[string]string // 函数调用call_id -> 函数名，用于标注后续的调用结果
+	Body      json.RawMessage   // 返回给客户端的响应对象
+	CreatedAt time.Time
+}
+
+// ResponseStore Responses API响应存储（内存，带过期时间）
+type ResponseStore struct {
+	mu        sync.RWMutex
+	ttl       time.Duration
+	responses map[string]*StoredResponse
+	lastScan  time.Time
+}
+
+// NewResponseStore 创建响应存储
+func NewResponseStore(ttl time.Duration) *ResponseStore {
+	return &ResponseStore{
+		ttl:       ttl,
+		responses: make(map[string]*StoredResponse),
+	}
+}
+
+// Get 获取owner创建的响应，不存在、已过期或属于其他API密钥时返回nil
+func (s *ResponseStore) Get(id, owner string) *StoredResponse {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	resp, ok := s.responses[id]
+	if !ok || resp.OwnerKey != owner || time.Since(resp.CreatedAt) > s.ttl {
+		return nil
+	}
+	return resp
+}
+
+// Put 保存响应
+func (s *ResponseStore) Put(resp *StoredResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responses[resp.ID] = resp
+
+	// 定期清理过期响应
+	now := time.Now()
+	if now.Sub(s.lastScan) > s.ttl/10 {
+		for id, r := range s.responses {
+			if now.Sub(r.CreatedAt) > s.ttl {
+				delete(s.responses, id)
+			}
+		}
+		s.lastScan = now
+	}
+}
+
+// Delete 删除owner创建的响应，返回是否存在（属于其他API密钥时视为不存在）
+func (s *ResponseStore) Delete(id, owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp, ok := s.responses[id]
+	if !ok || resp.OwnerKey != owner {
+		return false
+	}
+	delete(s.responses, id)
+	return true
+}
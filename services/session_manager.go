@@ -0,0 +1,191 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"cto2api/models"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidToken token格式错误或签名不匹配
+	ErrInvalidToken = errors.New("无效的token")
+	// ErrTokenExpired token已过期
+	ErrTokenExpired = errors.New("token已过期")
+	// ErrTokenRevoked token已被注销
+	ErrTokenRevoked = errors.New("token已被注销")
+)
+
+// SessionClaims 管理会话声明
+type SessionClaims struct {
+	ID        string `json:"jti"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Gen       int64  `json:"gen"`
+}
+
+// SessionStore 会话注销状态的持久化（由DataStore实现）
+type SessionStore interface {
+	GetSessionState() models.SessionState
+	SetSessionState(state models.SessionState) error
+}
+
+// SessionManager 管理员会话管理器（HMAC签名、带过期时间的token）
+// 注销状态写入SessionStore，使用固定secret时重启后已注销的token仍然无效
+type SessionManager struct {
+	mu      sync.RWMutex
+	secret  []byte
+	ttl     time.Duration
+	store   SessionStore         // 为nil时注销状态只保存在内存中
+	revoked map[string]time.Time // 已注销的会话ID -> 原过期时间
+	gen     int64                // 会话代数，RevokeAll后递增使旧token全部失效
+}
+
+// defaultSessionTTL 默认的管理token有效期
+const defaultSessionTTL = 24 * time.Hour
+
+// NewSessionManager 创建会话管理器，secret为空时随机生成（重启后所有会话失效），ttl<=0时使用默认有效期
+// store不为nil时从中恢复注销状态，并在注销时写回
+func NewSessionManager(secret string, ttl time.Duration, store SessionStore) *SessionManager {
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		rand.Read(key)
+	}
+	m := &SessionManager{
+		secret:  key,
+		ttl:     ttl,
+		store:   store,
+		revoked: make(map[string]time.Time),
+	}
+	if store != nil {
+		state := store.GetSessionState()
+		m.gen = state.Gen
+		for id, exp := range state.Revoked {
+			m.revoked[id] = exp
+		}
+		m.cleanup()
+	}
+	return m
+}
+
+// Issue 签发新的会话token
+func (m *SessionManager) Issue() (string, *SessionClaims, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	m.mu.RLock()
+	gen := m.gen
+	m.mu.RUnlock()
+
+	now := time.Now()
+	claims := &SessionClaims{
+		ID:        hex.EncodeToString(id),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(m.ttl).Unix(),
+		Gen:       gen,
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + m.sign(encoded), claims, nil
+}
+
+// Validate 校验token签名、过期时间和注销状态
+func (m *SessionManager) Validate(token string) (*SessionClaims, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, ErrInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(m.sign(parts[0]))) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims SessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ID == "" {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, revoked := m.revoked[claims.ID]; revoked {
+		return nil, ErrTokenRevoked
+	}
+	if claims.Gen != m.gen {
+		return nil, ErrTokenRevoked
+	}
+
+	return &claims, nil
+}
+
+// Revoke 注销单个会话，保存失败时会话在本次运行中仍然是注销的
+func (m *SessionManager) Revoke(claims *SessionClaims) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.revoked[claims.ID] = time.Unix(claims.ExpiresAt, 0)
+	m.cleanup()
+	return m.persist()
+}
+
+// RevokeAll 注销当前所有会话，保存失败时会话在本次运行中仍然是注销的
+func (m *SessionManager) RevokeAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gen++
+	m.revoked = make(map[string]time.Time)
+	return m.persist()
+}
+
+// persist 把注销状态写入存储（调用方需持有写锁）
+func (m *SessionManager) persist() error {
+	if m.store == nil {
+		return nil
+	}
+	return m.store.SetSessionState(models.SessionState{Gen: m.gen, Revoked: m.revoked})
+}
+
+// cleanup 清理已自然过期的注销记录（调用方需持有写锁）
+func (m *SessionManager) cleanup() {
+	now := time.Now()
+	for id, exp := range m.revoked {
+		if now.After(exp) {
+			delete(m.revoked, id)
+		}
+	}
+}
+
+// sign 计算HMAC-SHA256签名
+func (m *SessionManager) sign(data string) string {
+	mac := hmac.New(sha256.New, m.secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,74 @@
+package services_test
+
+import (
+	"cto2api/models"
+	"cto2api/services"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionManagerDefaultTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{0, -time.Hour} {
+		sessions := services.NewSessionManager("secret", ttl, nil)
+		token, claims, err := sessions.Issue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := time.Unix(claims.ExpiresAt, 0).Sub(time.Unix(claims.IssuedAt, 0)); got != 24*time.Hour {
+			t.Errorf("ttl %v: token lifetime = %v, want 24h", ttl, got)
+		}
+		if _, err := sessions.Validate(token); err != nil {
+			t.Errorf("ttl %v: validate fresh token = %v", ttl, err)
+		}
+	}
+}
+
+// memorySessionStore 模拟持久化的会话注销状态
+type memorySessionStore struct {
+	state models.SessionState
+}
+
+func (s *memorySessionStore) GetSessionState() models.SessionState {
+	return s.state
+}
+
+func (s *memorySessionStore) SetSessionState(state models.SessionState) error {
+	revoked := make(map[string]time.Time, len(state.Revoked))
+	for id, exp := range state.Revoked {
+		revoked[id] = exp
+	}
+	s.state = models.SessionState{Gen: state.Gen, Revoked: revoked}
+	return nil
+}
+
+func TestSessionManagerRevocationSurvivesRestart(t *testing.T) {
+	store := &memorySessionStore{}
+	sessions := services.NewSessionManager("secret", time.Hour, store)
+	revoked, claims, _ := sessions.Issue()
+	kept, _, _ := sessions.Issue()
+	if err := sessions.Revoke(claims); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟重启：用同一个secret和存储创建新的会话管理器
+	sessions = services.NewSessionManager("secret", time.Hour, store)
+	if _, err := sessions.Validate(revoked); !errors.Is(err, services.ErrTokenRevoked) {
+		t.Errorf("revoked token after restart = %v, want ErrTokenRevoked", err)
+	}
+	if _, err := sessions.Validate(kept); err != nil {
+		t.Errorf("kept token after restart = %v", err)
+	}
+	if err := sessions.RevokeAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions = services.NewSessionManager("secret", time.Hour, store)
+	if _, err := sessions.Validate(kept); !errors.Is(err, services.ErrTokenRevoked) {
+		t.Errorf("token after RevokeAll and restart = %v, want ErrTokenRevoked", err)
+	}
+	fresh, _, _ := sessions.Issue()
+	if _, err := sessions.Validate(fresh); err != nil {
+		t.Errorf("token issued after restart = %v", err)
+	}
+}
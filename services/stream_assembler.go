@@ -0,0 +1,221 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// bufferMode chat缓冲的内容形式
+type bufferMode int
+
+const (
+	bufferUnknown    bufferMode = iota // 还无法判断
+	bufferCumulative                   // 每帧是该消息到目前为止的完整内容
+	bufferDelta                        // 每帧只包含新增内容
+)
+
+// messageSeparator 不同chat消息之间的分隔
+const messageSeparator = "\n\n"
+
+// cumulativeConfirmations 判断为快照模式所需的内容严格增长的帧数
+// （增量流中下一段恰好以已有全文开头的情况，如"ha"之后又是"ha"，不会连续出现两次）
+const cumulativeConfirmations = 2
+
+// messageState 单条chat消息的组装状态
+type messageState struct {
+	text     string // 已经输出的完整内容
+	mode     bufferMode
+	snapshot string   // 模式未确定时，按快照解释的最新内容
+	pending  []string // 模式未确定时暂存的帧，按增量解释时依次拼接
+	grown    int      // 模式未确定时内容严格增长的帧数
+}
+
+// StreamAssembler 将update帧中的chat缓冲组装为只包含新增文本的增量
+// 同一条消息的缓冲可能是完整快照也可能是增量，第一帧之后的帧在模式确定前暂存不输出：
+// 帧不以上一次快照为前缀（也不是更短的旧快照）时确定为增量模式；
+// 连续cumulativeConfirmations帧严格增长，或其他消息输出之后该消息又出现以已有内容开头的帧时，确定为快照模式。
+// 其他消息输出或流结束（Flush）时，暂存的帧按已有证据解释后输出。多条消息按出现顺序拼接
+type StreamAssembler struct {
+	messages map[string]*messageState
+	order    []string // 消息出现的顺序，Flush时按该顺序输出
+	last     string   // 最近输出文本的消息ID
+	emitted  bool     // 是否已经输出过文本
+}
+
+// NewStreamAssembler 创建流组装器
+func NewStreamAssembler() *StreamAssembler {
+	return &StreamAssembler{messages: make(map[string]*messageState)}
+}
+
+// Feed 处理一条消息的chat缓冲，返回新增的文本（没有新内容或暂存时为空）
+func (a *StreamAssembler) Feed(messageID, content string) string {
+	if content == "" {
+		return ""
+	}
+
+	msg, ok := a.messages[messageID]
+	if !ok {
+		msg = &messageState{}
+		a.messages[messageID] = msg
+		a.order = append(a.order, messageID)
+	}
+	resumed := a.emitted && a.last != messageID
+
+	// 其他消息暂存的帧先输出，保持文本顺序
+	out := a.flushExcept(msg)
+
+	switch {
+	case msg.mode == bufferDelta, msg.text == "":
+		return out + a.emit(messageID, msg, content)
+	case msg.mode == bufferCumulative:
+		if strings.HasPrefix(content, msg.text) {
+			return out + a.emit(messageID, msg, content[len(msg.text):])
+		}
+		// 比已有内容短的旧快照
+		return out
+	}
+
+	// 模式未确定
+	switch {
+	case strings.HasPrefix(content, msg.snapshot):
+		if len(content) > len(msg.snapshot) {
+			msg.grown++
+		}
+		msg.snapshot = content
+		msg.pending = append(msg.pending, content)
+		if resumed || msg.grown >= cumulativeConfirmations {
+			return out + a.resolve(messageID, msg, bufferCumulative)
+		}
+		return out
+	case strings.HasPrefix(msg.snapshot, content):
+		// 可能是更短的旧快照，也可能是增量
+		msg.pending = append(msg.pending, content)
+		return out
+	default:
+		msg.pending = append(msg.pending, content)
+		return out + a.resolve(messageID, msg, bufferDelta)
+	}
+}
+
+// Flush 流结束时输出所有暂存的帧：有内容增长的消息按快照解释，否则按增量解释
+func (a *StreamAssembler) Flush() string {
+	return a.flushExcept(nil)
+}
+
+// flushExcept 输出除except外所有消息暂存的帧
+func (a *StreamAssembler) flushExcept(except *messageState) string {
+	var out string
+	for _, id := range a.order {
+		msg := a.messages[id]
+		if msg == except || len(msg.pending) == 0 {
+			continue
+		}
+		mode := bufferDelta
+		if msg.grown > 0 {
+			mode = bufferCumulative
+		}
+		out += a.resolve(id, msg, mode)
+	}
+	return out
+}
+
+// resolve 确定消息的模式并输出暂存的帧
+func (a *StreamAssembler) resolve(messageID string, msg *messageState, mode bufferMode) string {
+	msg.mode = mode
+	var delta string
+	if mode == bufferCumulative {
+		delta = msg.snapshot[len(msg.text):]
+	} else {
+		delta = strings.Join(msg.pending, "")
+	}
+	msg.pending, msg.snapshot = nil, ""
+	return a.emit(messageID, msg, delta)
+}
+
+// emit 记录消息新增的文本，与上一次输出的消息不同时加上分隔
+func (a *StreamAssembler) emit(messageID string, msg *messageState, delta string) string {
+	if delta == "" {
+		return ""
+	}
+
+	msg.text += delta
+	if msg.mode == bufferUnknown && msg.snapshot == "" {
+		msg.snapshot = msg.text
+	}
+	if a.emitted && a.last != messageID {
+		delta = messageSeparator + delta
+	}
+	a.last = messageID
+	a.emitted = true
+	return delta
+}
+
+// streamFrame 解析后的WebSocket帧
+type streamFrame struct {
+	kind      string          // 缓冲类型（chat、thinking、文件修改、命令执行等），state帧为空
+	messageID string          // 消息ID，没有时为空
+	content   string          // 缓冲中的文本内容
+	raw       json.RawMessage // 上游原始缓冲
+	done      bool            // 回复结束（state.inProgress为false）
+}
+
+// decodeFrame 解析一个WebSocket帧，无法识别的帧返回ok=false
+// update帧的缓冲形如 {"type":"chat","chat":{"content":"..."}}，内容位于与type同名的字段下
+func decodeFrame(message []byte) (frame streamFrame, ok bool) {
+	var data struct {
+		Type   string `json:"type"`
+		Buffer string `json:"buffer"`
+		State  struct {
+			InProgress *bool `json:"inProgress"`
+		} `json:"state"`
+	}
+	if err := json.Unmarshal(message, &data); err != nil {
+		return frame, false
+	}
+
+	switch data.Type {
+	case "update":
+		var buffer map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(data.Buffer), &buffer); err != nil {
+			return frame, false
+		}
+		kind := stringField(buffer, "type")
+		if kind == "" {
+			return frame, false
+		}
+
+		// 内容字段不是对象时忽略，仍然保留原始缓冲
+		var payload map[string]json.RawMessage
+		json.Unmarshal(buffer[kind], &payload)
+
+		frame.kind = kind
+		frame.messageID = firstNonEmpty(stringField(payload, "id"), stringField(payload, "messageId"), stringField(buffer, "id"))
+		frame.content = stringField(payload, "content")
+		frame.raw = json.RawMessage(data.Buffer)
+		return frame, true
+	case "state":
+		if data.State.InProgress != nil && !*data.State.InProgress {
+			frame.done = true
+			return frame, true
+		}
+	}
+	return frame, false
+}
+
+// stringField 读取JSON对象中的字符串字段，不存在或不是字符串时返回空
+func stringField(obj map[string]json.RawMessage, key string) string {
+	var value string
+	if raw, ok := obj[key]; ok {
+		json.Unmarshal(raw, &value)
+	}
+	return value
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package services_test
+
+import (
+	"context"
+	"cto2api/services"
+	"strings"
+	"testing"
+)
+
+func TestStreamAssembler(t *testing.T) {
+	type chunk struct{ id, content string }
+
+	// 模式确定前的帧暂存，flush为流结束时输出的内容
+	tests := []struct {
+		name   string
+		chunks []chunk
+		deltas []string
+		flush  string
+	}{
+		{
+			name:   "delta buffers",
+			chunks: []chunk{{"", "Hel"}, {"", "lo"}, {"", " world"}},
+			deltas: []string{"Hel", "lo", " world"},
+		},
+		{
+			name:   "cumulative snapshots",
+			chunks: []chunk{{"", "Hel"}, {"", "Hello"}, {"", "Hello world"}, {"", "Hello world!"}},
+			deltas: []string{"Hel", "", "lo world", "!"},
+		},
+		{
+			name:   "repeated and stale snapshots",
+			chunks: []chunk{{"", "abc"}, {"", "abc"}, {"", "abcd"}, {"", "ab"}, {"", "abcde"}, {"", "abcde"}},
+			deltas: []string{"abc", "", "", "", "de", ""},
+		},
+		{
+			name:   "single growing snapshot is resolved at the end",
+			chunks: []chunk{{"", "Hel"}, {"", "Hello"}},
+			deltas: []string{"Hel", ""},
+			flush:  "lo",
+		},
+		{
+			name:   "repeated delta chunk",
+			chunks: []chunk{{"", "ha"}, {"", "ha"}},
+			deltas: []string{"ha", ""},
+			flush:  "ha",
+		},
+		{
+			name:   "repeated delta chunks followed by other text",
+			chunks: []chunk{{"", "ha"}, {"", "ha"}, {"", "haha"}, {"", "!"}, {"", "ha"}},
+			deltas: []string{"ha", "", "", "hahaha!", "ha"},
+		},
+		{
+			name:   "delta mode is sticky",
+			chunks: []chunk{{"", "ha"}, {"", " "}, {"", "ha"}},
+			deltas: []string{"ha", " ", "ha"},
+		},
+		{
+			name:   "multiple messages are separated",
+			chunks: []chunk{{"m1", "first"}, {"m2", "second"}, {"m2", "second!"}, {"m1", "first"}},
+			deltas: []string{"first", "\n\nsecond", "", "!"},
+		},
+		{
+			name:   "held text is emitted before the next message",
+			chunks: []chunk{{"m1", "ha"}, {"m1", "ha"}, {"m2", "next"}},
+			deltas: []string{"ha", "", "ha\n\nnext"},
+		},
+		{
+			name:   "empty content",
+			chunks: []chunk{{"", ""}, {"", "x"}},
+			deltas: []string{"", "x"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := services.NewStreamAssembler()
+			for i, c := range tt.chunks {
+				if got := a.Feed(c.id, c.content); got != tt.deltas[i] {
+					t.Errorf("Feed(%q, %q) = %q, want %q", c.id, c.content, got, tt.deltas[i])
+				}
+			}
+			if got := a.Flush(); got != tt.flush {
+				t.Errorf("Flush() = %q, want %q", got, tt.flush)
+			}
+		})
+	}
+}
+
+// TestStreamMatchesFullResponse 流式增量拼接后与非流式结果一致
+func TestStreamMatchesFullResponse(t *testing.T) {
+	for _, fixture := range loadStreamFixtures(t) {
+		t.Run(fixture.ChatID, func(t *testing.T) {
+			replay := &services.Replay{}
+			replay.AddStream(fixture)
+			replay.AddStream(fixture)
+			client := services.NewCTOClient("cookie", services.Endpoints{}).UseReplay(replay)
+
+			var streamed strings.Builder
+			responseChan := make(chan services.StreamResponse, 100)
+			go client.StreamChat(context.Background(), fixture.ChatID, "token", responseChan)
+			for resp := range responseChan {
+				if resp.Error != nil {
+					t.Fatal(resp.Error)
+				}
+				streamed.WriteString(resp.Content)
+			}
+
+			full, err := client.GetFullResponse(context.Background(), fixture.ChatID, "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if streamed.String() != full {
+				t.Errorf("streamed %q, full response %q", streamed.String(), full)
+			}
+		})
+	}
+}
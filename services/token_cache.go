@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenExpirySkew   = 5 * time.Second  // 距离过期不足该时间的JWT视为已过期
+	tokenRefreshAhead = 20 * time.Second // 距离过期不足该时间时后台提前刷新
+	tokenDefaultTTL   = 50 * time.Second // 无法解析JWT过期时间时的默认有效期
+	tokenIdleTimeout  = 5 * time.Minute  // 超过该时间未使用的Cookie不再后台刷新
+	tokenRefreshTick  = 5 * time.Second  // 后台检查间隔
+)
+
+// cachedToken 单个Cookie的Clerk会话和JWT缓存
+type cachedToken struct {
+	endpoints  Endpoints // 获取该JWT时使用的上游地址，后台刷新时沿用
+	clerk      *ClerkInfo
+	jwt        string
+	expiresAt  time.Time
+	lastUsed   time.Time
+	refreshing bool
+}
+
+// valid JWT是否仍可使用
+func (t *cachedToken) valid(now time.Time) bool {
+	return t.jwt != "" && now.Before(t.expiresAt.Add(-tokenExpirySkew))
+}
+
+// TokenCache 按Cookie缓存Clerk会话ID和JWT，在过期前复用并提前刷新
+type TokenCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedToken
+	stop    chan struct{}
+}
+
+var sharedTokenCache = NewTokenCache()
+
+// SharedTokenCache 所有CTOClient共享的令牌缓存
+func SharedTokenCache() *TokenCache {
+	return sharedTokenCache
+}
+
+// NewTokenCache 创建令牌缓存
+func NewTokenCache() *TokenCache {
+	return &TokenCache{
+		entries: make(map[string]*cachedToken),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start 启动后台提前刷新
+func (tc *TokenCache) Start() {
+	go func() {
+		ticker := time.NewTicker(tokenRefreshTick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				tc.refreshExpiring()
+			case <-tc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止后台刷新
+func (tc *TokenCache) Stop() {
+	close(tc.stop)
+}
+
+// Invalidate 丢弃Cookie的缓存（收到401时调用）
+func (tc *TokenCache) Invalidate(cookie string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	delete(tc.entries, cookie)
+}
+
+// get 获取仍然有效的缓存并记录使用时间
+func (tc *TokenCache) get(cookie string) (*ClerkInfo, string, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	entry, ok := tc.entries[cookie]
+	if !ok {
+		return nil, "", false
+	}
+	now := time.Now()
+	entry.lastUsed = now
+	if !entry.valid(now) {
+		return entry.clerk, "", false
+	}
+	return entry.clerk, entry.jwt, true
+}
+
+// put 保存新获取的会话和JWT
+func (tc *TokenCache) put(cookie string, endpoints Endpoints, clerk *ClerkInfo, jwt string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	entry, ok := tc.entries[cookie]
+	if !ok {
+		entry = &cachedToken{lastUsed: time.Now()}
+		tc.entries[cookie] = entry
+	}
+	entry.endpoints = endpoints
+	entry.clerk = clerk
+	entry.jwt = jwt
+	entry.expiresAt = jwtExpiry(jwt)
+}
+
+// refreshExpiring 提前刷新即将过期且最近使用过的JWT，清理长期未使用的缓存
+func (tc *TokenCache) refreshExpiring() {
+	now := time.Now()
+
+	tc.mu.Lock()
+	due := make(map[string]*cachedToken)
+	for cookie, entry := range tc.entries {
+		if now.Sub(entry.lastUsed) > tokenIdleTimeout {
+			delete(tc.entries, cookie)
+			continue
+		}
+		if entry.refreshing || now.Before(entry.expiresAt.Add(-tokenRefreshAhead)) {
+			continue
+		}
+		entry.refreshing = true
+		due[cookie] = entry
+	}
+	tc.mu.Unlock()
+
+	for cookie, entry := range due {
+		go tc.refresh(cookie, entry)
+	}
+}
+
+// refresh 后台复用会话ID刷新单个Cookie的JWT
+// 刷新期间缓存被丢弃（收到401）或被重新获取的会话替换时不写回，避免恢复已失效的会话
+// 刷新失败时保留原缓存，JWT过期后由请求重新获取会话
+func (tc *TokenCache) refresh(cookie string, entry *cachedToken) {
+	tc.mu.Lock()
+	endpoints, sessionID := entry.endpoints, entry.clerk.SessionID
+	tc.mu.Unlock()
+
+	jwt, err := NewCTOClient(cookie, endpoints).GetJWT(context.Background(), sessionID)
+
+	tc.mu.Lock()
+	entry.refreshing = false
+	if err == nil && tc.entries[cookie] == entry {
+		entry.jwt = jwt
+		entry.expiresAt = jwtExpiry(jwt)
+	}
+	tc.mu.Unlock()
+
+	if err != nil {
+		slog.Warn("后台刷新JWT失败", "error", err)
+	}
+}
+
+// jwtExpiry 解析JWT的exp字段，失败时使用默认有效期
+func jwtExpiry(jwt string) time.Time {
+	parts := strings.Split(jwt, ".")
+	if len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+			var claims struct {
+				Exp int64 `json:"exp"`
+			}
+			if json.Unmarshal(payload, &claims) == nil && claims.Exp > 0 {
+				return time.Unix(claims.Exp, 0)
+			}
+		}
+	}
+	return time.Now().Add(tokenDefaultTTL)
+}
+
+// Authenticate 获取Clerk会话和JWT，优先使用缓存
+// 缓存的JWT过期时复用会话ID只刷新JWT，会话失效时重新获取会话
+func (c *CTOClient) Authenticate(ctx context.Context) (*ClerkInfo, string, error) {
+	clerk, jwt, ok := c.tokens.get(c.cookie)
+	if ok {
+		return clerk, jwt, nil
+	}
+
+	if clerk != nil {
+		jwt, err := c.GetJWT(ctx, clerk.SessionID)
+		if err == nil {
+			c.tokens.put(c.cookie, c.endpoints, clerk, jwt)
+			return clerk, jwt, nil
+		}
+		// 请求被取消时会话仍然有效，保留缓存
+		if ctx.Err() != nil {
+			return nil, "", &AuthError{Stage: "jwt", Err: err}
+		}
+		// 会话可能已失效，丢弃缓存后重新获取会话
+		c.tokens.Invalidate(c.cookie)
+	}
+
+	clerk, err := c.GetClerkInfo(ctx)
+	if err != nil {
+		return nil, "", &AuthError{Stage: "clerk", Err: err}
+	}
+
+	jwt, err = c.GetJWT(ctx, clerk.SessionID)
+	if err != nil {
+		return nil, "", &AuthError{Stage: "jwt", Err: err}
+	}
+
+	c.tokens.put(c.cookie, c.endpoints, clerk, jwt)
+	return clerk, jwt, nil
+}
+
+// invalidateOn401 上游返回401时丢弃缓存的JWT
+func (c *CTOClient) invalidateOn401(err error) {
+	if isUnauthorized(err) {
+		c.tokens.Invalidate(c.cookie)
+	}
+}
+
+// isUnauthorized 是否是上游401（JWT失效）
+func isUnauthorized(err error) bool {
+	var upstreamErr *UpstreamError
+	return errors.As(err, &upstreamErr) && upstreamErr.StatusCode == http.StatusUnauthorized
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newJWTServer 为任何会话签发固定JWT的上游
+func newJWTServer(t *testing.T, jwt string) Endpoints {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"object": "token", "jwt": jwt})
+	}))
+	t.Cleanup(server.Close)
+	return Endpoints{ClerkBaseURL: server.URL}
+}
+
+func TestTokenCacheRefresh(t *testing.T) {
+	endpoints := newJWTServer(t, "refreshed")
+	clerk := &ClerkInfo{SessionID: "sess_1"}
+
+	t.Run("updates the entry", func(t *testing.T) {
+		tc := NewTokenCache()
+		tc.put("c", endpoints, clerk, "old")
+		entry := tc.entries["c"]
+		entry.refreshing = true
+
+		tc.refresh("c", entry)
+		if entry.jwt != "refreshed" || entry.refreshing {
+			t.Errorf("entry after refresh = %+v", entry)
+		}
+	})
+
+	t.Run("skips an invalidated entry", func(t *testing.T) {
+		tc := NewTokenCache()
+		tc.put("c", endpoints, clerk, "old")
+		entry := tc.entries["c"]
+
+		// 刷新期间收到401丢弃了缓存
+		tc.Invalidate("c")
+		tc.refresh("c", entry)
+		if _, ok := tc.entries["c"]; ok {
+			t.Error("refresh recreated an invalidated entry")
+		}
+	})
+
+	t.Run("skips a replaced entry", func(t *testing.T) {
+		tc := NewTokenCache()
+		tc.put("c", endpoints, clerk, "old")
+		entry := tc.entries["c"]
+
+		// 刷新期间请求重新获取了会话
+		tc.Invalidate("c")
+		tc.put("c", endpoints, &ClerkInfo{SessionID: "sess_2"}, "new")
+		tc.refresh("c", entry)
+		if current := tc.entries["c"]; current.jwt != "new" || current.clerk.SessionID != "sess_2" {
+			t.Errorf("entry = %+v, want the replacement kept", current)
+		}
+	})
+}
+
+func TestTokenCacheRefreshExpiring(t *testing.T) {
+	endpoints := newJWTServer(t, "refreshed")
+	tc := NewTokenCache()
+	now := time.Now()
+
+	tc.put("fresh", endpoints, &ClerkInfo{SessionID: "s1"}, "fresh")
+	tc.put("expiring", endpoints, &ClerkInfo{SessionID: "s2"}, "expiring")
+	tc.put("idle", endpoints, &ClerkInfo{SessionID: "s3"}, "idle")
+	tc.entries["fresh"].expiresAt = now.Add(time.Minute)
+	tc.entries["expiring"].expiresAt = now.Add(tokenRefreshAhead / 2)
+	tc.entries["idle"].lastUsed = now.Add(-2 * tokenIdleTimeout)
+
+	tc.refreshExpiring()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tc.mu.Lock()
+		jwt, refreshing := tc.entries["expiring"].jwt, tc.entries["expiring"].refreshing
+		tc.mu.Unlock()
+		if jwt == "refreshed" && !refreshing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expiring entry not refreshed: jwt = %q", jwt)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if _, ok := tc.entries["idle"]; ok {
+		t.Error("idle entry was not dropped")
+	}
+	if fresh := tc.entries["fresh"]; fresh.jwt != "fresh" || fresh.refreshing {
+		t.Errorf("fresh entry = %+v, want it left alone", fresh)
+	}
+}
@@ -0,0 +1,62 @@
+package services_test
+
+import (
+	"context"
+	"cto2api/internal/fakeupstream"
+	"cto2api/services"
+	"testing"
+)
+
+func TestTokenCacheReusesSessionAndJWT(t *testing.T) {
+	upstream := fakeupstream.New()
+	defer upstream.Close()
+	account := upstream.AddAccount(&fakeupstream.Account{Cookie: "__client=token-cache"})
+	t.Cleanup(func() { services.SharedTokenCache().Invalidate(account.Cookie) })
+
+	authenticate := func() string {
+		t.Helper()
+		// 每次使用新的客户端，缓存在客户端之间共享
+		clerk, jwt, err := services.NewCTOClient(account.Cookie, upstream.Endpoints()).Authenticate(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clerk.SessionID != account.SessionID || jwt == "" {
+			t.Fatalf("authenticate = %+v, %q", clerk, jwt)
+		}
+		return jwt
+	}
+	calls := func() (int, int) { return upstream.ClerkCalls(), upstream.TokenCalls() }
+
+	first := authenticate()
+	if second := authenticate(); second != first {
+		t.Errorf("second JWT = %q, want the cached %q", second, first)
+	}
+	if clerk, tokens := calls(); clerk != 1 || tokens != 1 {
+		t.Errorf("upstream calls = %d clerk, %d tokens, want 1 each", clerk, tokens)
+	}
+
+	// 丢弃缓存后重新获取会话和JWT
+	services.SharedTokenCache().Invalidate(account.Cookie)
+	authenticate()
+	if clerk, tokens := calls(); clerk != 2 || tokens != 2 {
+		t.Errorf("upstream calls after invalidate = %d clerk, %d tokens, want 2 each", clerk, tokens)
+	}
+}
+
+func TestTokenCacheDoesNotCacheFailures(t *testing.T) {
+	upstream := fakeupstream.New()
+	defer upstream.Close()
+	account := upstream.AddAccount(&fakeupstream.Account{Cookie: "__client=token-cache-fail", TokenStatus: 500})
+	t.Cleanup(func() { services.SharedTokenCache().Invalidate(account.Cookie) })
+
+	for i := 1; i <= 2; i++ {
+		_, _, err := services.NewCTOClient(account.Cookie, upstream.Endpoints()).Authenticate(context.Background())
+		if err == nil {
+			t.Fatal("authenticate succeeded, want the token error")
+		}
+		// 没有缓存可复用，每次都重新获取会话
+		if clerk := upstream.ClerkCalls(); clerk != i {
+			t.Errorf("attempt %d: clerk calls = %d, want %d", i, clerk, i)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// 工具调用在上游输出中的标记
+const (
+	toolCallOpenTag  = "<tool_call>"
+	toolCallCloseTag = "</tool_call>"
+)
+
+// ToolSpec 工具定义
+type ToolSpec struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+}
+
+// ParsedToolCall 从上游输出中解析出的工具调用
+type ParsedToolCall struct {
+	Name      string
+	Arguments string // JSON字符串
+}
+
+// BuildToolPrompt 生成注入到prompt中的工具说明
+// forced 为空表示由模型自行决定，"*" 表示必须调用任一工具，其他值表示必须调用指定工具
+func BuildToolPrompt(tools []ToolSpec, forced string) string {
+	var sb strings.Builder
+	sb.WriteString("You have access to the following tools. ")
+	sb.WriteString("To call a tool, output a block in exactly this format and nothing else inside it:\n")
+	sb.WriteString(toolCallOpenTag + "\n")
+	sb.WriteString(`{"name": "<tool name>", "arguments": {<arguments as JSON object>}}` + "\n")
+	sb.WriteString(toolCallCloseTag + "\n")
+	sb.WriteString("You may output several blocks to call several tools. ")
+	sb.WriteString("After calling tools, stop and wait: the results will be provided in the next message as Tool messages. ")
+	sb.WriteString("Do not use your own built-in tools to perform these actions and do not invent tool results.\n\n")
+	sb.WriteString("Available tools:\n")
+
+	for _, tool := range tools {
+		sb.WriteString("- " + tool.Name)
+		if tool.Description != "" {
+			sb.WriteString(": " + tool.Description)
+		}
+		sb.WriteString("\n")
+		if params := bytes.TrimSpace(tool.Parameters); len(params) > 0 && !bytes.Equal(params, []byte("null")) {
+			sb.WriteString("  parameters: " + string(params) + "\n")
+		}
+	}
+
+	switch forced {
+	case "":
+	case "*":
+		sb.WriteString("\nYou must call at least one tool in your reply.")
+	default:
+		sb.WriteString(fmt.Sprintf("\nYou must call the tool %q in your reply.", forced))
+	}
+
+	return sb.String()
+}
+
+// RenderToolCalls 将助手文本和工具调用渲染为上游可理解的文本
+// 与ToolCallParser解析的格式一致，用于回放历史和计算会话指纹
+func RenderToolCalls(text string, calls []ParsedToolCall) string {
+	parts := make([]string, 0, len(calls)+1)
+	if text = strings.TrimSpace(text); text != "" {
+		parts = append(parts, text)
+	}
+	for _, call := range calls {
+		args := call.Arguments
+		if strings.TrimSpace(args) == "" {
+			args = "{}"
+		}
+		parts = append(parts, fmt.Sprintf("%s\n{\"name\": %q, \"arguments\": %s}\n%s", toolCallOpenTag, call.Name, args, toolCallCloseTag))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// ToolCallParser 从流式输出中增量解析工具调用
+type ToolCallParser struct {
+	buf    string // 尚未处理的内容
+	inCall bool   // 是否处于 <tool_call> 块内
+}
+
+// NewToolCallParser 创建解析器
+func NewToolCallParser() *ToolCallParser {
+	return &ToolCallParser{}
+}
+
+// Feed 输入一段内容，返回可以安全输出的文本和已完成的工具调用
+func (p *ToolCallParser) Feed(chunk string) (string, []ParsedToolCall) {
+	p.buf += chunk
+
+	var text strings.Builder
+	var calls []ParsedToolCall
+
+	for {
+		if !p.inCall {
+			idx := strings.Index(p.buf, toolCallOpenTag)
+			if idx < 0 {
+				// 保留可能是开始标记前缀的尾部
+				keep := partialSuffix(p.buf, toolCallOpenTag)
+				text.WriteString(p.buf[:len(p.buf)-keep])
+				p.buf = p.buf[len(p.buf)-keep:]
+				break
+			}
+			text.WriteString(p.buf[:idx])
+			p.buf = p.buf[idx+len(toolCallOpenTag):]
+			p.inCall = true
+			continue
+		}
+
+		idx := strings.Index(p.buf, toolCallCloseTag)
+		if idx < 0 {
+			break
+		}
+		body := p.buf[:idx]
+		p.buf = p.buf[idx+len(toolCallCloseTag):]
+		p.inCall = false
+
+		if call, ok := parseToolCall(body); ok {
+			calls = append(calls, call)
+		} else {
+			text.WriteString(toolCallOpenTag + body + toolCallCloseTag)
+		}
+	}
+
+	return text.String(), calls
+}
+
+// Flush 输入结束，返回剩余文本和工具调用（未闭合的调用块尽量解析）
+func (p *ToolCallParser) Flush() (string, []ParsedToolCall) {
+	rest := p.buf
+	inCall := p.inCall
+	p.buf = ""
+	p.inCall = false
+
+	if !inCall {
+		return rest, nil
+	}
+	if call, ok := parseToolCall(rest); ok {
+		return "", []ParsedToolCall{call}
+	}
+	return toolCallOpenTag + rest, nil
+}
+
+// parseToolCall 解析调用块中的JSON
+func parseToolCall(body string) (ParsedToolCall, bool) {
+	body = strings.TrimSpace(body)
+	// 兼容模型用代码块包裹JSON的情况
+	body = strings.TrimPrefix(body, "```json")
+	body = strings.TrimPrefix(body, "```")
+	body = strings.TrimSuffix(body, "```")
+	body = strings.TrimSpace(body)
+
+	var raw struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(body), &raw); err != nil || raw.Name == "" {
+		return ParsedToolCall{}, false
+	}
+
+	args := bytes.TrimSpace(raw.Arguments)
+	switch {
+	case len(args) == 0 || bytes.Equal(args, []byte("null")):
+		args = []byte("{}")
+	case args[0] == '"':
+		// arguments 已经是JSON字符串
+		var s string
+		if err := json.Unmarshal(args, &s); err == nil {
+			args = []byte(s)
+		}
+	default:
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, args); err == nil {
+			args = compact.Bytes()
+		}
+	}
+
+	return ParsedToolCall{Name: raw.Name, Arguments: string(args)}, true
+}
+
+// partialSuffix 返回s末尾与tag前缀重合的最大长度
+func partialSuffix(s, tag string) int {
+	max := len(tag) - 1
+	if max > len(s) {
+		max = len(s)
+	}
+	for n := max; n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
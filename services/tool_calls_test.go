@@ -0,0 +1,137 @@
+package services_test
+
+import (
+	"cto2api/services"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// feedAll 依次输入所有片段并结束，返回输出的全部文本和工具调用
+func feedAll(chunks ...string) (string, []services.ParsedToolCall) {
+	parser := services.NewToolCallParser()
+	var text strings.Builder
+	var calls []services.ParsedToolCall
+	for _, chunk := range chunks {
+		t, c := parser.Feed(chunk)
+		text.WriteString(t)
+		calls = append(calls, c...)
+	}
+	t, c := parser.Flush()
+	text.WriteString(t)
+	return text.String(), append(calls, c...)
+}
+
+func TestToolCallParser(t *testing.T) {
+	weather := services.ParsedToolCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}
+	clock := services.ParsedToolCall{Name: "get_time", Arguments: `{}`}
+
+	tests := []struct {
+		name   string
+		chunks []string
+		text   string
+		calls  []services.ParsedToolCall
+	}{
+		{
+			name:   "plain text",
+			chunks: []string{"Hello", ", world"},
+			text:   "Hello, world",
+		},
+		{
+			name:   "single call",
+			chunks: []string{"Checking.\n<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\"}}\n</tool_call>"},
+			text:   "Checking.\n",
+			calls:  []services.ParsedToolCall{weather},
+		},
+		{
+			name:   "tags split across chunks",
+			chunks: []string{"Checking.<to", "ol_ca", "ll>{\"name\": \"get_wea", "ther\", \"arguments\": {\"city\": \"Paris\"}}</tool", "_call> done"},
+			text:   "Checking. done",
+			calls:  []services.ParsedToolCall{weather},
+		},
+		{
+			name: "multiple calls",
+			chunks: []string{
+				`<tool_call>{"name": "get_weather", "arguments": {"city": "Paris"}}</tool_call>`,
+				"\n",
+				`<tool_call>{"name": "get_time"}</tool_call>`,
+			},
+			text:  "\n",
+			calls: []services.ParsedToolCall{weather, clock},
+		},
+		{
+			name:   "string arguments and code fence",
+			chunks: []string{"<tool_call>```json\n{\"name\": \"get_weather\", \"arguments\": \"{\\\"city\\\":\\\"Paris\\\"}\"}\n```</tool_call>"},
+			calls:  []services.ParsedToolCall{weather},
+		},
+		{
+			name:   "malformed JSON is returned as text",
+			chunks: []string{"<tool_call>{\"name\": \"get_weather\", </tool_call>ok"},
+			text:   "<tool_call>{\"name\": \"get_weather\", </tool_call>ok",
+		},
+		{
+			name:   "call without a name is returned as text",
+			chunks: []string{`<tool_call>{"arguments": {}}</tool_call>`},
+			text:   `<tool_call>{"arguments": {}}</tool_call>`,
+		},
+		{
+			name:   "text mentioning the markers",
+			chunks: []string{"Wrap calls in <tool_call> and </tool_call> tags, e.g. <tool_", "x>."},
+			text:   "Wrap calls in <tool_call> and </tool_call> tags, e.g. <tool_x>.",
+		},
+		{
+			name:   "unclosed open tag in text",
+			chunks: []string{"Use the <tool_call> tag", " to call tools."},
+			text:   "Use the <tool_call> tag to call tools.",
+		},
+		{
+			name:   "unclosed call is parsed at the end",
+			chunks: []string{`<tool_call>{"name": "get_time", "arguments": {}}`},
+			calls:  []services.ParsedToolCall{clock},
+		},
+		{
+			name:   "trailing partial tag is kept until the end",
+			chunks: []string{"Almost <tool_c"},
+			text:   "Almost <tool_c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, calls := feedAll(tt.chunks...)
+			if text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("calls = %+v, want %+v", calls, tt.calls)
+			}
+		})
+	}
+}
+
+// TestToolCallParserHoldsPartialTag 可能是开始标记的尾部不提前输出
+func TestToolCallParserHoldsPartialTag(t *testing.T) {
+	parser := services.NewToolCallParser()
+	if text, _ := parser.Feed("Hello <tool"); text != "Hello " {
+		t.Errorf("text = %q, want the partial tag held back", text)
+	}
+	if text, _ := parser.Feed("box>"); text != "<toolbox>" {
+		t.Errorf("text = %q, want the held text released", text)
+	}
+}
+
+// TestRenderToolCallsRoundTrip 渲染的工具调用能被解析器还原
+func TestRenderToolCallsRoundTrip(t *testing.T) {
+	calls := []services.ParsedToolCall{
+		{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+		{Name: "get_time", Arguments: ""},
+	}
+	text, parsed := feedAll(services.RenderToolCalls("  Let me check. ", calls))
+	if text != "Let me check.\n\n" {
+		t.Errorf("text = %q", text)
+	}
+	want := []services.ParsedToolCall{calls[0], {Name: "get_time", Arguments: "{}"}}
+	if !reflect.DeepEqual(parsed, want) {
+		t.Errorf("parsed = %+v, want %+v", parsed, want)
+	}
+}
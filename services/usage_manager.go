@@ -1,111 +1,195 @@
 package services
 
 import (
+	"context"
+	"cto2api/models"
+	"fmt"
+	"log/slog"
+	"math/rand"
 	"sync"
 	"time"
 )
 
-// UsageManager 用量管理器
+const (
+	usageTickInterval = 10 * time.Second // 后台检查到期Cookie的间隔
+	usageBaseBackoff  = time.Minute      // 刷新失败后的首次重试间隔，之后翻倍
+)
+
+// usageSchedule 单个Cookie的用量刷新计划
+type usageSchedule struct {
+	nextRefresh time.Time
+	failures    int  // 连续失败次数
+	refreshing  bool // 刷新进行中
+}
+
+// UsageManager 用量管理器：按Cookie缓存用量，后台定期刷新
 type UsageManager struct {
-	mu            sync.RWMutex
-	billingInfo   *BillingInfo
-	lastUpdate    time.Time
+	mu             sync.Mutex
+	store          *models.DataStore
+	endpoints      Endpoints
 	updateInterval time.Duration
-	updating      bool
+	maxBackoff     time.Duration
+	schedules      map[string]*usageSchedule
+	ctx            context.Context // 后台刷新使用，Stop时取消
+	cancel         context.CancelFunc
 }
 
 // NewUsageManager 创建用量管理器
-func NewUsageManager() *UsageManager {
+func NewUsageManager(store *models.DataStore, endpoints Endpoints, updateInterval time.Duration) *UsageManager {
+	if updateInterval <= 0 {
+		updateInterval = 5 * time.Minute
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &UsageManager{
-		updateInterval: 5 * time.Minute, // 5分钟更新一次
+		store:          store,
+		endpoints:      endpoints,
+		updateInterval: updateInterval,
+		maxBackoff:     30 * time.Minute,
+		schedules:      make(map[string]*usageSchedule),
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 }
 
-// GetBillingInfo 获取用量信息（带缓存）
-func (m *UsageManager) GetBillingInfo(client *CTOClient, jwt string) (*BillingInfo, error) {
-	m.mu.RLock()
-	// 如果缓存有效，直接返回
-	if m.billingInfo != nil && time.Since(m.lastUpdate) < m.updateInterval {
-		info := m.billingInfo
-		m.mu.RUnlock()
-		return info, nil
-	}
-	m.mu.RUnlock()
+// Start 启动后台刷新
+func (m *UsageManager) Start() {
+	go func() {
+		m.refreshDue()
+
+		ticker := time.NewTicker(usageTickInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.refreshDue()
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止后台刷新，并取消进行中的后台请求
+func (m *UsageManager) Stop() {
+	m.cancel()
+}
+
+// Refresh 立即刷新指定Cookie的用量，ctx取消后不再继续请求上游
+func (m *UsageManager) Refresh(ctx context.Context, cookie *models.CookieInfo) (*BillingInfo, error) {
+	m.mu.Lock()
+	schedule := m.schedule(cookie.ID)
+	schedule.refreshing = true
+	m.mu.Unlock()
+
+	return m.refresh(ctx, cookie.ID, cookie.Cookie)
+}
+
+// refreshDue 刷新所有到期的启用Cookie
+func (m *UsageManager) refreshDue() {
+	cookies := m.store.CookieSnapshots()
+	now := time.Now()
 
-	// 需要更新
 	m.mu.Lock()
-	// 双重检查，避免重复更新
-	if m.billingInfo != nil && time.Since(m.lastUpdate) < m.updateInterval {
-		info := m.billingInfo
-		m.mu.Unlock()
-		return info, nil
+	defer m.mu.Unlock()
+
+	active := make(map[string]bool, len(cookies))
+	for _, cookie := range cookies {
+		if !cookie.Enabled {
+			continue
+		}
+		active[cookie.ID] = true
+
+		schedule := m.schedule(cookie.ID)
+		if schedule.refreshing || now.Before(schedule.nextRefresh) {
+			continue
+		}
+		schedule.refreshing = true
+		go m.refresh(m.ctx, cookie.ID, cookie.Cookie)
 	}
 
-	// 如果正在更新，返回旧数据（如果有）
-	if m.updating {
-		info := m.billingInfo
-		m.mu.Unlock()
-		if info != nil {
-			return info, nil
+	// 清理已删除或禁用的Cookie
+	for id, schedule := range m.schedules {
+		if !active[id] && !schedule.refreshing {
+			delete(m.schedules, id)
 		}
-		// 如果没有旧数据，等待更新完成
-		time.Sleep(100 * time.Millisecond)
-		return m.GetBillingInfo(client, jwt)
 	}
+}
 
-	m.updating = true
-	m.mu.Unlock()
+// refresh 获取用量并记录结果，安排下一次刷新
+func (m *UsageManager) refresh(ctx context.Context, id, cookie string) (*BillingInfo, error) {
+	billing, err := fetchBilling(ctx, NewCTOClient(cookie, m.endpoints))
 
-	// 执行更新
-	info, err := client.GetBillingInfo(jwt)
-	
 	m.mu.Lock()
-	m.updating = false
-	if err == nil {
-		m.billingInfo = info
-		m.lastUpdate = time.Now()
+	schedule := m.schedule(id)
+	schedule.refreshing = false
+	if err != nil {
+		schedule.failures++
+		schedule.nextRefresh = time.Now().Add(m.backoff(schedule.failures))
+	} else {
+		schedule.failures = 0
+		schedule.nextRefresh = time.Now().Add(jitter(m.updateInterval))
 	}
 	m.mu.Unlock()
 
-	return info, err
+	if err != nil {
+		slog.Warn("Cookie用量刷新失败", "cookie_id", id, "error", err)
+		return nil, err
+	}
+
+	m.store.SetUsage(id, &models.UsageInfo{
+		TaskCreditsUsage:     billing.TaskCreditsUsage,
+		TaskCreditsLimit:     billing.TaskCreditsLimit,
+		TaskConcurrencyUsage: billing.TaskConcurrencyUsage,
+		TaskConcurrencyLimit: billing.TaskConcurrencyLimit,
+		LastUpdate:           time.Now().Format(models.UsageTimeLayout),
+	})
+	return billing, nil
 }
 
-// RefreshAsync 异步刷新用量信息
-func (m *UsageManager) RefreshAsync(client *CTOClient, jwt string) {
-	go func() {
-		m.mu.RLock()
-		if m.updating {
-			m.mu.RUnlock()
-			return
+// schedule 获取Cookie的刷新计划，新Cookie在一个抖动区间内尽快刷新（调用方需持有锁）
+func (m *UsageManager) schedule(id string) *usageSchedule {
+	schedule, ok := m.schedules[id]
+	if !ok {
+		schedule = &usageSchedule{
+			nextRefresh: time.Now().Add(time.Duration(rand.Int63n(int64(usageTickInterval)))),
 		}
-		m.mu.RUnlock()
-
-		m.mu.Lock()
-		m.updating = true
-		m.mu.Unlock()
-
-		info, err := client.GetBillingInfo(jwt)
-		
-		m.mu.Lock()
-		m.updating = false
-		if err == nil {
-			m.billingInfo = info
-			m.lastUpdate = time.Now()
-		}
-		m.mu.Unlock()
-	}()
+		m.schedules[id] = schedule
+	}
+	return schedule
+}
+
+// backoff 第n次连续失败后的重试间隔
+func (m *UsageManager) backoff(failures int) time.Duration {
+	d := usageBaseBackoff
+	for i := 1; i < failures && d < m.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > m.maxBackoff {
+		d = m.maxBackoff
+	}
+	return jitter(d)
 }
 
-// GetCached 获取缓存的用量信息（不触发更新）
-func (m *UsageManager) GetCached() *BillingInfo {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.billingInfo
+// jitter 在±10%范围内随机调整时长，避免所有Cookie同时刷新
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d) / 5
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread/2) + time.Duration(rand.Int63n(spread))
 }
 
-// IsStale 检查缓存是否过期
-func (m *UsageManager) IsStale() bool {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return m.billingInfo == nil || time.Since(m.lastUpdate) >= m.updateInterval
-}
\ No newline at end of file
+// fetchBilling 通过缓存的JWT获取用量信息
+func fetchBilling(ctx context.Context, client *CTOClient) (*BillingInfo, error) {
+	_, jwt, err := client.Authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	billing, err := client.GetBillingInfo(ctx, jwt)
+	if err != nil {
+		return nil, fmt.Errorf("获取用量信息失败: %w", err)
+	}
+	return billing, nil
+}
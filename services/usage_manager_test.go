@@ -0,0 +1,53 @@
+package services_test
+
+import (
+	"context"
+	"cto2api/internal/fakeupstream"
+	"cto2api/models"
+	"cto2api/services"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUsageManagerRefresh(t *testing.T) {
+	upstream := fakeupstream.New()
+	defer upstream.Close()
+	account := upstream.AddAccount(&fakeupstream.Account{
+		Cookie:  "__client=usage",
+		Billing: services.BillingInfo{TaskCreditsUsage: 3, TaskCreditsLimit: 10, TaskConcurrencyLimit: 2},
+	})
+	t.Cleanup(func() { services.SharedTokenCache().Invalidate(account.Cookie) })
+
+	store, err := models.NewDataStore(openTestStorage(t, filepath.Join(t.TempDir(), "test.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := &models.CookieInfo{ID: "c1", Name: "c1", Cookie: account.Cookie, Enabled: true, CreatedAt: time.Now()}
+	if err := store.AddCookie(cookie); err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有Start时不在后台刷新，Stop可以重复调用
+	manager := services.NewUsageManager(store, upstream.Endpoints(), time.Minute)
+	defer manager.Stop()
+	manager.Stop()
+
+	// 调用方取消时不请求上游
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := manager.Refresh(ctx, cookie); err == nil {
+		t.Error("refresh with a cancelled context succeeded")
+	}
+
+	billing, err := manager.Refresh(context.Background(), cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if billing.TaskCreditsUsage != 3 {
+		t.Errorf("billing = %+v", billing)
+	}
+	if usage := store.GetCookie("c1").Usage; usage == nil || usage.TaskCreditsLimit != 10 || usage.TaskConcurrencyLimit != 2 {
+		t.Errorf("stored usage = %+v", usage)
+	}
+}